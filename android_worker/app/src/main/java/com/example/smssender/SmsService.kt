@@ -3,7 +3,9 @@ package com.example.smssender
 import android.app.*
 import android.content.*
 import android.os.*
+import android.provider.Settings
 import android.telephony.SmsManager
+import android.telephony.SmsMessage
 import androidx.core.app.NotificationCompat
 import org.json.JSONObject
 import java.net.HttpURLConnection
@@ -19,18 +21,41 @@ class SmsService : Service() {
     private lateinit var dbHelper: DatabaseHelper
     private val taskExecutor = Executors.newSingleThreadScheduledExecutor()
     private val urlEndpoint = "http://192.168.8.204:8080/api/v0/ready"
+    // The server hands each request to one named worker and only takes that worker's PATCHes for it
+    private val workerName by lazy {
+        "android-" + Settings.Secure.getString(contentResolver, Settings.Secure.ANDROID_ID)
+    }
     private val SMS_SENT_ACTION = "SMS_SENT_ACTION"
+    private val SMS_DELIVERED_ACTION = "SMS_DELIVERED_ACTION"
 
     private val MIN_DELAY_MS = 2000L
 
     // Global variable initialized to current time on start
     private var lastSentTime: Long = 0L
 
+    // Status reports can show up minutes after the send, so this one lives as long as the service
+    private val deliveryReceiver = object : BroadcastReceiver() {
+        override fun onReceive(context: Context?, intent: Intent?) {
+            val id = intent?.getStringExtra("sms_id") ?: return
+            val pdu = intent.getByteArrayExtra("pdu")
+            val format = intent.getStringExtra("format")
+            // TP-Status from the status report PDU, fall back on the result code if the radio skipped it
+            val pduStatus = if (pdu != null) {
+                SmsMessage.createFromPdu(pdu, format).status
+            } else if (resultCode == Activity.RESULT_OK) 0 else 0x40
+
+            Log.d("SMS_SYNC", "Delivery report for $id, TP-Status $pduStatus")
+            taskExecutor.execute { performDeliveryReport(id, pduStatus) }
+        }
+    }
+
     override fun onCreate() {
         super.onCreate()
         dbHelper = DatabaseHelper(this)
         // Populate global variable with current time to start the gap immediately
         lastSentTime = System.currentTimeMillis()
+        // Only our own PendingIntents deliver here, nothing else on the phone gets to fake a report
+        registerReceiver(deliveryReceiver, IntentFilter(SMS_DELIVERED_ACTION), RECEIVER_NOT_EXPORTED)
     }
 
     override fun onStartCommand(intent: Intent?, flags: Int, startId: Int): Int {
@@ -66,10 +91,18 @@ class SmsService : Service() {
 
     private fun performNetworkCycle() {
         try {
-            val connection = URL(urlEndpoint).openConnection() as HttpURLConnection
+            val connection = URL("$urlEndpoint?worker=$workerName").openConnection() as HttpURLConnection
             connection.requestMethod = "GET"
             connection.connectTimeout = 5000
 
+            // The server paces sends now, a 429 means wait as long as it says before asking again
+            if (connection.responseCode == 429) {
+                val retryAfterMs = (connection.getHeaderField("Retry-After")?.toLongOrNull() ?: 5L) * 1000L
+                Log.d("SMS_SYNC", "Throttled by server, next poll in ${retryAfterMs}ms")
+                taskExecutor.schedule({ performNetworkCycle() }, retryAfterMs, TimeUnit.MILLISECONDS)
+                return
+            }
+
             val responseString = connection.inputStream.bufferedReader().readText()
             val json = JSONObject(responseString)
             val smsRequest = json.getJSONObject("smsrequest")
@@ -96,10 +129,18 @@ class SmsService : Service() {
 
         val sentIntent = PendingIntent.getBroadcast(
             this, requestCode,
-            Intent(SMS_SENT_ACTION).apply { putExtra("sms_id", id) },
+            Intent(SMS_SENT_ACTION).apply { setPackage(packageName); putExtra("sms_id", id) },
             PendingIntent.FLAG_IMMUTABLE or PendingIntent.FLAG_UPDATE_CURRENT
         )
 
+        // Needs to stay mutable so the radio can attach the status report pdu, which means it has to
+        // name our package too (a mutable implicit intent is refused from Android 14)
+        val deliveredIntent = PendingIntent.getBroadcast(
+            this, requestCode + 1,
+            Intent(SMS_DELIVERED_ACTION).apply { setPackage(packageName); putExtra("sms_id", id) },
+            PendingIntent.FLAG_MUTABLE or PendingIntent.FLAG_UPDATE_CURRENT
+        )
+
         val receiver = object : BroadcastReceiver() {
             override fun onReceive(context: Context?, intent: Intent?) {
                 val receivedId = intent?.getStringExtra("sms_id") ?: id
@@ -129,8 +170,8 @@ class SmsService : Service() {
             }
         }
 
-        registerReceiver(receiver, IntentFilter(SMS_SENT_ACTION), RECEIVER_EXPORTED)
-        smsManager.sendTextMessage(number, null, message, sentIntent, null)
+        registerReceiver(receiver, IntentFilter(SMS_SENT_ACTION), RECEIVER_NOT_EXPORTED)
+        smsManager.sendTextMessage(number, null, message, sentIntent, deliveredIntent)
     }
 
     private fun performPatch(id: String, status: String) {
@@ -141,7 +182,10 @@ class SmsService : Service() {
             conn.doOutput = true
             conn.setRequestProperty("Content-Type", "application/json")
 
-            val body = JSONObject().apply { put("status", status) }
+            val body = JSONObject().apply {
+                put("status", status)
+                put("worker", workerName)
+            }
             conn.outputStream.use { it.write(body.toString().toByteArray()) }
             conn.responseCode
             conn.disconnect()
@@ -150,6 +194,25 @@ class SmsService : Service() {
         }
     }
 
+    private fun performDeliveryReport(id: String, pduStatus: Int) {
+        try {
+            val conn = URL("http://192.168.8.204:8080/api/v0/smsrequest/delivery?id=$id").openConnection() as HttpURLConnection
+            conn.requestMethod = "POST"
+            conn.doOutput = true
+            conn.setRequestProperty("Content-Type", "application/json")
+
+            val body = JSONObject().apply {
+                put("pdu_status", pduStatus)
+                put("reported_at_ms", System.currentTimeMillis())
+            }
+            conn.outputStream.use { it.write(body.toString().toByteArray()) }
+            conn.responseCode
+            conn.disconnect()
+        } catch (e: Exception) {
+            Log.e("SMS_NET", "Delivery report Error: ${e.message}")
+        }
+    }
+
     // --- Helpers ---
     private fun broadcastUpdate(time: String, json: String) {
         sendBroadcast(Intent("UPDATE_SMS_UI").apply {
@@ -176,6 +239,7 @@ class SmsService : Service() {
     override fun onBind(intent: Intent?) = null
 
     override fun onDestroy() {
+        unregisterReceiver(deliveryReceiver)
         taskExecutor.shutdown()
         super.onDestroy()
     }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"microsms/config"
+	"microsms/models"
+	"time"
+)
+
+/**
+Subcommands, `microsms <command>` runs one against the configured database and exits instead of
+starting the server.
+**/
+
+func runCommand(cfg *config.Config, name string, args []string) int {
+	switch name {
+	case "migrate":
+		return runMigrate(cfg, args)
+	case "bench":
+		return runBench(cfg, args)
+	}
+	fmt.Printf("Unknown command %s, try migrate or bench\n", name)
+	return 2
+}
+
+// bench [-duration 10s] [-creators 4] [-workers 4], sustained create/claim/patch throughput
+func runBench(cfg *config.Config, args []string) int {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	duration := flags.Duration("duration", 10*time.Second, "how long to keep the load up")
+	creators := flags.Int("creators", 4, "goroutines creating requests")
+	workers := flags.Int("workers", 4, "goroutines claiming, marking sent and reporting delivery")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if _, err := models.InitDB(cfg.Database); err != nil {
+		fmt.Printf("Failed opening the database: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Benchmarking %s for %s with %d creators and %d workers\n", models.DBDriver(), *duration, *creators, *workers)
+	result, err := models.RunBench(models.BenchConfig{Duration: *duration, Creators: *creators, Workers: *workers})
+	if err != nil {
+		fmt.Printf("Bench didn't run: %s\n", err)
+		return 1
+	}
+	failed := false
+	fmt.Printf("%-16s %8s %9s %8s %8s %8s\n", "op", "count", "per sec", "p50", "p99", "errors")
+	for _, op := range result.Ops {
+		fmt.Printf("%-16s %8d %9.1f %8s %8s %8d\n", op.Name, op.Count, float64(op.Count)/result.Duration.Seconds(),
+			op.Percentile(0.5).Round(time.Microsecond), op.Percentile(0.99).Round(time.Microsecond), op.Errors)
+		if op.FirstErr != nil {
+			failed = true
+			fmt.Printf("    first error: %s\n", op.FirstErr)
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// migrate [status|up|dry-run], status when there's nothing after it
+func runMigrate(cfg *config.Config, args []string) int {
+	action := "status"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	if _, err := models.ConnectDB(cfg.Database); err != nil {
+		fmt.Printf("Failed opening the database: %s\n", err)
+		return 1
+	}
+	switch action {
+	case "status":
+		statuses, err := models.GetMigrationStatus()
+		if err != nil {
+			fmt.Printf("Failed reading migrations: %s\n", err)
+			return 1
+		}
+		fmt.Printf("Schema migrations on %s, this build knows up to version %d\n", models.DBDriver(), models.LatestSchemaVersion())
+		for _, status := range statuses {
+			state := "pending"
+			switch {
+			case status.Unknown:
+				state = "applied by a newer build " + time.Unix(status.AppliedAt, 0).UTC().Format(time.RFC3339)
+			case status.AppliedAt > 0:
+				state = "applied " + time.Unix(status.AppliedAt, 0).UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-24s %s\n", status.Version, status.Name, state)
+		}
+		return 0
+	case "up":
+		applied, err := models.MigrateUp()
+		if err != nil {
+			fmt.Printf("Migration failed: %s\n", err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Printf("Schema already at version %d, nothing to do\n", models.LatestSchemaVersion())
+			return 0
+		}
+		statuses, err := models.GetMigrationStatus()
+		if err != nil {
+			fmt.Printf("Error reading migration status: %s\n", err)
+			return 1
+		}
+		// A skipped migration leaves a gap, so report what's actually there
+		pending := 0
+		for _, status := range statuses {
+			if status.AppliedAt == 0 && !status.Unknown {
+				pending++
+			}
+		}
+		if pending > 0 {
+			fmt.Printf("Applied %d migrations, %d still pending\n", len(applied), pending)
+			return 0
+		}
+		fmt.Printf("Applied %d migrations, schema at version %d\n", len(applied), models.LatestSchemaVersion())
+		return 0
+	case "dry-run":
+		plans, ran, err := models.DryRunMigrations()
+		for _, plan := range plans {
+			fmt.Printf("%4d  %s\n", plan.Version, plan.Name)
+			if plan.Skipped != "" {
+				fmt.Printf("        skipped, stays pending: %s\n", plan.Skipped)
+			}
+			for _, statement := range plan.Statements {
+				fmt.Printf("        %s\n", statement)
+			}
+		}
+		if err != nil {
+			fmt.Printf("Migration would fail: %s\n", err)
+			return 1
+		}
+		switch {
+		case len(plans) == 0:
+			fmt.Printf("Schema already at version %d, nothing to do\n", models.LatestSchemaVersion())
+		case ran:
+			fmt.Printf("%d migrations would apply, ran them in a transaction and rolled it back\n", len(plans))
+		default:
+			fmt.Printf("%d migrations would apply, %s can't roll back DDL so nothing was run\n", len(plans), models.DBDriver())
+		}
+		return 0
+	}
+	fmt.Printf("Unknown migrate action %s, try status, up or dry-run\n", action)
+	return 2
+}
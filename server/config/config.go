@@ -9,9 +9,18 @@ import (
 
 // Config holds all application configuration
 type Config struct {
-	Server   ServerConfig
-	Database DatabaseConfig
-	Filter   FilterConfig
+	Server     ServerConfig
+	Database   DatabaseConfig
+	Filter     FilterConfig
+	Auth       AuthConfig
+	Webhooks   WebhookConfig
+	Verify     VerifyConfig
+	SMS        SMSConfig
+	Throttle   ThrottleConfig
+	QuietHours QuietHoursConfig
+	Frequency  FrequencyCapConfig
+	Links      LinkConfig
+	Retention  RetentionConfig
 }
 
 type ServerConfig struct {
@@ -20,13 +29,175 @@ type ServerConfig struct {
 }
 
 type DatabaseConfig struct {
-	Path string
+	Driver string // sqlite (default), postgres or mysql
+	Path   string // the SQLite file
+	DSN    string // connection string for postgres/mysql
+	// SQLite only
+	WAL         bool // on unless switched off, readers and the writer stop blocking each other
+	BusyTimeout int  // ms to wait on a lock before giving up, defaults to 5000
+	Readers     int  // read connections next to the single writer, defaults to 4
 }
 
 type FilterConfig struct {
+	Enabled        bool // off means requests skip screening and go straight to opt in
 	APIURL         string
 	MaxConcurrent  int
 	ResultChanSize int
+	Chain          []string        // filters to run in order: smsfilter, rules, allowlist, moderation
+	Policy         string          // any (one block blocks) or all (blocked only if every filter blocks)
+	Rules          []string        // regexes for the rules filter
+	Keywords       []string        // whole words for the rules filter
+	AllowList      []string        // regexes that approve a message outright
+	Categories     map[string]bool // default SMSFilter category toggles, true means screen for it
+	Overridable    []string        // categories a single request is allowed to flip
+	Moderation     ModerationConfig
+	Review         ReviewConfig
+	Timeout        int // seconds per call to a filter API
+	Retries        int // extra attempts on timeouts, 429s and 5xx
+	RetryBackoff   int // ms before the first retry, doubles each time (with jitter)
+	Breaker        BreakerConfig
+	Cache          FilterCacheConfig
+	Heuristics     HeuristicsConfig
+}
+
+// Local scoring that runs before any filter is called. Each rule that fires adds its score, at
+// BlockScore the message is blocked outright and at FlagScore it's held for review
+type HeuristicsConfig struct {
+	Enabled               bool
+	BlockScore            int
+	FlagScore             int
+	Shorteners            []string // link shortener domains
+	ShortenerScore        int
+	LinkDomains           []string // our own domains, links anywhere else are unregistered (empty skips the check)
+	UnregisteredLinkScore int
+	MixedScriptScore      int // latin mixed with lookalike cyrillic/greek in one word
+	InvisibleCharScore    int // zero width, bidi and other invisible characters anywhere in the message
+	FanOut                HeuristicLimit
+	Velocity              HeuristicLimit
+}
+
+// More than Count in Window seconds adds Score
+type HeuristicLimit struct {
+	Count  int
+	Window int
+	Score  int
+}
+
+// Verdict cache keyed on the message hash plus category policy, kept in the DB
+type FilterCacheConfig struct {
+	Enabled bool
+	TTL     int // seconds a verdict is reused for
+}
+
+// Circuit breaker in front of each filter API
+type BreakerConfig struct {
+	Threshold int    // consecutive failed calls that open it
+	Cooldown  int    // seconds it stays open before a single probe call is let through
+	Policy    string // hold (leave messages in filter_check until it closes) or fail (error them)
+}
+
+// What happens to a blocked verdict. "block" blocks it, "hold_for_review" parks borderline ones
+// in held for an admin to approve or confirm
+type ReviewConfig struct {
+	Mode       string
+	Borderline []string // a block is borderline when every category it hit is in here, empty means any block
+}
+
+// Any OpenAI compatible moderation endpoint
+type ModerationConfig struct {
+	URL    string
+	APIKey string
+	Model  string
+}
+
+type AuthConfig struct {
+	AdminKeys []string    // keys allowed on privileged endpoints (search etc), empty locks them
+	Clients   []APIClient // known senders, picked out by their key
+}
+
+// A sender we know about. Its categories replace the filter defaults for every request it makes
+type APIClient struct {
+	Name       string
+	Key        string
+	Categories map[string]bool
+}
+
+type WebhookConfig struct {
+	Secret         string // signs events sent to per request callback_urls
+	MaxAttempts    int
+	InitialBackoff int // seconds, doubles every attempt
+	MaxBackoff     int // seconds
+	Timeout        int // seconds per POST
+	Workers        int // deliveries in flight at once
+	// Hosts (subdomains too) a request's callback_url may point at, empty allows any public host.
+	// callback_url comes from /create so it never gets to reach loopback or private addresses
+	// unless AllowPrivateCallbacks says so (local setups)
+	CallbackHosts         []string
+	AllowPrivateCallbacks bool
+}
+
+type VerifyConfig struct {
+	FromNumber    string // number the codes are sent from when the request doesn't say
+	CodeLength    int
+	TTL           int    // seconds a code stays valid
+	MaxAttempts   int    // wrong guesses before the code is burned
+	MessageFormat string // %s gets the code
+	StartLimit    int    // codes sent per number per window
+	CheckLimit    int    // checks per number per window
+	Window        int    // seconds
+}
+
+type SMSConfig struct {
+	MaxSegments    int    // 0 means no limit
+	OversizeAction string // reject or truncate
+	Transliterate  bool   // swap smart quotes etc so a message can stay GSM-7
+}
+
+// Links in outbound messages
+type LinkConfig struct {
+	AllowList []string // domains links may point at (subdomains too), empty allows anything
+	Rewrite   bool     // swap links for <baseurl>/l/<code> and count clicks
+	BaseURL   string   // where phones can reach this server
+}
+
+// How long finished requests keep their bodies and rows
+type RetentionConfig struct {
+	Enabled   bool
+	Interval  int // seconds between sweeps
+	BatchSize int // rows per transaction
+	Rules     []RetentionRule
+}
+
+// Finished requests matching Priority and Statuses (empty matches any) get their message redacted
+// Redact after they were created and are deleted outright Delete after. "24h", "90d", empty skips it
+type RetentionRule struct {
+	Priority string
+	Statuses []string
+	Redact   string
+	Delete   string
+}
+
+// Messages per number per period handed out to workers, 0 means no limit
+type ThrottleConfig struct {
+	SenderPerMinute    int
+	SenderPerHour      int
+	SenderPerDay       int
+	RecipientPerMinute int
+	RecipientPerHour   int
+	RecipientPerDay    int
+}
+
+type QuietHoursConfig struct {
+	Enabled         bool
+	Windows         []string // "21:00-08:00" in the recipient's local time, can wrap past midnight
+	DefaultTimezone string   // for numbers we can't place
+	Bypass          []string // priorities that go out regardless, otp by default
+}
+
+type FrequencyCapConfig struct {
+	Caps   []string // "<limit>/<window>" per recipient, e.g. "5/1h"
+	Policy string   // reject (429 on create) or defer (queue it until there's room)
+	Bypass []string // priorities the caps don't apply to, otp by default
 }
 
 // Global config instance
@@ -64,25 +235,188 @@ func Load() *Config {
 			Host: viper.GetString("server.host"),
 		},
 		Database: DatabaseConfig{
-			Path: viper.GetString("database.path"),
+			Driver: viper.GetString("database.driver"),
+			Path:   viper.GetString("database.path"),
+			DSN:    viper.GetString("database.dsn"),
+
+			WAL:         !viper.IsSet("database.wal") || viper.GetBool("database.wal"), // on unless switched off
+			BusyTimeout: viper.GetInt("database.busytimeout"),
+			Readers:     viper.GetInt("database.readers"),
 		},
 		Filter: FilterConfig{
+			Enabled:        !viper.IsSet("filter.enabled") || viper.GetBool("filter.enabled"), // on unless switched off
 			APIURL:         viper.GetString("filter.apiurl"),
 			MaxConcurrent:  viper.GetInt("filter.maxconcurrent"),
 			ResultChanSize: viper.GetInt("filter.resultchansize"),
+			Chain:          viper.GetStringSlice("filter.chain"),
+			Policy:         viper.GetString("filter.policy"),
+			Rules:          viper.GetStringSlice("filter.rules"),
+			Keywords:       viper.GetStringSlice("filter.keywords"),
+			AllowList:      viper.GetStringSlice("filter.allowlist"),
+			Categories:     getBoolMap("filter.categories"),
+			Overridable:    viper.GetStringSlice("filter.overridable"),
+			Moderation: ModerationConfig{
+				URL:    viper.GetString("filter.moderation.url"),
+				APIKey: viper.GetString("filter.moderation.apikey"),
+				Model:  viper.GetString("filter.moderation.model"),
+			},
+			Review: ReviewConfig{
+				Mode:       viper.GetString("filter.review.mode"),
+				Borderline: viper.GetStringSlice("filter.review.borderline"),
+			},
+			Timeout:      viper.GetInt("filter.timeout"),
+			Retries:      viper.GetInt("filter.retries"),
+			RetryBackoff: viper.GetInt("filter.retrybackoff"),
+			Breaker: BreakerConfig{
+				Threshold: viper.GetInt("filter.breaker.threshold"),
+				Cooldown:  viper.GetInt("filter.breaker.cooldown"),
+				Policy:    viper.GetString("filter.breaker.policy"),
+			},
+			Cache: FilterCacheConfig{
+				Enabled: viper.GetBool("filter.cache.enabled"),
+				TTL:     viper.GetInt("filter.cache.ttl"),
+			},
+			Heuristics: HeuristicsConfig{
+				Enabled:               viper.GetBool("filter.heuristics.enabled"),
+				BlockScore:            viper.GetInt("filter.heuristics.blockscore"),
+				FlagScore:             viper.GetInt("filter.heuristics.flagscore"),
+				Shorteners:            viper.GetStringSlice("filter.heuristics.shorteners"),
+				ShortenerScore:        viper.GetInt("filter.heuristics.shortenerscore"),
+				LinkDomains:           viper.GetStringSlice("filter.heuristics.linkdomains"),
+				UnregisteredLinkScore: viper.GetInt("filter.heuristics.unregisteredlinkscore"),
+				MixedScriptScore:      viper.GetInt("filter.heuristics.mixedscriptscore"),
+				InvisibleCharScore:    getInvisibleCharScore(),
+				FanOut:                getHeuristicLimit("filter.heuristics.fanout"),
+				Velocity:              getHeuristicLimit("filter.heuristics.velocity"),
+			},
+		},
+		Auth: AuthConfig{
+			AdminKeys: viper.GetStringSlice("auth.adminkeys"),
+		},
+		Webhooks: WebhookConfig{
+			Secret:                viper.GetString("webhooks.secret"),
+			MaxAttempts:           viper.GetInt("webhooks.maxattempts"),
+			InitialBackoff:        viper.GetInt("webhooks.initialbackoff"),
+			MaxBackoff:            viper.GetInt("webhooks.maxbackoff"),
+			Timeout:               viper.GetInt("webhooks.timeout"),
+			Workers:               viper.GetInt("webhooks.workers"),
+			CallbackHosts:         viper.GetStringSlice("webhooks.callbackhosts"),
+			AllowPrivateCallbacks: viper.GetBool("webhooks.allowprivatecallbacks"),
+		},
+		SMS: SMSConfig{
+			MaxSegments:    viper.GetInt("sms.maxsegments"),
+			OversizeAction: viper.GetString("sms.oversizeaction"),
+			Transliterate:  viper.GetBool("sms.transliterate"),
+		},
+		Links: LinkConfig{
+			AllowList: viper.GetStringSlice("links.allowlist"),
+			Rewrite:   viper.GetBool("links.rewrite"),
+			BaseURL:   viper.GetString("links.baseurl"),
+		},
+		Retention: RetentionConfig{
+			Enabled:   viper.GetBool("retention.enabled"),
+			Interval:  viper.GetInt("retention.interval"),
+			BatchSize: viper.GetInt("retention.batchsize"),
+		},
+		Throttle: ThrottleConfig{
+			SenderPerMinute:    viper.GetInt("throttle.senderperminute"),
+			SenderPerHour:      viper.GetInt("throttle.senderperhour"),
+			SenderPerDay:       viper.GetInt("throttle.senderperday"),
+			RecipientPerMinute: viper.GetInt("throttle.recipientperminute"),
+			RecipientPerHour:   viper.GetInt("throttle.recipientperhour"),
+			RecipientPerDay:    viper.GetInt("throttle.recipientperday"),
+		},
+		QuietHours: QuietHoursConfig{
+			Enabled:         viper.GetBool("quiethours.enabled"),
+			Windows:         viper.GetStringSlice("quiethours.windows"),
+			DefaultTimezone: viper.GetString("quiethours.defaulttimezone"),
+			Bypass:          viper.GetStringSlice("quiethours.bypass"),
+		},
+		Frequency: FrequencyCapConfig{
+			Caps:   viper.GetStringSlice("frequencycaps.caps"),
+			Policy: viper.GetString("frequencycaps.policy"),
+			Bypass: viper.GetStringSlice("frequencycaps.bypass"),
+		},
+		Verify: VerifyConfig{
+			FromNumber:    viper.GetString("verify.fromnumber"),
+			CodeLength:    viper.GetInt("verify.codelength"),
+			TTL:           viper.GetInt("verify.ttl"),
+			MaxAttempts:   viper.GetInt("verify.maxattempts"),
+			MessageFormat: viper.GetString("verify.messageformat"),
+			StartLimit:    viper.GetInt("verify.startlimit"),
+			CheckLimit:    viper.GetInt("verify.checklimit"),
+			Window:        viper.GetInt("verify.window"),
 		},
 	}
 
+	// Lists of structs don't have a viper.GetX, unmarshal them
+	if err := viper.UnmarshalKey("auth.clients", &AppConfig.Auth.Clients); err != nil {
+		fmt.Printf("Failed reading auth.clients: %s\n", err)
+	}
+	if err := viper.UnmarshalKey("retention.rules", &AppConfig.Retention.Rules); err != nil {
+		fmt.Printf("Failed reading retention.rules: %s\n", err)
+	}
+
 	return AppConfig
 }
 
+func getBoolMap(key string) map[string]bool {
+	values := map[string]bool{}
+	for name, value := range viper.GetStringMap(key) {
+		if enabled, ok := value.(bool); ok {
+			values[name] = enabled
+		}
+	}
+	return values
+}
+
+// Configs from before invisiblecharscore had mixedscriptscore cover invisible characters too, keep
+// scoring them the same until the new key is set
+func getInvisibleCharScore() int {
+	if viper.IsSet("filter.heuristics.invisiblecharscore") {
+		return viper.GetInt("filter.heuristics.invisiblecharscore")
+	}
+	return viper.GetInt("filter.heuristics.mixedscriptscore")
+}
+
+func getHeuristicLimit(key string) HeuristicLimit {
+	return HeuristicLimit{
+		Count:  viper.GetInt(key + ".count"),
+		Window: viper.GetInt(key + ".window"),
+		Score:  viper.GetInt(key + ".score"),
+	}
+}
+
 // Print displays the current configuration
 func (c *Config) Print() {
 	fmt.Println("=== Application Configuration ===")
 	fmt.Printf("Server Address: %s:%s\n", c.Server.Host, c.Server.Port)
+	fmt.Printf("Database Driver: %s\n", c.Database.Driver)
 	fmt.Printf("Database Path: %s\n", c.Database.Path)
+	fmt.Printf("Database DSN Set: %t\n", c.Database.DSN != "") // has the password in it
+	fmt.Printf("Database SQLite WAL: %t, Busy Timeout: %dms, Readers: %d\n", c.Database.WAL, c.Database.BusyTimeout, c.Database.Readers)
+	fmt.Printf("Filter Enabled: %t\n", c.Filter.Enabled)
 	fmt.Printf("Filter API URL: %s\n", c.Filter.APIURL)
 	fmt.Printf("Filter Max Concurrent: %d\n", c.Filter.MaxConcurrent)
 	fmt.Printf("Filter Result Channel Size: %d\n", c.Filter.ResultChanSize)
+	fmt.Printf("Filter Chain: %v (%s)\n", c.Filter.Chain, c.Filter.Policy)
+	fmt.Printf("Filter Review Mode: %s\n", c.Filter.Review.Mode)
+	fmt.Printf("Filter Timeout: %ds, %d retries\n", c.Filter.Timeout, c.Filter.Retries)
+	fmt.Printf("Filter Breaker: %d failures, %ds cooldown (%s)\n", c.Filter.Breaker.Threshold, c.Filter.Breaker.Cooldown, c.Filter.Breaker.Policy)
+	fmt.Printf("Filter Cache: %t (%ds)\n", c.Filter.Cache.Enabled, c.Filter.Cache.TTL)
+	fmt.Printf("Filter Heuristics: %t (flag %d, block %d)\n", c.Filter.Heuristics.Enabled, c.Filter.Heuristics.FlagScore, c.Filter.Heuristics.BlockScore)
+	fmt.Printf("Admin API Keys: %d configured\n", len(c.Auth.AdminKeys)) // never print the keys themselves
+	fmt.Printf("API Clients: %d configured\n", len(c.Auth.Clients))
+	fmt.Printf("Webhook Max Attempts: %d\n", c.Webhooks.MaxAttempts)
+	fmt.Printf("Webhook Backoff: %ds-%ds\n", c.Webhooks.InitialBackoff, c.Webhooks.MaxBackoff)
+	fmt.Printf("Webhook Workers: %d, Callback Hosts: %v\n", c.Webhooks.Workers, c.Webhooks.CallbackHosts)
+	fmt.Printf("SMS Max Segments: %d (%s)\n", c.SMS.MaxSegments, c.SMS.OversizeAction)
+	fmt.Printf("Links: %d allowed domains, rewrite %t\n", len(c.Links.AllowList), c.Links.Rewrite)
+	fmt.Printf("Sender Throttle: %d/min %d/hour %d/day\n", c.Throttle.SenderPerMinute, c.Throttle.SenderPerHour, c.Throttle.SenderPerDay)
+	fmt.Printf("Recipient Throttle: %d/min %d/hour %d/day\n", c.Throttle.RecipientPerMinute, c.Throttle.RecipientPerHour, c.Throttle.RecipientPerDay)
+	fmt.Printf("Quiet Hours: %t %v (default %s)\n", c.QuietHours.Enabled, c.QuietHours.Windows, c.QuietHours.DefaultTimezone)
+	fmt.Printf("Frequency Caps: %v (%s)\n", c.Frequency.Caps, c.Frequency.Policy)
+	fmt.Printf("Retention: %t, %d rules every %ds\n", c.Retention.Enabled, len(c.Retention.Rules), c.Retention.Interval)
+	fmt.Printf("Verify Code TTL: %ds, Max Attempts: %d\n", c.Verify.TTL, c.Verify.MaxAttempts)
 	fmt.Println("=================================")
 }
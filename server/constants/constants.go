@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"math/big"
 	"regexp"
+	"slices"
+	"strings"
 )
 
 type OptInStatus string
@@ -27,12 +29,67 @@ const (
 type RequestStatus string
 
 const (
+	RequestStatus_FILTER_CHECK  RequestStatus = "filter_check" // waiting on the content filter, opt in gets looked at after
+	RequestStatus_HELD          RequestStatus = "held"         // borderline filter verdict waiting on a human
 	RequestStatus_VERIFY_CHECK  RequestStatus = "verify_check"
 	RequestStatus_READY_TO_SEND RequestStatus = "ready_to_send"
 	RequestStatus_TAKEN         RequestStatus = "taken"
 	RequestStatus_SENT          RequestStatus = "sent"
 	RequestStatus_ERROR         RequestStatus = "error"
 	RequestStatus_BLOCKED       RequestStatus = "blocked"
+	RequestStatus_CANCELLED     RequestStatus = "cancelled"
+	RequestStatus_DELIVERED     RequestStatus = "delivered"
+	RequestStatus_UNDELIVERED   RequestStatus = "undelivered"
+	RequestStatus_EXPIRED       RequestStatus = "expired"
+)
+
+// Categories the SMSFilter API can screen for, each one goes over as a top level bool
+var FilterCategories = []string{
+	"violent_crimes",
+	"nonviolent_crimes",
+	"sex_related_crimes",
+	"child_sexual_exploitation",
+	"defamation",
+	"specialized_advice",
+	"privacy",
+	"intellectual_property",
+	"indiscriminate_weapons",
+	"hate",
+	"suicide_and_self_harm",
+	"sexual_content",
+	"elections",
+}
+
+func IsValidFilterCategory(category string) bool {
+	return slices.Contains(FilterCategories, category)
+}
+
+// How (or if) a request's message got screened
+type FilterMode string
+
+const (
+	FilterMode_FILTER   FilterMode = "filter"   // went through the filter chain
+	FilterMode_TEMPLATE FilterMode = "template" // body was screened once with its template
+	FilterMode_SYSTEM   FilterMode = "system"   // we wrote it ourselves (OTP codes)
+	FilterMode_DISABLED FilterMode = "disabled" // filtering was off, never screened
+)
+
+type RequestPriority string
+
+const (
+	RequestPriority_OTP      RequestPriority = "otp" // one time passwords, jump the queue
+	RequestPriority_STANDARD RequestPriority = "standard"
+	RequestPriority_BULK     RequestPriority = "bulk"
+)
+
+type VerificationStatus string
+
+const (
+	VerificationStatus_PENDING  VerificationStatus = "pending"
+	VerificationStatus_APPROVED VerificationStatus = "approved"
+	VerificationStatus_FAILED   VerificationStatus = "failed" // out of attempts
+	VerificationStatus_EXPIRED  VerificationStatus = "expired"
+	VerificationStatus_REPLACED VerificationStatus = "replaced" // a newer code was sent to the number
 )
 
 func IsValidOptInStatus(status string) bool {
@@ -50,24 +107,51 @@ func IsValidRequestAuthStatus(status string) bool {
 }
 
 func IsValidRequestStatus(status string) bool {
-	if status != string(RequestStatus_VERIFY_CHECK) && status != string(RequestStatus_READY_TO_SEND) && status != string(RequestStatus_TAKEN) && status != string(RequestStatus_SENT) && status != string(RequestStatus_ERROR) && status != string(RequestStatus_BLOCKED) {
-		return false
+	switch RequestStatus(status) {
+	case RequestStatus_FILTER_CHECK, RequestStatus_HELD, RequestStatus_VERIFY_CHECK, RequestStatus_READY_TO_SEND, RequestStatus_TAKEN, RequestStatus_SENT, RequestStatus_ERROR,
+		RequestStatus_BLOCKED, RequestStatus_CANCELLED, RequestStatus_DELIVERED, RequestStatus_UNDELIVERED, RequestStatus_EXPIRED:
+		return true
 	}
-	return true
+	return false
+}
+
+// Map the TP-Status byte from an SMS status report (3GPP TS 23.040 9.2.3.15) onto our statuses.
+// 0x00-0x1F means the handset got it, 0x20-0x3F means the SMSC is still retrying (so no verdict
+// yet) and anything from 0x40 up is a permanent or given up failure
+func RequestStatusFromPDUStatus(pduStatus int) (RequestStatus, bool) {
+	switch {
+	case pduStatus < 0:
+		return "", false
+	case pduStatus < 0x20:
+		return RequestStatus_DELIVERED, true
+	case pduStatus < 0x40:
+		return "", false
+	default:
+		return RequestStatus_UNDELIVERED, true
+	}
+}
+
+func IsValidRequestPriority(priority string) bool {
+	switch RequestPriority(priority) {
+	case RequestPriority_OTP, RequestPriority_STANDARD, RequestPriority_BULK:
+		return true
+	}
+	return false
 }
 
 func GetPhone(number string) (string, error) {
 	if !IsValidPhone(number) {
 		return "", fmt.Errorf("Error invalid phone number %s", number)
 	}
-	var phoneRegex = `^(?:\(\d{3}\)|\d{3})[-. ]?\d{3}[-. ]?\d{4}$`
+	// Same shape as IsValidPhone but with groups so we can pull the pieces back out
+	var phoneRegex = `^(?:\((\d{3})\)|(\d{3}))[-. ]?(\d{3})[-. ]?(\d{4})$`
 	re := regexp.MustCompile(phoneRegex)
 	match := re.FindStringSubmatch(number)
 
-	// Extract components
-	areaCode := match[0][:3] // Get area code
-	centralOfficeCode := match[1]
-	subscriberNumber := match[2]
+	// Extract components, area code lands in group 1 or 2 depending on the parens
+	areaCode := match[1] + match[2]
+	centralOfficeCode := match[3]
+	subscriberNumber := match[4]
 
 	// Normalize to +1 (XXX) XXX-XXXX
 	normalized := fmt.Sprintf("(%s)-%s-%s", areaCode, centralOfficeCode, subscriberNumber)
@@ -83,6 +167,29 @@ func IsValidPhone(number string) bool {
 	return re.MatchString(number)
 }
 
+// Lower case with the whitespace squashed, for spotting the same message sent over and over.
+// Anything beyond that could change what the message says so it stays as is
+func NormalizeMessage(message string) string {
+	return strings.Join(strings.Fields(strings.ToLower(message)), " ")
+}
+
+// Numeric one time code, same crypto/rand approach as the code phrase but we hand back the
+// error since a verification can't go out with a placeholder code
+func GenerateOTPCode(digits int) (string, error) {
+	chars := []rune("0123456789")
+
+	b := make([]rune, digits)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = chars[n.Int64()]
+	}
+
+	return string(b), nil
+}
+
 func GenerateCodePhrase() string {
 	chars := []rune("ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 
@@ -0,0 +1,33 @@
+package constants
+
+import "testing"
+
+// Every way of writing a number comes out the same. Before GetPhone had capture groups the
+// pieces came out of the wrong matches and panicked or mangled anything but plain digits
+func TestGetPhone(t *testing.T) {
+	tests := []struct {
+		number   string
+		expected string
+		valid    bool
+	}{
+		{"5551234567", "(555)-123-4567", true},
+		{"555-123-4567", "(555)-123-4567", true},
+		{"555.123.4567", "(555)-123-4567", true},
+		{"555 123 4567", "(555)-123-4567", true},
+		{"(555)123-4567", "(555)-123-4567", true},
+		{"(555) 123-4567", "(555)-123-4567", true},
+		{"(555)-123-4567", "(555)-123-4567", true},
+		{"555-1234", "", false},
+		{"(555 123-4567", "", false},
+		{"+1 555 123 4567", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.number, func(t *testing.T) {
+			normalized, err := GetPhone(test.number)
+			if (err == nil) != test.valid || normalized != test.expected {
+				t.Errorf("got %q (%v), expected %q valid %t", normalized, err, test.expected, test.valid)
+			}
+		})
+	}
+}
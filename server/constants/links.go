@@ -0,0 +1,62 @@
+package constants
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// A link found in a message. Start and End index the message so it can be swapped out
+type MessageLink struct {
+	Start     int
+	End       int
+	Text      string // as written, "example.com/x" or "https://example.com/x"
+	Host      string // lower case, www. dropped
+	HasScheme bool
+}
+
+// Anything link shaped, host then optional port and path. Without a scheme the TLD has to look
+// like a real one so "e.g." and "3.50" don't turn into links
+var messageLinkPattern = regexp.MustCompile(`(?i)\b(https?://)?((?:[a-z0-9-]+\.)+[a-z]{2,63})\b(?::\d+)?(?:[/?#]\S*)?`)
+
+var linkTLDs = []string{
+	"com", "net", "org", "io", "ly", "co", "me", "info", "biz", "xyz", "gd", "at", "cc", "us", "to",
+	"link", "click", "top", "site", "online", "app", "live", "shop", "ru", "cn", "tk",
+}
+
+// Every link in the message in order. Trailing punctuation is left out since "see example.com."
+// ends a sentence, not the URL
+func FindLinks(message string) []MessageLink {
+	var links []MessageLink
+	for _, match := range messageLinkPattern.FindAllStringSubmatchIndex(message, -1) {
+		hasScheme := match[2] >= 0
+		host := strings.TrimPrefix(strings.ToLower(message[match[4]:match[5]]), "www.")
+		if !hasScheme && !slices.Contains(linkTLDs, host[strings.LastIndex(host, ".")+1:]) {
+			continue
+		}
+		end := match[1]
+		for end > match[5] && strings.ContainsRune(".,!?;:)]}'\"", rune(message[end-1])) {
+			end--
+		}
+		links = append(links, MessageLink{Start: match[0], End: end, Text: message[match[0]:end], Host: host, HasScheme: hasScheme})
+	}
+	return links
+}
+
+// Something a browser can open, links written without a scheme get https
+func (link MessageLink) URL() string {
+	if link.HasScheme {
+		return link.Text
+	}
+	return "https://" + link.Text
+}
+
+// The host is the domain or one of its subdomains
+func HostMatches(host string, domains []string) bool {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package constants
+
+import (
+	"strings"
+	"unicode/utf16"
+)
+
+/**
+SMS encoding and segment math. A message that fits the GSM 03.38 alphabet goes out as GSM-7
+(160 septets, 153 per part once it's split because of the UDH), anything else is UCS-2 (70 UTF-16
+units, 67 per part). Extension table characters cost two septets and an escape or a surrogate pair
+never gets split across parts, same as the phone does it.
+**/
+
+type SMSEncoding string
+
+const (
+	SMSEncoding_GSM7 SMSEncoding = "gsm7"
+	SMSEncoding_UCS2 SMSEncoding = "ucs2"
+)
+
+// What to do with a body over the max segment count
+const (
+	OversizeAction_REJECT   = "reject"
+	OversizeAction_TRUNCATE = "truncate"
+)
+
+const gsm7Basic = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+
+const gsm7Extension = "\f^{}\\[~]|€"
+
+// Common characters phones and word processors swap in that have a plain GSM-7 twin
+var gsm7Transliterations = strings.NewReplacer(
+	"‘", "'", "’", "'", "‚", "'", "′", "'",
+	"“", "\"", "”", "\"", "„", "\"", "″", "\"",
+	"–", "-", "—", "-", "‐", "-", "‑", "-",
+	"…", "...", " ", " ", " ", " ", "​", "",
+	"•", "*", "«", "\"", "»", "\"",
+)
+
+type SegmentInfo struct {
+	Encoding      SMSEncoding `json:"encoding"`
+	Characters    int         `json:"characters"`     // septets for GSM-7, UTF-16 units for UCS-2
+	SegmentLength int         `json:"segment_length"` // characters that fit in each part
+	Segments      int         `json:"segments"`
+}
+
+// Cost of a rune in its encoding's units, 0 means it can't be sent as GSM-7
+func gsm7Cost(r rune) int {
+	if strings.ContainsRune(gsm7Basic, r) {
+		return 1
+	}
+	if strings.ContainsRune(gsm7Extension, r) {
+		return 2
+	}
+	return 0
+}
+
+func IsGSM7(message string) bool {
+	for _, r := range message {
+		if gsm7Cost(r) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Swap smart quotes and friends for their GSM-7 versions, but only when that gets the whole
+// message into GSM-7. If something else forces UCS-2 anyway the original characters stay
+func TransliterateGSM7(message string) string {
+	if IsGSM7(message) {
+		return message
+	}
+	transliterated := gsm7Transliterations.Replace(message)
+	if IsGSM7(transliterated) {
+		return transliterated
+	}
+	return message
+}
+
+func runeCost(r rune, encoding SMSEncoding) int {
+	if encoding == SMSEncoding_GSM7 {
+		return gsm7Cost(r)
+	}
+	return utf16.RuneLen(r)
+}
+
+func segmentLimits(encoding SMSEncoding) (single int, multi int) {
+	if encoding == SMSEncoding_GSM7 {
+		return 160, 153
+	}
+	return 70, 67
+}
+
+// Work out encoding and how many parts the message goes out as
+func GetSegmentInfo(message string) SegmentInfo {
+	info := SegmentInfo{Encoding: SMSEncoding_UCS2}
+	if IsGSM7(message) {
+		info.Encoding = SMSEncoding_GSM7
+	}
+	single, multi := segmentLimits(info.Encoding)
+	for _, r := range message {
+		info.Characters += runeCost(r, info.Encoding)
+	}
+	if info.Characters <= single {
+		info.SegmentLength = single
+		info.Segments = 1
+		return info
+	}
+	// Split, a character that doesn't fit whole in a part moves to the next one
+	info.SegmentLength = multi
+	info.Segments = 1
+	used := 0
+	for _, r := range message {
+		cost := runeCost(r, info.Encoding)
+		if used+cost > multi {
+			info.Segments++
+			used = 0
+		}
+		used += cost
+	}
+	return info
+}
+
+// Cut the message down to fit in maxSegments parts without splitting a character
+func TruncateToSegments(message string, maxSegments int) string {
+	info := GetSegmentInfo(message)
+	if maxSegments <= 0 || info.Segments <= maxSegments {
+		return message
+	}
+	single, multi := segmentLimits(info.Encoding)
+	if maxSegments == 1 {
+		return truncateToUnits(message, info.Encoding, single)
+	}
+	// Pack part by part the same way GetSegmentInfo counts them
+	segments, used := 1, 0
+	for i, r := range message {
+		cost := runeCost(r, info.Encoding)
+		if used+cost > multi {
+			if segments == maxSegments {
+				return message[:i]
+			}
+			segments++
+			used = 0
+		}
+		used += cost
+	}
+	return message
+}
+
+func truncateToUnits(message string, encoding SMSEncoding, limit int) string {
+	used := 0
+	for i, r := range message {
+		used += runeCost(r, encoding)
+		if used > limit {
+			return message[:i]
+		}
+	}
+	return message
+}
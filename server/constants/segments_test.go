@@ -0,0 +1,59 @@
+package constants
+
+import (
+	"strings"
+	"testing"
+)
+
+// Part counts at the edges: where one part turns into two, extension characters costing two
+// septets and escapes or surrogate pairs that can't be split across parts
+func TestGetSegmentInfo(t *testing.T) {
+	tests := []struct {
+		name       string
+		message    string
+		encoding   SMSEncoding
+		characters int
+		segments   int
+	}{
+		{"empty", "", SMSEncoding_GSM7, 0, 1},
+		{"short", "hello", SMSEncoding_GSM7, 5, 1},
+		{"one full part", strings.Repeat("a", 160), SMSEncoding_GSM7, 160, 1},
+		{"one over", strings.Repeat("a", 161), SMSEncoding_GSM7, 161, 2},
+		{"extension costs two", strings.Repeat("€", 80), SMSEncoding_GSM7, 160, 1},
+		{"extension over", strings.Repeat("€", 81), SMSEncoding_GSM7, 162, 2},
+		{"escape not split", strings.Repeat("a", 152) + "€" + strings.Repeat("a", 152), SMSEncoding_GSM7, 306, 3},
+		{"ucs2", "привет", SMSEncoding_UCS2, 6, 1},
+		{"ucs2 full part", strings.Repeat("я", 70), SMSEncoding_UCS2, 70, 1},
+		{"ucs2 over", strings.Repeat("я", 71), SMSEncoding_UCS2, 71, 2},
+		{"surrogate pair not split", strings.Repeat("я", 66) + "😀" + strings.Repeat("я", 66), SMSEncoding_UCS2, 134, 3},
+		{"one emoji makes it ucs2", strings.Repeat("a", 69) + "😀", SMSEncoding_UCS2, 71, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info := GetSegmentInfo(test.message)
+			if info.Encoding != test.encoding || info.Characters != test.characters || info.Segments != test.segments {
+				t.Errorf("got %s, %d characters, %d segments, expected %s, %d, %d", info.Encoding, info.Characters, info.Segments, test.encoding, test.characters, test.segments)
+			}
+		})
+	}
+}
+
+// Only swapped when that gets the whole message into GSM-7
+func TestTransliterateGSM7(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{"already gsm7", `say "hi"`, `say "hi"`},
+		{"smart quotes", "say “hi” – it’s fine…", `say "hi" - it's fine...`},
+		{"emoji keeps the quotes", "say “hi” 😀", "say “hi” 😀"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := TransliterateGSM7(test.message); got != test.want {
+				t.Errorf("got %q, expected %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,363 @@
+package helpers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"microsms/config"
+	"microsms/constants"
+	"microsms/models"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/**
+Content filters. Each backend implements Filter and config.FilterConfig picks which ones run and
+in what order. The chain policy decides how their verdicts combine: "any" blocks as soon as one
+filter blocks (everything has to pass), "all" only blocks when every filter blocks. An allow-list
+hit approves the message on the spot whatever comes after it.
+**/
+
+const (
+	FilterPolicy_ANY = "any"
+	FilterPolicy_ALL = "all"
+
+	FilterName_SMSFILTER  = "smsfilter"
+	FilterName_RULES      = "rules"
+	FilterName_ALLOWLIST  = "allowlist"
+	FilterName_MODERATION = "moderation"
+)
+
+type Filter interface {
+	Name() string
+	Check(message string, categories map[string]bool) (models.FilterVerdict, error)
+}
+
+// Runs filters in order and combines them by policy
+type FilterChain struct {
+	Filters []Filter
+	Policy  string
+}
+
+var filterChain *FilterChain
+
+// SetFilterChain builds the filter chain from the config, an empty chain means just the SMSFilter
+// API. With filtering switched off there's no chain at all
+func SetFilterChain(cfg config.FilterConfig) error {
+	switch cfg.Breaker.Policy {
+	case "":
+		filterBreakerPolicy = BreakerPolicy_HOLD
+	case BreakerPolicy_HOLD, BreakerPolicy_FAIL:
+		filterBreakerPolicy = cfg.Breaker.Policy
+	default:
+		return fmt.Errorf("invalid filter breaker policy %s", cfg.Breaker.Policy)
+	}
+	if !cfg.Enabled {
+		filterChain = nil
+		return nil
+	}
+	chain, err := NewFilterChain(cfg)
+	if err != nil {
+		return err
+	}
+	filterChain = chain
+	return nil
+}
+
+func NewFilterChain(cfg config.FilterConfig) (*FilterChain, error) {
+	chain := &FilterChain{Policy: cfg.Policy}
+	switch chain.Policy {
+	case "":
+		chain.Policy = FilterPolicy_ANY
+	case FilterPolicy_ANY, FilterPolicy_ALL:
+	default:
+		return nil, fmt.Errorf("invalid filter policy %s", cfg.Policy)
+	}
+	names := cfg.Chain
+	if len(names) == 0 {
+		names = []string{FilterName_SMSFILTER}
+	}
+	for _, name := range names {
+		var filter Filter
+		var err error
+		switch name {
+		case FilterName_SMSFILTER:
+			filter = &SMSFilterAPI{URL: cfg.APIURL, api: newFilterAPIClient(name, cfg)}
+		case FilterName_RULES:
+			filter, err = NewRuleFilter(cfg.Rules, cfg.Keywords)
+		case FilterName_ALLOWLIST:
+			filter, err = NewAllowListFilter(cfg.AllowList)
+		case FilterName_MODERATION:
+			filter = &ModerationFilter{URL: cfg.Moderation.URL, APIKey: cfg.Moderation.APIKey, Model: cfg.Moderation.Model, api: newFilterAPIClient(name, cfg)}
+		default:
+			err = fmt.Errorf("unknown filter %s", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		chain.Filters = append(chain.Filters, filter)
+	}
+	return chain, nil
+}
+
+func (chain *FilterChain) Name() string {
+	return "chain"
+}
+
+// What /health reports about screening
+type FilterStatus struct {
+	Mode       constants.FilterMode `json:"mode"` // filter or disabled
+	Chain      []string             `json:"chain,omitempty"`
+	Policy     string               `json:"policy,omitempty"`
+	Breakers   map[string]string    `json:"breakers,omitempty"` // circuit breaker state per filter API
+	Heuristics bool                 `json:"heuristics,omitempty"`
+}
+
+// The HTTP backends, the ones with a breaker in front of them
+type filterAPIBackend interface {
+	apiClient() *filterAPIClient
+}
+
+func (filter *SMSFilterAPI) apiClient() *filterAPIClient {
+	return filter.api
+}
+
+func (filter *ModerationFilter) apiClient() *filterAPIClient {
+	return filter.api
+}
+
+// Whether any filter API in the chain is turning calls away right now
+func filterUnavailable() bool {
+	if filterChain == nil {
+		return false
+	}
+	for _, filter := range filterChain.Filters {
+		if backend, ok := filter.(filterAPIBackend); ok && backend.apiClient().breaker.blocking() {
+			return true
+		}
+	}
+	return false
+}
+
+func GetFilterStatus() FilterStatus {
+	if filterChain == nil {
+		return FilterStatus{Mode: constants.FilterMode_DISABLED}
+	}
+	status := FilterStatus{Mode: constants.FilterMode_FILTER, Policy: filterChain.Policy, Heuristics: heuristicsConfig.Enabled}
+	for _, filter := range filterChain.Filters {
+		status.Chain = append(status.Chain, filter.Name())
+		if backend, ok := filter.(filterAPIBackend); ok {
+			if status.Breakers == nil {
+				status.Breakers = map[string]string{}
+			}
+			status.Breakers[filter.Name()] = backend.apiClient().breaker.State()
+		}
+	}
+	return status
+}
+
+// Check the message against the chain. Any filter erroring fails the whole check, we'd rather
+// hold the message in error than guess
+func (chain *FilterChain) Check(message string, categories map[string]bool) (models.FilterVerdict, error) {
+	var last models.FilterVerdict
+	for _, filter := range chain.Filters {
+		verdict, err := filter.Check(message, categories)
+		if err != nil {
+			return models.FilterVerdict{Backend: filter.Name()}, fmt.Errorf("%s filter: %w", filter.Name(), err)
+		}
+		verdict.Backend = filter.Name()
+		switch {
+		case verdict.Allowed:
+			return verdict, nil
+		case verdict.Blocked && chain.Policy == FilterPolicy_ANY:
+			return verdict, nil
+		case !verdict.Blocked && chain.Policy == FilterPolicy_ALL:
+			return verdict, nil
+		}
+		last = verdict
+	}
+	// any: nothing blocked, all: everything blocked. Either way the last verdict says so
+	return last, nil
+}
+
+// The original SMSFilter API, POST {"sms": ...} plus the category toggles and read back blocked
+type SMSFilterAPI struct {
+	URL string
+	api *filterAPIClient
+}
+
+func (filter *SMSFilterAPI) Name() string {
+	return FilterName_SMSFILTER
+}
+
+func (filter *SMSFilterAPI) Check(message string, categories map[string]bool) (models.FilterVerdict, error) {
+	var smsResponse SMSResponse
+	var body []byte
+	smsFilter := SMSFilterRequest{SMS: message, Categories: categories}
+	payload, err := json.Marshal(smsFilter)
+	if err != nil {
+		goto ERROR
+	}
+	body, err = filter.api.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, filter.URL, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		goto ERROR
+	}
+	fmt.Printf("Safety API returned %s", body)
+	if err = json.Unmarshal(body, &smsResponse); err != nil {
+		goto ERROR
+	}
+
+	return models.FilterVerdict{
+		Blocked:            smsResponse.Blocked,
+		Reason:             smsResponse.Reason,
+		IncludedCategories: smsResponse.IncludedCategories,
+		ExcludedCategories: smsResponse.ExcludedCategories,
+	}, nil
+ERROR:
+	return models.FilterVerdict{}, err
+}
+
+// Local regex and keyword rules, anything matching is blocked. Keywords are case insensitive
+// whole words
+type RuleFilter struct {
+	rules []*regexp.Regexp
+}
+
+func NewRuleFilter(rules []string, keywords []string) (*RuleFilter, error) {
+	filter := &RuleFilter{}
+	for _, rule := range rules {
+		if strings.TrimSpace(rule) == "" {
+			return nil, fmt.Errorf("empty filter rule, it would block every message")
+		}
+		re, err := regexp.Compile(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter rule %s: %s", rule, err)
+		}
+		filter.rules = append(filter.rules, re)
+	}
+	for _, keyword := range keywords {
+		keyword = strings.TrimSpace(keyword)
+		if keyword == "" {
+			return nil, fmt.Errorf("empty filter keyword, it would block every message")
+		}
+		filter.rules = append(filter.rules, regexp.MustCompile(`(?i)\b`+regexp.QuoteMeta(keyword)+`\b`))
+	}
+	return filter, nil
+}
+
+func (filter *RuleFilter) Name() string {
+	return FilterName_RULES
+}
+
+func (filter *RuleFilter) Check(message string, categories map[string]bool) (models.FilterVerdict, error) {
+	for _, rule := range filter.rules {
+		if rule.MatchString(message) {
+			return models.FilterVerdict{Blocked: true, Reason: fmt.Sprintf("matched rule %s", rule)}, nil
+		}
+	}
+	return models.FilterVerdict{}, nil
+}
+
+// Messages matching one of these patterns are approved without asking anything further down the chain
+type AllowListFilter struct {
+	patterns []*regexp.Regexp
+}
+
+func NewAllowListFilter(patterns []string) (*AllowListFilter, error) {
+	filter := &AllowListFilter{}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow-list pattern %s: %s", pattern, err)
+		}
+		filter.patterns = append(filter.patterns, re)
+	}
+	return filter, nil
+}
+
+func (filter *AllowListFilter) Name() string {
+	return FilterName_ALLOWLIST
+}
+
+func (filter *AllowListFilter) Check(message string, categories map[string]bool) (models.FilterVerdict, error) {
+	for _, pattern := range filter.patterns {
+		if pattern.MatchString(message) {
+			return models.FilterVerdict{Allowed: true, Reason: fmt.Sprintf("allow-listed by %s", pattern)}, nil
+		}
+	}
+	return models.FilterVerdict{}, nil
+}
+
+// Any OpenAI compatible /v1/moderations endpoint, flagged means blocked. Its categories don't line
+// up with the SMSFilter ones so the toggles aren't used here
+type ModerationFilter struct {
+	URL    string
+	APIKey string
+	Model  string
+	api    *filterAPIClient
+}
+
+type moderationRequest struct {
+	Input string `json:"input"`
+	Model string `json:"model,omitempty"`
+}
+
+type moderationResponse struct {
+	Model   string `json:"model"`
+	Results []struct {
+		Flagged    bool            `json:"flagged"`
+		Categories map[string]bool `json:"categories"`
+	} `json:"results"`
+}
+
+func (filter *ModerationFilter) Name() string {
+	return FilterName_MODERATION
+}
+
+func (filter *ModerationFilter) Check(message string, categories map[string]bool) (models.FilterVerdict, error) {
+	payload, err := json.Marshal(moderationRequest{Input: message, Model: filter.Model})
+	if err != nil {
+		return models.FilterVerdict{}, err
+	}
+	body, err := filter.api.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, filter.URL, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if filter.APIKey != "" {
+			req.Header.Set("Authorization", "Bearer "+filter.APIKey)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return models.FilterVerdict{}, err
+	}
+	var moderation moderationResponse
+	if err = json.Unmarshal(body, &moderation); err != nil {
+		return models.FilterVerdict{}, err
+	}
+	verdict := models.FilterVerdict{Model: moderation.Model}
+	for _, result := range moderation.Results {
+		verdict.Blocked = verdict.Blocked || result.Flagged
+		for category, flagged := range result.Categories {
+			if flagged {
+				verdict.IncludedCategories = append(verdict.IncludedCategories, category)
+			}
+		}
+	}
+	sort.Strings(verdict.IncludedCategories)
+	if verdict.Blocked {
+		verdict.Reason = fmt.Sprintf("flagged for %s", strings.Join(verdict.IncludedCategories, ", "))
+	}
+	return verdict, nil
+}
@@ -0,0 +1,144 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"microsms/config"
+	"microsms/models"
+	"testing"
+)
+
+// Keywords are trimmed whole words, a blank one is a config mistake rather than a match-all
+func TestRuleFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []string
+		keywords []string
+		message  string
+		blocked  bool
+		invalid  bool
+	}{
+		{"keyword", nil, []string{"casino"}, "Win big at the CASINO tonight", true, false},
+		{"keyword inside a word", nil, []string{"casino"}, "casinos are fine", false, false},
+		{"keyword padded", nil, []string{"  casino "}, "casino night", true, false},
+		{"rule", []string{`\d{4}-\d{4}`}, nil, "call 5555-0100", true, false},
+		{"nothing matches", []string{`\d{4}-\d{4}`}, []string{"casino"}, "see you at lunch", false, false},
+		{"empty keyword", nil, []string{"casino", ""}, "", false, true},
+		{"blank keyword", nil, []string{"   "}, "", false, true},
+		{"empty rule", []string{" "}, nil, "", false, true},
+		{"bad rule", []string{`(`}, nil, "", false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := NewRuleFilter(test.rules, test.keywords)
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("rules %q keywords %q accepted", test.rules, test.keywords)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			verdict, err := filter.Check(test.message, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if verdict.Blocked != test.blocked {
+				t.Errorf("%q blocked %t, expected %t (%s)", test.message, verdict.Blocked, test.blocked, verdict.Reason)
+			}
+		})
+	}
+}
+
+// A filter that always says the same thing
+type stubFilter struct {
+	name    string
+	verdict models.FilterVerdict
+	err     error
+	calls   int
+}
+
+func (filter *stubFilter) Name() string {
+	return filter.name
+}
+
+func (filter *stubFilter) Check(message string, categories map[string]bool) (models.FilterVerdict, error) {
+	filter.calls++
+	return filter.verdict, filter.err
+}
+
+// any blocks on the first block, all only when every filter blocks, an allow-list hit ends it
+// either way and an error stops the chain
+func TestFilterChainPolicies(t *testing.T) {
+	pass := models.FilterVerdict{}
+	block := models.FilterVerdict{Blocked: true}
+	allow := models.FilterVerdict{Allowed: true}
+	tests := []struct {
+		name     string
+		policy   string
+		verdicts []models.FilterVerdict
+		failing  int // index of a filter that errors, -1 for none
+		blocked  bool
+		backend  string // which filter decided
+		called   int    // filters asked
+	}{
+		{"any, nothing blocks", FilterPolicy_ANY, []models.FilterVerdict{pass, pass}, -1, false, "f1", 2},
+		{"any, first blocks", FilterPolicy_ANY, []models.FilterVerdict{block, pass}, -1, true, "f0", 1},
+		{"any, second blocks", FilterPolicy_ANY, []models.FilterVerdict{pass, block}, -1, true, "f1", 2},
+		{"all, one passes", FilterPolicy_ALL, []models.FilterVerdict{block, pass, block}, -1, false, "f1", 2},
+		{"all, every one blocks", FilterPolicy_ALL, []models.FilterVerdict{block, block}, -1, true, "f1", 2},
+		{"allow-listed first", FilterPolicy_ANY, []models.FilterVerdict{allow, block}, -1, false, "f0", 1},
+		{"allow-listed under all", FilterPolicy_ALL, []models.FilterVerdict{block, allow, block}, -1, false, "f1", 2},
+		{"error stops the chain", FilterPolicy_ANY, []models.FilterVerdict{pass, pass, block}, 1, false, "f1", 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chain := &FilterChain{Policy: test.policy}
+			var stubs []*stubFilter
+			for i, verdict := range test.verdicts {
+				stub := &stubFilter{name: fmt.Sprintf("f%d", i), verdict: verdict}
+				if i == test.failing {
+					stub.err = errors.New("down")
+				}
+				stubs = append(stubs, stub)
+				chain.Filters = append(chain.Filters, stub)
+			}
+			verdict, err := chain.Check("hello", nil)
+			if (err != nil) != (test.failing >= 0) {
+				t.Errorf("error %v, expected one %t", err, test.failing >= 0)
+			}
+			if verdict.Blocked != test.blocked || verdict.Backend != test.backend {
+				t.Errorf("blocked %t by %s, expected %t by %s", verdict.Blocked, verdict.Backend, test.blocked, test.backend)
+			}
+			called := 0
+			for _, stub := range stubs {
+				called += stub.calls
+			}
+			if called != test.called {
+				t.Errorf("asked %d filters, expected %d", called, test.called)
+			}
+		})
+	}
+}
+
+func TestFilterChainConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   config.FilterConfig
+		valid bool
+	}{
+		{"defaults to the api", config.FilterConfig{}, true},
+		{"local chain", config.FilterConfig{Policy: FilterPolicy_ALL, Chain: []string{FilterName_ALLOWLIST, FilterName_RULES}, Keywords: []string{"casino"}}, true},
+		{"unknown policy", config.FilterConfig{Policy: "most"}, false},
+		{"unknown filter", config.FilterConfig{Chain: []string{"magic"}}, false},
+		{"bad allow-list pattern", config.FilterConfig{Chain: []string{FilterName_ALLOWLIST}, AllowList: []string{"("}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewFilterChain(test.cfg); (err == nil) != test.valid {
+				t.Errorf("got %v, expected valid %t", err, test.valid)
+			}
+		})
+	}
+}
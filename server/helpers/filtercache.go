@@ -0,0 +1,96 @@
+package helpers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"microsms/config"
+	"microsms/constants"
+	"microsms/models"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var filterCacheConfig config.FilterCacheConfig
+var filterCacheHits atomic.Int64
+var filterCacheMisses atomic.Int64
+
+// SetFilterCacheGlobals sets the verdict cache config from main, a day by default
+func SetFilterCacheGlobals(cfg config.FilterCacheConfig) {
+	if cfg.TTL <= 0 {
+		cfg.TTL = 86400
+	}
+	filterCacheConfig = cfg
+}
+
+// Hit/miss counts are since startup, entry counts come from the DB
+type FilterCacheStats struct {
+	Enabled bool    `json:"enabled"`
+	TTL     int     `json:"ttl"`
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+	Entries int64   `json:"entries"`
+	Expired int64   `json:"expired"`
+}
+
+func GetFilterCacheStats() (FilterCacheStats, error) {
+	stats := FilterCacheStats{
+		Enabled: filterCacheConfig.Enabled,
+		TTL:     filterCacheConfig.TTL,
+		Hits:    filterCacheHits.Load(),
+		Misses:  filterCacheMisses.Load(),
+	}
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(lookups)
+	}
+	var err error
+	stats.Entries, stats.Expired, err = models.CountFilterCacheEntries(time.Now().Unix())
+	return stats, err
+}
+
+// Hash of everything that decides a verdict: the normalized message (so "ALERT:  pipe burst" and
+// "alert: pipe burst" share one), the categories it's screened for and
+// the chain (order and policy) doing the screening
+func filterCacheHash(message string, categories map[string]bool) string {
+	var policy []string
+	for category, enabled := range categories {
+		policy = append(policy, fmt.Sprintf("%s=%t", category, enabled))
+	}
+	slices.Sort(policy)
+	status := GetFilterStatus()
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%s", constants.NormalizeMessage(message), strings.Join(policy, ","), strings.Join(status.Chain, ","), status.Policy)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Cached verdict for the message, ok is false on a miss (or with the cache off). A broken cache
+// is just a miss, the filter still gets asked
+func lookupFilterCache(hash string) (models.FilterVerdict, bool) {
+	if !filterCacheConfig.Enabled {
+		return models.FilterVerdict{}, false
+	}
+	entry, err := models.GetFilterCacheEntry(hash, time.Now().Unix())
+	if err != nil {
+		fmt.Printf("Filter cache lookup failed: %s\n", err)
+	}
+	if entry == nil {
+		filterCacheMisses.Add(1)
+		return models.FilterVerdict{}, false
+	}
+	filterCacheHits.Add(1)
+	return entry.Verdict, true
+}
+
+// Only real answers get cached, an error says nothing about the message
+func storeFilterCache(hash string, verdict models.FilterVerdict) {
+	if !filterCacheConfig.Enabled || verdict.Error != "" {
+		return
+	}
+	expiresAt := time.Now().Add(time.Duration(filterCacheConfig.TTL) * time.Second).Unix()
+	if err := models.SaveFilterCacheEntry(hash, verdict, expiresAt); err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,208 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"microsms/config"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/**
+How we talk to the filter APIs. One client with a timeout shared by every HTTP backend, a few
+retries with jittered backoff for the failures worth retrying (connection errors, timeouts, 429
+and 5xx) and a circuit breaker per backend. Once a filter fails threshold calls in a row the
+breaker opens and we stop calling it for the cooldown, then a single probe call decides whether
+it closes again or stays open for another round.
+**/
+
+const (
+	BreakerPolicy_HOLD = "hold" // leave messages in filter_check, the requeue sweep rechecks them later
+	BreakerPolicy_FAIL = "fail" // error them like any other failed check
+
+	BreakerState_CLOSED    = "closed"
+	BreakerState_OPEN      = "open"
+	BreakerState_HALF_OPEN = "half_open" // cooldown is over and a probe call is out
+)
+
+var ErrFilterUnavailable = errors.New("filter unavailable, circuit breaker open")
+
+var filterBreakerPolicy = BreakerPolicy_HOLD
+
+// Tracks consecutive failures for one filter API
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	state     string
+	openedAt  time.Time
+}
+
+func newCircuitBreaker(cfg config.BreakerConfig) *circuitBreaker {
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = 5
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = 30
+	}
+	return &circuitBreaker{threshold: cfg.Threshold, cooldown: time.Duration(cfg.Cooldown) * time.Second, state: BreakerState_CLOSED}
+}
+
+// Whether a call may go out. Past the cooldown the first caller becomes the probe, everyone else
+// keeps getting turned away until it comes back
+func (breaker *circuitBreaker) allow() bool {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	switch breaker.state {
+	case BreakerState_OPEN:
+		if time.Since(breaker.openedAt) < breaker.cooldown {
+			return false
+		}
+		breaker.state = BreakerState_HALF_OPEN
+		return true
+	case BreakerState_HALF_OPEN:
+		return false
+	}
+	return true
+}
+
+// Record how a call went, returns true when this failure is the one that opened the breaker
+func (breaker *circuitBreaker) record(failed bool) bool {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	if !failed {
+		breaker.failures = 0
+		breaker.state = BreakerState_CLOSED
+		return false
+	}
+	breaker.failures++
+	if breaker.state == BreakerState_HALF_OPEN || breaker.failures >= breaker.threshold {
+		opened := breaker.state != BreakerState_OPEN
+		breaker.state = BreakerState_OPEN
+		breaker.openedAt = time.Now()
+		return opened
+	}
+	return false
+}
+
+// Open means calls are being turned away right now, an open breaker past its cooldown is about
+// to let a probe through so it doesn't count
+func (breaker *circuitBreaker) blocking() bool {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	switch breaker.state {
+	case BreakerState_OPEN:
+		return time.Since(breaker.openedAt) < breaker.cooldown
+	case BreakerState_HALF_OPEN:
+		return true
+	}
+	return false
+}
+
+func (breaker *circuitBreaker) State() string {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	return breaker.state
+}
+
+// The HTTP side of a filter backend: shared client, retry settings and its own breaker
+type filterAPIClient struct {
+	name         string
+	client       *http.Client
+	retries      int
+	retryBackoff time.Duration
+	breaker      *circuitBreaker
+}
+
+func newFilterAPIClient(name string, cfg config.FilterConfig) *filterAPIClient {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10
+	}
+	if cfg.Retries < 0 {
+		cfg.Retries = 0
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = 250
+	}
+	return &filterAPIClient{
+		name:         name,
+		client:       &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second},
+		retries:      cfg.Retries,
+		retryBackoff: time.Duration(cfg.RetryBackoff) * time.Millisecond,
+		breaker:      newCircuitBreaker(cfg.Breaker),
+	}
+}
+
+// A non-200 from the filter API, 429 and 5xx are worth another go
+type filterStatusError struct {
+	name       string
+	statusCode int
+}
+
+func (err *filterStatusError) Error() string {
+	return fmt.Sprintf("%s API returned non-200 status: %d", err.name, err.statusCode)
+}
+
+func retryableFilterError(err error) bool {
+	var statusErr *filterStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode == http.StatusTooManyRequests || statusErr.statusCode >= 500
+	}
+	return true // connection refused, timeouts, resets
+}
+
+// Send the request and hand back the 200 body. newRequest is called for every attempt since a
+// request body can only be read once. Only retryable failures count against the breaker, a 400
+// means the API is up and didn't like us
+func (api *filterAPIClient) do(newRequest func() (*http.Request, error)) ([]byte, error) {
+	if !api.breaker.allow() {
+		return nil, ErrFilterUnavailable
+	}
+	var body []byte
+	var err error
+	for attempt := 0; attempt <= api.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(api.retryDelay(attempt))
+		}
+		body, err = api.doOnce(newRequest)
+		if err == nil || !retryableFilterError(err) {
+			break
+		}
+		fmt.Printf("Filter %s attempt %d failed: %s\n", api.name, attempt+1, err)
+	}
+	failed := err != nil && retryableFilterError(err)
+	if api.breaker.record(failed) {
+		fmt.Printf("Filter %s keeps failing, circuit breaker open for %s\n", api.name, api.breaker.cooldown)
+	}
+	if failed && api.breaker.State() == BreakerState_OPEN {
+		return nil, fmt.Errorf("%w: %s", ErrFilterUnavailable, err)
+	}
+	return body, err
+}
+
+func (api *filterAPIClient) doOnce(newRequest func() (*http.Request, error)) ([]byte, error) {
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := api.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body) // so the connection can be reused
+		return nil, &filterStatusError{name: api.name, statusCode: resp.StatusCode}
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Exponential backoff with full jitter, same idea as the webhook retries but in milliseconds
+func (api *filterAPIClient) retryDelay(attempt int) time.Duration {
+	backoff := api.retryBackoff << (attempt - 1)
+	return backoff/2 + rand.N(backoff/2+1)
+}
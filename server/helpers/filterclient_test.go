@@ -0,0 +1,121 @@
+package helpers
+
+import (
+	"errors"
+	"microsms/config"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The breaker through a run of calls: opens at the threshold, turns everyone away for the
+// cooldown, then lets one probe decide
+func TestCircuitBreaker(t *testing.T) {
+	breaker := newCircuitBreaker(config.BreakerConfig{Threshold: 2, Cooldown: 30})
+	steps := []struct {
+		name    string
+		do      string // allow, fail, ok or cool (the cooldown runs out)
+		allowed bool   // for allow
+		opened  bool   // for fail, this failure opened it
+		state   string
+	}{
+		{"closed", "allow", true, false, BreakerState_CLOSED},
+		{"first failure", "fail", false, false, BreakerState_CLOSED},
+		{"success resets", "ok", false, false, BreakerState_CLOSED},
+		{"failure", "fail", false, false, BreakerState_CLOSED},
+		{"threshold", "fail", false, true, BreakerState_OPEN},
+		{"turned away", "allow", false, false, BreakerState_OPEN},
+		{"cooldown over", "cool", false, false, BreakerState_OPEN},
+		{"probe", "allow", true, false, BreakerState_HALF_OPEN},
+		{"only one probe", "allow", false, false, BreakerState_HALF_OPEN},
+		{"probe fails", "fail", false, true, BreakerState_OPEN},
+		{"open again", "allow", false, false, BreakerState_OPEN},
+		{"second cooldown", "cool", false, false, BreakerState_OPEN},
+		{"second probe", "allow", true, false, BreakerState_HALF_OPEN},
+		{"probe passes", "ok", false, false, BreakerState_CLOSED},
+	}
+	for _, step := range steps {
+		switch step.do {
+		case "allow":
+			if allowed := breaker.allow(); allowed != step.allowed {
+				t.Errorf("%s: allowed %t, expected %t", step.name, allowed, step.allowed)
+			}
+		case "fail":
+			if opened := breaker.record(true); opened != step.opened {
+				t.Errorf("%s: opened %t, expected %t", step.name, opened, step.opened)
+			}
+		case "ok":
+			breaker.record(false)
+		case "cool":
+			breaker.openedAt = breaker.openedAt.Add(-breaker.cooldown)
+		}
+		if state := breaker.State(); state != step.state {
+			t.Errorf("%s: breaker %s, expected %s", step.name, state, step.state)
+		}
+	}
+}
+
+// What gets retried and what counts against the breaker, the API answers with each status in turn
+func TestFilterAPIRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []int
+		rounds      int // calls to do, each one retries up to twice
+		calls       int32
+		ok          bool
+		unavailable bool
+		state       string
+	}{
+		{"first try", []int{200}, 1, 1, true, false, BreakerState_CLOSED},
+		{"retried 503", []int{503, 200}, 1, 2, true, false, BreakerState_CLOSED},
+		{"retried 429", []int{429, 429, 200}, 1, 3, true, false, BreakerState_CLOSED},
+		{"400 isn't retried", []int{400, 200}, 1, 1, false, false, BreakerState_CLOSED},
+		{"out of retries", []int{500, 500, 500}, 1, 3, false, false, BreakerState_CLOSED},
+		{"opens the breaker", []int{500}, 2, 6, false, true, BreakerState_OPEN},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls atomic.Int32
+			api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				call := int(calls.Add(1)) - 1
+				w.WriteHeader(test.statuses[min(call, len(test.statuses)-1)])
+			}))
+			defer api.Close()
+			client := newFilterAPIClient("test", config.FilterConfig{Retries: 2, RetryBackoff: 1, Breaker: config.BreakerConfig{Threshold: 2}})
+			newRequest := func() (*http.Request, error) { return http.NewRequest(http.MethodGet, api.URL, nil) }
+			var err error
+			for range test.rounds {
+				_, err = client.do(newRequest)
+			}
+			if (err == nil) != test.ok || errors.Is(err, ErrFilterUnavailable) != test.unavailable {
+				t.Errorf("got %v, expected ok %t unavailable %t", err, test.ok, test.unavailable)
+			}
+			if calls.Load() != test.calls {
+				t.Errorf("API called %d times, expected %d", calls.Load(), test.calls)
+			}
+			if state := client.breaker.State(); state != test.state {
+				t.Errorf("breaker %s, expected %s", state, test.state)
+			}
+			if test.unavailable {
+				before := calls.Load()
+				if _, err = client.do(newRequest); !errors.Is(err, ErrFilterUnavailable) || calls.Load() != before {
+					t.Errorf("open breaker let a call through (%v)", err)
+				}
+			}
+		})
+	}
+}
+
+// Jittered between half and all of the doubled backoff
+func TestFilterRetryDelay(t *testing.T) {
+	client := newFilterAPIClient("test", config.FilterConfig{RetryBackoff: 100})
+	for attempt, ceiling := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond} {
+		for range 20 {
+			if delay := client.retryDelay(attempt); delay < ceiling/2 || delay > ceiling {
+				t.Errorf("attempt %d waited %s, expected %s-%s", attempt, delay, ceiling/2, ceiling)
+			}
+		}
+	}
+}
@@ -1,38 +1,60 @@
 package helpers
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"microsms/constants"
 	"microsms/models"
-	"net/http"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 /**
 A simple package to help querying the SMS filter API. The filter API runs qwen and gives a simple
-boolean to indicate if a message is "blocked"
+boolean to indicate if a message is "blocked". Which filters actually run lives in filter.go
 **/
 
-var filterAPIURL string
+// Webhook event for a message clearing the filter, every other event is just the new status
+const WebhookEvent_FILTERED = "filtered"
 
 var filterWG *sync.WaitGroup
 var filterResultChan chan FilterResult
 var filterAPIChan chan struct{}
 
+// Requests with a check out right now, keyed on id. Cleared once the result has been handled
+var filterInFlight sync.Map
+
+// The requeue sweep only looks at filter_checks older than filterRequeueAge, anything younger is
+// most likely still on its first check
+const (
+	filterRequeueInterval  = 15 * time.Second
+	filterRequeueAge       = time.Minute
+	filterRequeueBatchSize = 50
+)
+
 type FilterResult struct {
 	SMSID   uuid.UUID
 	Blocked bool
 	Err     error
+	Verdict models.FilterVerdict
 }
 
 // SMSFilterRequest represents the request payload structure
 type SMSFilterRequest struct {
-	SMS string `json:"sms"`
+	SMS        string          `json:"sms"`
+	Categories map[string]bool `json:"-"` // violent_crimes etc, the API wants them next to sms
+}
+
+// Flatten the category toggles in beside sms, leaving one out means the API's own default
+func (request SMSFilterRequest) MarshalJSON() ([]byte, error) {
+	payload := map[string]interface{}{"sms": request.SMS}
+	for category, enabled := range request.Categories {
+		payload[category] = enabled
+	}
+	return json.Marshal(payload)
 }
 
 // SMSFilterResponse represents the response structure from the API
@@ -43,87 +65,189 @@ type SMSResponse struct {
 	ExcludedCategories []string `json:"excluded_categories"`
 }
 
-// SetFilterGlobals sets the waitgroup, channel, and API URL from main
-func SetFilterGlobals(wg *sync.WaitGroup, ch chan FilterResult, semaphore chan struct{}, apiURL string) {
+// SetFilterGlobals sets the waitgroup and channels from main
+func SetFilterGlobals(wg *sync.WaitGroup, ch chan FilterResult, semaphore chan struct{}) {
 	filterWG = wg
 	filterResultChan = ch
 	filterAPIChan = semaphore
-	filterAPIURL = apiURL
 }
 
+// Filter results only move requests still waiting on the filter, so a request cancelled
+// mid-check stays cancelled
+var filterCheckStatus = []constants.RequestStatus{constants.RequestStatus_FILTER_CHECK}
+
 // HandleFilterResults processes the results from the filter API channel
 func HandleFilterResults() {
 	for result := range filterResultChan {
-		fmt.Printf("Handling filter result for SMS ID: %s\n", result.SMSID)
+		handleFilterResult(result)
+		filterInFlight.Delete(result.SMSID)
+	}
+}
 
-		if result.Err != nil {
-			fmt.Printf("Error filtering SMS %s: %s\n", result.SMSID, result.Err)
-			_, err := models.UpdateSMSRequest(result.SMSID.String(), constants.RequestStatus_ERROR)
-			if err != nil {
-				fmt.Printf("Failed to update SMS %s to ERROR status: %s\n", result.SMSID, err)
-			}
-			continue
+func handleFilterResult(result FilterResult) {
+	fmt.Printf("Handling filter result for SMS ID: %s\n", result.SMSID)
+	// Keep the verdict before moving the request so the status event already carries it
+	if err := models.SaveFilterVerdict(result.SMSID.String(), result.Verdict); err != nil {
+		fmt.Println(err)
+	}
+
+	if errors.Is(result.Err, ErrFilterUnavailable) && filterBreakerPolicy == BreakerPolicy_HOLD {
+		// Not the message's fault, it waits in FILTER_CHECK and the requeue sweep tries it again
+		fmt.Printf("Filter unavailable, SMS %s stays in FILTER_CHECK: %s\n", result.SMSID, result.Err)
+		return
+	}
+
+	if result.Err != nil {
+		fmt.Printf("Error filtering SMS %s: %s\n", result.SMSID, result.Err)
+		_, _, err := models.TransitionSMSRequest(result.SMSID.String(), filterCheckStatus, constants.RequestStatus_ERROR)
+		if err != nil {
+			fmt.Printf("Failed to update SMS %s to ERROR status: %s\n", result.SMSID, err)
 		}
+		return
+	}
 
-		if result.Blocked {
-			fmt.Printf("SMS %s was blocked by filter\n", result.SMSID)
-			_, err := models.UpdateSMSRequest(result.SMSID.String(), constants.RequestStatus_BLOCKED)
-			if err != nil {
-				fmt.Printf("Failed to update SMS %s to BLOCKED status: %s\n", result.SMSID, err)
-			}
-		} else {
-			fmt.Printf("SMS %s passed filter, marking as READY_TO_SEND\n", result.SMSID)
-			_, err := models.UpdateSMSRequest(result.SMSID.String(), constants.RequestStatus_READY_TO_SEND)
-			if err != nil {
-				fmt.Printf("Failed to update SMS %s to READY_TO_SEND status: %s\n", result.SMSID, err)
+	if result.Blocked && holdForReview(result.Verdict) {
+		fmt.Printf("SMS %s is borderline, holding for review\n", result.SMSID)
+		_, _, err := models.TransitionSMSRequest(result.SMSID.String(), filterCheckStatus, constants.RequestStatus_HELD)
+		if err != nil {
+			fmt.Printf("Failed to update SMS %s to HELD status: %s\n", result.SMSID, err)
+		}
+	} else if result.Blocked {
+		fmt.Printf("SMS %s was blocked by filter\n", result.SMSID)
+		_, _, err := models.TransitionSMSRequest(result.SMSID.String(), filterCheckStatus, constants.RequestStatus_BLOCKED)
+		if err != nil {
+			fmt.Printf("Failed to update SMS %s to BLOCKED status: %s\n", result.SMSID, err)
+		}
+	} else if result.Verdict.Flagged {
+		// Passed the filter but the heuristics want a human to look first
+		fmt.Printf("SMS %s flagged by heuristics (%v), holding for review\n", result.SMSID, result.Verdict.Flags)
+		_, _, err := models.TransitionSMSRequest(result.SMSID.String(), filterCheckStatus, constants.RequestStatus_HELD)
+		if err != nil {
+			fmt.Printf("Failed to update SMS %s to HELD status: %s\n", result.SMSID, err)
+		}
+	} else {
+		fmt.Printf("SMS %s passed filter, checking opt in\n", result.SMSID)
+		smsrequest, moved, err := models.PassFilter(result.SMSID.String())
+		if err != nil {
+			fmt.Printf("Failed to move SMS %s on from FILTER_CHECK: %s\n", result.SMSID, err)
+		} else if moved {
+			models.NotifyStatusChange(smsrequest, WebhookEvent_FILTERED)
+		}
+	}
+}
+
+// RunFilterRequeue sends requests still sitting in filter_check back through the filter once no
+// breaker is turning calls away. Picks up what the hold policy parked plus anything a restart
+// left behind
+func RunFilterRequeue() {
+	ticker := time.NewTicker(filterRequeueInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if filterChain == nil || filterUnavailable() {
+			continue
+		}
+		smsrequests, err := models.GetStaleFilterChecks(time.Now().Add(-filterRequeueAge).Unix(), filterRequeueBatchSize)
+		if err != nil {
+			fmt.Printf("Failed loading stale filter checks: %s\n", err)
+			continue
+		}
+		for _, smsrequest := range smsrequests {
+			if _, running := filterInFlight.Load(smsrequest.ID); running {
+				continue
 			}
+			fmt.Printf("Requeueing SMS %s for the filter\n", smsrequest.ID)
+			filterWG.Add(1)
+			go CheckSMSMessage(smsrequest)
 		}
 	}
 }
 
 // CheckSMSMessage checks the message and sends result to channel (runs in goroutine)
-func CheckSMSMessage(smsID uuid.UUID, message string) {
+func CheckSMSMessage(smsrequest models.SMSRequest) {
 	defer filterWG.Done() // WG will decrement on function finish
+	smsID := smsrequest.ID
+	if _, running := filterInFlight.LoadOrStore(smsID, true); running {
+		return // the route and the requeue sweep raced, one check is plenty
+	}
 
 	// Acquire semaphore slot (blocks if max concurrent reached)
 	filterAPIChan <- struct{}{}
 	defer func() { <-filterAPIChan }() // Release slot when done
 
-	blocked, err := checkSMSMessage(message)
+	verdict, err := checkSMSMessage(&smsrequest)
 	filterResultChan <- FilterResult{
 		SMSID:   smsID,
-		Blocked: blocked,
+		Blocked: verdict.Blocked,
 		Err:     err,
+		Verdict: verdict,
 	}
 }
 
-// Fires Filter API request and returns the bool value
-func checkSMSMessage(message string) (bool, error) {
-	var smsResponse SMSResponse
-	var body []byte
-	var resp *http.Response
-	smsFilter := SMSFilterRequest{SMS: message}
-	payload, err := json.Marshal(smsFilter)
-	if err != nil {
-		goto ERROR
+// CheckTemplate runs a template body through the filter once and records the verdict on the
+// template (runs in goroutine)
+func CheckTemplate(templateID uuid.UUID, body string) {
+	defer filterWG.Done()
+
+	filterAPIChan <- struct{}{}
+	defer func() { <-filterAPIChan }()
+
+	if filterChain == nil {
+		// Nothing to screen it with, it stays pending until ScreenPendingTemplates gets to it
+		return
 	}
-	resp, err = http.Post(filterAPIURL, "application/json", bytes.NewBuffer(payload))
+	verdict, err := filterChain.Check(body, models.DefaultFilterCategories())
 	if err != nil {
-		goto ERROR
+		fmt.Printf("Error filtering template %s: %s\n", templateID, err)
+	}
+	if err = models.SetTemplateFilterResult(templateID, verdict.Blocked, verdict.Reason, err); err != nil {
+		fmt.Printf("Failed saving filter result for template %s: %s\n", templateID, err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("Filter API returned non-200 status: %d", resp.StatusCode)
-		goto ERROR
+}
+
+// Screen the templates still pending, the ones made while filtering was off or left over from a
+// restart. Runs once on startup, only does something when there's a filter chain
+func ScreenPendingTemplates() {
+	if filterChain == nil {
+		return
 	}
-	body, err = io.ReadAll(resp.Body)
+	templates, err := models.GetPendingTemplates()
 	if err != nil {
-		goto ERROR
+		fmt.Printf("Failed loading pending templates: %s\n", err)
+		return
 	}
-	fmt.Printf("Safety API returned %s", body)
-	err = json.Unmarshal(body, &smsResponse)
+	for _, template := range templates {
+		fmt.Printf("Screening pending template %s\n", template.ID)
+		filterWG.Add(1)
+		go CheckTemplate(template.ID, template.Body)
+	}
+}
 
-	return smsResponse.Blocked, nil
-ERROR:
-	return false, err
+// Scores the request on the local heuristics, then runs the message through the filter chain (or
+// takes the cached verdict for it) unless the heuristics already blocked it. The verdict comes back
+// stamped with when and how long
+func checkSMSMessage(smsrequest *models.SMSRequest) (models.FilterVerdict, error) {
+	started := time.Now()
+	var heuristics models.FilterVerdict
+	if applyHeuristics(smsrequest, &heuristics) {
+		heuristics.LatencyMs = time.Since(started).Milliseconds()
+		heuristics.CheckedAt = time.Now().UnixMilli()
+		return heuristics, nil
+	}
+	var verdict models.FilterVerdict
+	var err error
+	hash := filterCacheHash(smsrequest.Message, smsrequest.FilterCategories)
+	if cached, ok := lookupFilterCache(hash); ok {
+		verdict = cached
+		verdict.Cached = true
+	} else {
+		verdict, err = filterChain.Check(smsrequest.Message, smsrequest.FilterCategories)
+		if err != nil {
+			verdict.Error = err.Error()
+		}
+		storeFilterCache(hash, verdict) // before the heuristics go on, those belong to this request only
+	}
+	verdict.Score, verdict.Flags, verdict.Flagged = heuristics.Score, heuristics.Flags, heuristics.Flagged
+	verdict.LatencyMs = time.Since(started).Milliseconds()
+	verdict.CheckedAt = time.Now().UnixMilli()
+	return verdict, err
 }
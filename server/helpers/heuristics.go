@@ -0,0 +1,148 @@
+package helpers
+
+import (
+	"fmt"
+	"microsms/config"
+	"microsms/constants"
+	"microsms/models"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/**
+Local spam and abuse heuristics. These catch what's structural rather than semantic (shortened
+or unknown links, lookalike characters, one body blasted at a lot of numbers, a sender going
+much faster than usual) so they run per request, in Go, before any filter API is called. Every
+rule that fires adds its configured score and names itself in the verdict's flags.
+
+They're part of the filter check, so they only see requests in filter mode. Templated requests
+were screened with their template and fan out by design, system ones (otp codes) are our own
+text, and with filtering switched off nothing gets screened, heuristics included.
+**/
+
+const FilterName_HEURISTICS = "heuristics"
+
+var heuristicsConfig config.HeuristicsConfig
+
+// SetHeuristicsGlobals sets the heuristic rules from main
+func SetHeuristicsGlobals(cfg config.HeuristicsConfig) {
+	if cfg.FlagScore <= 0 {
+		cfg.FlagScore = 5
+	}
+	if cfg.BlockScore <= 0 {
+		cfg.BlockScore = 10
+	}
+	cfg.Shorteners = lowerAll(cfg.Shorteners)
+	cfg.LinkDomains = lowerAll(cfg.LinkDomains)
+	heuristicsConfig = cfg
+}
+
+func lowerAll(values []string) []string {
+	lowered := make([]string, 0, len(values))
+	for _, value := range values {
+		lowered = append(lowered, strings.ToLower(strings.TrimSpace(value)))
+	}
+	return lowered
+}
+
+// Hosts of every link in the message, www. dropped. The filter sees the message before its links
+// are rewritten, so these are where they really go
+func messageLinkHosts(smsrequest *models.SMSRequest) []string {
+	var hosts []string
+	for _, link := range constants.FindLinks(smsrequest.Message) {
+		hosts = append(hosts, link.Host)
+	}
+	slices.Sort(hosts)
+	return slices.Compact(hosts)
+}
+
+// Zero width and bidi control characters, nothing a normal text needs
+func invisibleRune(r rune) bool {
+	switch {
+	case r >= 0x200B && r <= 0x200F, r >= 0x202A && r <= 0x202E, r >= 0x2060 && r <= 0x2064, r >= 0x2066 && r <= 0x2069, r == 0xFEFF:
+		return true
+	}
+	return false
+}
+
+// A word mixing latin letters with cyrillic or greek ones, the classic "pаypal" with a cyrillic а
+func mixedScriptWord(word string) bool {
+	latin, lookalike := false, false
+	for _, r := range word {
+		switch {
+		case unicode.Is(unicode.Latin, r):
+			latin = true
+		case unicode.Is(unicode.Cyrillic, r), unicode.Is(unicode.Greek, r):
+			lookalike = true
+		}
+	}
+	return latin && lookalike
+}
+
+// Score the request, flags name every rule that fired
+func scoreHeuristics(smsrequest *models.SMSRequest) (int, []string) {
+	cfg := heuristicsConfig
+	score := 0
+	var flags []string
+	add := func(points int, flag string) {
+		if points > 0 {
+			score += points
+			flags = append(flags, flag)
+		}
+	}
+
+	for _, host := range messageLinkHosts(smsrequest) {
+		switch {
+		case constants.HostMatches(host, cfg.Shorteners):
+			add(cfg.ShortenerScore, "shortener:"+host)
+		case len(cfg.LinkDomains) > 0 && !constants.HostMatches(host, cfg.LinkDomains):
+			add(cfg.UnregisteredLinkScore, "unregistered_link:"+host)
+		}
+	}
+
+	if strings.IndexFunc(smsrequest.Message, invisibleRune) >= 0 {
+		add(cfg.InvisibleCharScore, "invisible_characters")
+	}
+	if slices.ContainsFunc(strings.Fields(smsrequest.Message), mixedScriptWord) {
+		add(cfg.MixedScriptScore, "mixed_script")
+	}
+
+	if cfg.FanOut.Count > 0 && cfg.FanOut.Window > 0 {
+		window := time.Duration(cfg.FanOut.Window) * time.Second
+		recipients, err := models.CountBodyRecipients(smsrequest.BodyHash, time.Now().Add(-window).Unix())
+		if err != nil {
+			fmt.Printf("Failed counting recipients for SMS %s: %s\n", smsrequest.ID, err)
+		} else if recipients > int64(cfg.FanOut.Count) {
+			add(cfg.FanOut.Score, fmt.Sprintf("fan_out:%d recipients in %s", recipients, window))
+		}
+	}
+	if cfg.Velocity.Count > 0 && cfg.Velocity.Window > 0 {
+		window := time.Duration(cfg.Velocity.Window) * time.Second
+		requests, err := models.CountSenderRequests(smsrequest.FromOptInID, time.Now().Add(-window).Unix())
+		if err != nil {
+			fmt.Printf("Failed counting sender requests for SMS %s: %s\n", smsrequest.ID, err)
+		} else if requests > int64(cfg.Velocity.Count) {
+			add(cfg.Velocity.Score, fmt.Sprintf("velocity:%d requests in %s", requests, window))
+		}
+	}
+	return score, flags
+}
+
+// Run the heuristics and stamp the result on the verdict. blocked means the score is at or over
+// the block threshold and no filter needs asking
+func applyHeuristics(smsrequest *models.SMSRequest, verdict *models.FilterVerdict) (blocked bool) {
+	if !heuristicsConfig.Enabled {
+		return false
+	}
+	verdict.Score, verdict.Flags = scoreHeuristics(smsrequest)
+	verdict.Flagged = verdict.Score >= heuristicsConfig.FlagScore
+	if verdict.Score < heuristicsConfig.BlockScore {
+		return false
+	}
+	verdict.Blocked = true
+	verdict.Backend = FilterName_HEURISTICS
+	verdict.Reason = fmt.Sprintf("scored %d on %s", verdict.Score, strings.Join(verdict.Flags, ", "))
+	return true
+}
@@ -0,0 +1,55 @@
+package helpers
+
+import (
+	"microsms/config"
+	"microsms/models"
+	"slices"
+	"testing"
+)
+
+// The rules that only look at the message, each one adds its score and names itself. Fan out and
+// velocity count stored requests and are covered where there's a database
+func TestHeuristicsScoring(t *testing.T) {
+	SetHeuristicsGlobals(config.HeuristicsConfig{
+		Enabled:               true,
+		FlagScore:             5,
+		BlockScore:            10,
+		Shorteners:            []string{"Bit.ly"},
+		ShortenerScore:        4,
+		LinkDomains:           []string{"example.com"},
+		UnregisteredLinkScore: 3,
+		MixedScriptScore:      5,
+		InvisibleCharScore:    2,
+	})
+	t.Cleanup(func() { SetHeuristicsGlobals(config.HeuristicsConfig{}) })
+	tests := []struct {
+		name    string
+		message string
+		score   int
+		flags   []string
+		flagged bool
+		blocked bool
+	}{
+		{"clean", "see you at lunch", 0, nil, false, false},
+		{"own domain", "details at https://www.example.com/a", 0, nil, false, false},
+		{"shortener", "click https://bit.ly/x", 4, []string{"shortener:bit.ly"}, false, false},
+		{"unregistered", "click https://evil.test/x", 3, []string{"unregistered_link:evil.test"}, false, false},
+		{"same host once", "https://evil.test/a and https://evil.test/b", 3, []string{"unregistered_link:evil.test"}, false, false},
+		{"invisible", "pay​pal", 2, []string{"invisible_characters"}, false, false},
+		{"mixed script", "log in to pаypal", 5, []string{"mixed_script"}, true, false},
+		{"cyrillic alone is fine", "привет друг", 0, nil, false, false},
+		{"enough to block", "pаypal​ https://bit.ly/x", 11, []string{"shortener:bit.ly", "invisible_characters", "mixed_script"}, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var verdict models.FilterVerdict
+			blocked := applyHeuristics(&models.SMSRequest{Message: test.message}, &verdict)
+			if verdict.Score != test.score || !slices.Equal(verdict.Flags, test.flags) {
+				t.Errorf("scored %d on %v, expected %d on %v", verdict.Score, verdict.Flags, test.score, test.flags)
+			}
+			if verdict.Flagged != test.flagged || blocked != test.blocked || verdict.Blocked != test.blocked {
+				t.Errorf("flagged %t blocked %t, expected %t and %t", verdict.Flagged, blocked, test.flagged, test.blocked)
+			}
+		})
+	}
+}
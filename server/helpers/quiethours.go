@@ -0,0 +1,139 @@
+package helpers
+
+import (
+	"fmt"
+	"microsms/config"
+	"microsms/constants"
+	"microsms/models"
+	"slices"
+	"strings"
+	"time"
+)
+
+/**
+Quiet hours. Non urgent messages don't go out inside the configured windows, evaluated in the
+recipient's local time (their opt in's timezone if set, otherwise a guess off the area code).
+Deferred requests just stay ready_to_send until the window closes.
+**/
+
+type quietWindow struct {
+	start int // minutes after local midnight
+	end   int
+}
+
+var quietHoursConfig config.QuietHoursConfig
+var quietWindows []quietWindow
+var quietDefaultLocation *time.Location
+
+func parseClock(clock string) (int, error) {
+	parsed, err := time.Parse("15:04", strings.TrimSpace(clock))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s", clock)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+// SetQuietHoursGlobals parses the windows from the config, a bad window or zone is an error
+func SetQuietHoursGlobals(cfg config.QuietHoursConfig) error {
+	var err error
+	if cfg.DefaultTimezone == "" {
+		cfg.DefaultTimezone = "America/New_York"
+	}
+	if cfg.Bypass == nil {
+		cfg.Bypass = []string{string(constants.RequestPriority_OTP)}
+	}
+	if quietDefaultLocation, err = time.LoadLocation(cfg.DefaultTimezone); err != nil {
+		return fmt.Errorf("invalid default timezone %s", cfg.DefaultTimezone)
+	}
+	quietWindows = nil
+	for _, raw := range cfg.Windows {
+		start, end, found := strings.Cut(raw, "-")
+		if !found {
+			return fmt.Errorf("invalid quiet hours window %s, expected HH:MM-HH:MM", raw)
+		}
+		var window quietWindow
+		if window.start, err = parseClock(start); err != nil {
+			return err
+		}
+		if window.end, err = parseClock(end); err != nil {
+			return err
+		}
+		quietWindows = append(quietWindows, window)
+	}
+	quietHoursConfig = cfg
+	return nil
+}
+
+// Where the recipient is, opt in override first then the area code then the default
+func recipientLocation(smsrequest *models.SMSRequest) *time.Location {
+	for _, name := range []string{smsrequest.ToOptIn.Timezone, constants.TimezoneForNumber(smsrequest.ToNumber)} {
+		if name == "" {
+			continue
+		}
+		if location, err := time.LoadLocation(name); err == nil {
+			return location
+		}
+	}
+	return quietDefaultLocation
+}
+
+// When the window covering local time t closes, zero time if t isn't in it
+func (window quietWindow) closesAfter(t time.Time) time.Time {
+	minutes := t.Hour()*60 + t.Minute()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	at := func(days int, minutes int) time.Time {
+		return midnight.AddDate(0, 0, days).Add(time.Duration(minutes) * time.Minute)
+	}
+	switch {
+	case window.start == window.end:
+		return time.Time{}
+	case window.start < window.end: // same day, 13:00-14:00
+		if minutes >= window.start && minutes < window.end {
+			return at(0, window.end)
+		}
+	case minutes >= window.start: // wraps midnight, 21:00-08:00, evening side
+		return at(1, window.end)
+	case minutes < window.end: // morning side
+		return at(0, window.end)
+	}
+	return time.Time{}
+}
+
+// QuietHoursWait is how long the request has to sit before quiet hours let it out, 0 if it can go now
+func QuietHoursWait(smsrequest *models.SMSRequest) time.Duration {
+	return quietHoursWait(smsrequest, time.Now())
+}
+
+func quietHoursWait(smsrequest *models.SMSRequest, now time.Time) time.Duration {
+	if !quietHoursConfig.Enabled || len(quietWindows) == 0 || slices.Contains(quietHoursConfig.Bypass, string(smsrequest.Priority)) {
+		return 0
+	}
+	now = now.In(recipientLocation(smsrequest))
+	opens := now
+	// Windows can sit back to back, keep walking until we land outside all of them
+	for range quietWindows {
+		moved := false
+		for _, window := range quietWindows {
+			if closes := window.closesAfter(opens); !closes.IsZero() {
+				opens = closes
+				moved = true
+			}
+		}
+		if !moved {
+			break
+		}
+	}
+	return opens.Sub(now)
+}
+
+// ClaimCheck is what models runs before handing a request to a worker. Quiet hours and frequency
+// caps go first so a deferred request doesn't use up throttle tokens
+func ClaimCheck(smsrequest *models.SMSRequest) time.Duration {
+	if wait := QuietHoursWait(smsrequest); wait > 0 {
+		return wait
+	}
+	if wait := models.FrequencyCapWait(smsrequest); wait > 0 {
+		return wait
+	}
+	return ThrottleSMSRequest(smsrequest)
+}
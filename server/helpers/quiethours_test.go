@@ -0,0 +1,69 @@
+package helpers
+
+import (
+	"microsms/config"
+	"microsms/constants"
+	"microsms/models"
+	"testing"
+	"time"
+)
+
+// How long a request waits at different local times, windows wrapping midnight and sitting back
+// to back included
+func TestQuietHoursWait(t *testing.T) {
+	err := SetQuietHoursGlobals(config.QuietHoursConfig{Enabled: true, Windows: []string{"21:00-08:00", "08:00-09:00", "12:00-13:00"}, DefaultTimezone: "UTC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetQuietHoursGlobals(config.QuietHoursConfig{}) })
+	tests := []struct {
+		name     string
+		at       string // UTC
+		timezone string
+		priority constants.RequestPriority
+		wait     time.Duration
+	}{
+		{"before the evening window", "20:59", "UTC", "", 0},
+		{"evening", "21:00", "UTC", "", 12 * time.Hour},
+		{"overnight into the next window", "02:30", "UTC", "", 6*time.Hour + 30*time.Minute},
+		{"second window", "08:00", "UTC", "", time.Hour},
+		{"open", "09:00", "UTC", "", 0},
+		{"lunch", "12:30", "UTC", "", 30 * time.Minute},
+		{"otp bypasses", "22:00", "UTC", constants.RequestPriority_OTP, 0},
+		{"recipient's own timezone", "05:00", "America/Los_Angeles", "", 11 * time.Hour}, // 22:00 PDT
+		{"open in the recipient's timezone", "20:00", "America/Los_Angeles", "", 0},      // 13:00 PDT
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now, err := time.Parse("2006-01-02 15:04", "2026-07-15 "+test.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			smsrequest := &models.SMSRequest{ToNumber: "555-555-0101", Priority: test.priority, ToOptIn: models.OptIn{Timezone: test.timezone}}
+			if wait := quietHoursWait(smsrequest, now); wait != test.wait {
+				t.Errorf("waits %s, expected %s", wait, test.wait)
+			}
+		})
+	}
+}
+
+func TestQuietHoursConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   config.QuietHoursConfig
+		valid bool
+	}{
+		{"windows", config.QuietHoursConfig{Windows: []string{"21:00-08:00", " 12:00 - 13:00 "}}, true},
+		{"no end", config.QuietHoursConfig{Windows: []string{"21:00"}}, false},
+		{"bad time", config.QuietHoursConfig{Windows: []string{"25:00-08:00"}}, false},
+		{"bad timezone", config.QuietHoursConfig{DefaultTimezone: "Mars/Olympus_Mons"}, false},
+	}
+	t.Cleanup(func() { SetQuietHoursGlobals(config.QuietHoursConfig{}) })
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := SetQuietHoursGlobals(test.cfg); (err == nil) != test.valid {
+				t.Errorf("got %v, expected valid %t", err, test.valid)
+			}
+		})
+	}
+}
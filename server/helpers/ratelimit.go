@@ -0,0 +1,57 @@
+package helpers
+
+import (
+	"sync"
+	"time"
+)
+
+// WindowLimiter allows limit hits per key inside a sliding window, in memory only so it resets on restart
+type WindowLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	hits   map[string][]time.Time
+	swept  time.Time
+}
+
+func NewWindowLimiter(limit int, window time.Duration) *WindowLimiter {
+	return &WindowLimiter{limit: limit, window: window, hits: make(map[string][]time.Time), swept: time.Now()}
+}
+
+// Allow records a hit for key and says whether it was inside the limit
+func (limiter *WindowLimiter) Allow(key string) bool {
+	return limiter.allow(key, time.Now())
+}
+
+func (limiter *WindowLimiter) allow(key string, now time.Time) bool {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	cutoff := now.Add(-limiter.window)
+	limiter.sweep(now, cutoff)
+	recent := limiter.hits[key][:0]
+	for _, hit := range limiter.hits[key] {
+		if hit.After(cutoff) {
+			recent = append(recent, hit)
+		}
+	}
+	if len(recent) >= limiter.limit {
+		limiter.hits[key] = recent
+		return false
+	}
+	limiter.hits[key] = append(recent, now)
+	return true
+}
+
+// Keys are whatever an unauthenticated caller sends, so once a window drop every key whose last
+// hit has aged out instead of keeping them all forever
+func (limiter *WindowLimiter) sweep(now time.Time, cutoff time.Time) {
+	if now.Sub(limiter.swept) < limiter.window {
+		return
+	}
+	limiter.swept = now
+	for key, hits := range limiter.hits {
+		if len(hits) == 0 || !hits[len(hits)-1].After(cutoff) {
+			delete(limiter.hits, key)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package helpers
+
+import (
+	"testing"
+	"time"
+)
+
+// Hits age out of the window one by one, and keys nobody has hit in a window are dropped
+func TestWindowLimiter(t *testing.T) {
+	limiter := NewWindowLimiter(2, time.Minute)
+	start := limiter.swept
+	tests := []struct {
+		name    string
+		key     string
+		after   time.Duration
+		allowed bool
+		keys    int
+	}{
+		{"first", "555-0100", 0, true, 1},
+		{"second", "555-0100", time.Second, true, 1},
+		{"over the limit", "555-0100", 2 * time.Second, false, 1},
+		{"another key", "555-0101", 3 * time.Second, true, 2},
+		{"first hit aged out", "555-0100", 61 * time.Second, true, 2},
+		{"idle key swept", "555-0102", 5 * time.Minute, true, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if allowed := limiter.allow(test.key, start.Add(test.after)); allowed != test.allowed {
+				t.Errorf("allowed %t, expected %t", allowed, test.allowed)
+			}
+			if len(limiter.hits) != test.keys {
+				t.Errorf("holding %d keys, expected %d", len(limiter.hits), test.keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package helpers
+
+import (
+	"fmt"
+	"microsms/config"
+	"microsms/models"
+	"sync"
+	"time"
+)
+
+/**
+Background retention sweep, the rules themselves live in models/Retention.go. It runs once at
+startup and then every interval, and remembers the last run so the admin preview can show it
+next to what the next one is going to do.
+**/
+
+var retentionConfig config.RetentionConfig
+var retentionMu sync.Mutex
+var retentionLastRun *models.RetentionRun
+var retentionNextRun time.Time
+
+// Where the sweep stands, NextRunAt is 0 while it's switched off
+type RetentionStatus struct {
+	Enabled   bool                 `json:"enabled"`
+	Interval  int                  `json:"interval"` // seconds
+	NextRunAt int64                `json:"next_run_at"`
+	LastRun   *models.RetentionRun `json:"last_run"`
+}
+
+// SetRetentionGlobals sets the sweep config from main and checks the rules
+func SetRetentionGlobals(cfg config.RetentionConfig) error {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 3600
+	}
+	retentionConfig = cfg
+	return models.SetRetentionPolicy(cfg)
+}
+
+func GetRetentionStatus() RetentionStatus {
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+	status := RetentionStatus{Enabled: retentionConfig.Enabled, Interval: retentionConfig.Interval, LastRun: retentionLastRun}
+	if retentionConfig.Enabled && !retentionNextRun.IsZero() {
+		status.NextRunAt = retentionNextRun.Unix()
+	}
+	return status
+}
+
+// RunRetentionSweeper applies the retention rules now and then every interval. Returns straight
+// away when retention is off. Run it in a goroutine
+func RunRetentionSweeper() {
+	if !retentionConfig.Enabled {
+		return
+	}
+	interval := time.Duration(retentionConfig.Interval) * time.Second
+	for {
+		run, err := models.RunRetention(time.Now())
+		if err != nil {
+			fmt.Printf("Retention sweep failed: %s\n", err)
+			run.Error = err.Error()
+		} else if run.Redacted > 0 || run.Deleted > 0 {
+			fmt.Printf("Retention sweep redacted %d and deleted %d requests in %dms\n", run.Redacted, run.Deleted, run.DurationMs)
+		}
+		retentionMu.Lock()
+		retentionLastRun = run
+		retentionNextRun = time.Now().Add(interval)
+		retentionMu.Unlock()
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,48 @@
+package helpers
+
+import (
+	"fmt"
+	"microsms/config"
+	"microsms/models"
+	"slices"
+)
+
+const (
+	ReviewMode_BLOCK = "block"           // a blocked verdict blocks the request, appeal through the review queue
+	ReviewMode_HOLD  = "hold_for_review" // borderline blocks wait in held for an admin instead
+)
+
+var reviewConfig config.ReviewConfig
+
+// SetReviewGlobals sets how blocked verdicts are handled, from main
+func SetReviewGlobals(cfg config.ReviewConfig) error {
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = ReviewMode_BLOCK
+	case ReviewMode_BLOCK, ReviewMode_HOLD:
+	default:
+		return fmt.Errorf("invalid filter review mode %s", cfg.Mode)
+	}
+	reviewConfig = cfg
+	return nil
+}
+
+// Whether a blocked verdict should wait for a human. Only in hold_for_review mode, and only when
+// every category it was blocked for is on the borderline list (an empty list holds every block)
+func holdForReview(verdict models.FilterVerdict) bool {
+	if reviewConfig.Mode != ReviewMode_HOLD || !verdict.Blocked {
+		return false
+	}
+	if len(reviewConfig.Borderline) == 0 {
+		return true
+	}
+	if len(verdict.IncludedCategories) == 0 {
+		return false // rule and keyword hits are deliberate, nothing borderline about them
+	}
+	for _, category := range verdict.IncludedCategories {
+		if !slices.Contains(reviewConfig.Borderline, category) {
+			return false
+		}
+	}
+	return true
+}
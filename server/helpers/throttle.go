@@ -0,0 +1,175 @@
+package helpers
+
+import (
+	"fmt"
+	"math"
+	"microsms/config"
+	"microsms/models"
+	"sync"
+	"time"
+)
+
+/**
+Server side send pacing. Every sender and recipient number gets token buckets (per minute, hour
+and day, whichever are configured) and a request is only handed to a worker when all of its
+buckets have a token. Anything throttled just stays ready_to_send for the next poll. Tokens
+are only spent on a claim that actually goes through, one another worker won gets refunded.
+Buckets live in memory so a restart hands everyone a full bucket again.
+**/
+
+type tokenBucket struct {
+	tokens   float64
+	capacity float64
+	rate     float64 // tokens per second
+	updated  time.Time
+}
+
+func (bucket *tokenBucket) refill(now time.Time) {
+	bucket.tokens = math.Min(bucket.capacity, bucket.tokens+now.Sub(bucket.updated).Seconds()*bucket.rate)
+	bucket.updated = now
+}
+
+// How long until there's a whole token, 0 if there already is
+func (bucket *tokenBucket) wait() time.Duration {
+	if bucket.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / bucket.rate * float64(time.Second))
+}
+
+type throttleLimit struct {
+	name   string // ends up in the bucket key, e.g. sender/minute
+	limit  int
+	period time.Duration
+}
+
+type Throttle struct {
+	mu      sync.Mutex
+	sender  []throttleLimit
+	to      []throttleLimit
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+// How often full buckets get dropped
+const throttleSweepInterval = time.Minute
+
+var sendThrottle *Throttle
+
+// SetThrottleGlobals builds the send throttle from the config, 0 on a limit switches it off
+func SetThrottleGlobals(cfg config.ThrottleConfig) {
+	sendThrottle = NewThrottle(cfg)
+}
+
+func NewThrottle(cfg config.ThrottleConfig) *Throttle {
+	throttle := &Throttle{buckets: make(map[string]*tokenBucket), swept: time.Now()}
+	add := func(limits *[]throttleLimit, name string, limit int, period time.Duration) {
+		if limit > 0 {
+			*limits = append(*limits, throttleLimit{name: name, limit: limit, period: period})
+		}
+	}
+	add(&throttle.sender, "sender/minute", cfg.SenderPerMinute, time.Minute)
+	add(&throttle.sender, "sender/hour", cfg.SenderPerHour, time.Hour)
+	add(&throttle.sender, "sender/day", cfg.SenderPerDay, 24*time.Hour)
+	add(&throttle.to, "recipient/minute", cfg.RecipientPerMinute, time.Minute)
+	add(&throttle.to, "recipient/hour", cfg.RecipientPerHour, time.Hour)
+	add(&throttle.to, "recipient/day", cfg.RecipientPerDay, 24*time.Hour)
+	return throttle
+}
+
+func (throttle *Throttle) bucket(limit throttleLimit, number string, now time.Time) *tokenBucket {
+	key := limit.name + "/" + number
+	bucket, ok := throttle.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{
+			tokens:   float64(limit.limit),
+			capacity: float64(limit.limit),
+			rate:     float64(limit.limit) / limit.period.Seconds(),
+			updated:  now,
+		}
+		throttle.buckets[key] = bucket
+	}
+	bucket.refill(now)
+	return bucket
+}
+
+// A bucket that has refilled all the way is no different from one that was never made, so every
+// so often drop those rather than keep one per number ever seen
+func (throttle *Throttle) sweep(now time.Time) {
+	if now.Sub(throttle.swept) < throttleSweepInterval {
+		return
+	}
+	throttle.swept = now
+	for key, bucket := range throttle.buckets {
+		if bucket.refill(now); bucket.tokens >= bucket.capacity {
+			delete(throttle.buckets, key)
+		}
+	}
+}
+
+// Take a token from every bucket the pair touches, or none of them. Hands back how long until
+// it would go through when it doesn't
+func (throttle *Throttle) Take(sender string, recipient string) time.Duration {
+	return throttle.take(sender, recipient, time.Now())
+}
+
+func (throttle *Throttle) take(sender string, recipient string, now time.Time) time.Duration {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+	throttle.sweep(now)
+	var buckets []*tokenBucket
+	for _, limit := range throttle.sender {
+		buckets = append(buckets, throttle.bucket(limit, sender, now))
+	}
+	for _, limit := range throttle.to {
+		buckets = append(buckets, throttle.bucket(limit, recipient, now))
+	}
+	var wait time.Duration
+	for _, bucket := range buckets {
+		wait = max(wait, bucket.wait())
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return 0
+}
+
+// Give back the token Take took from every bucket the pair touches, for a claim that didn't happen
+func (throttle *Throttle) Give(sender string, recipient string) {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+	now := time.Now()
+	for _, limit := range throttle.sender {
+		bucket := throttle.bucket(limit, sender, now)
+		bucket.tokens = math.Min(bucket.capacity, bucket.tokens+1)
+	}
+	for _, limit := range throttle.to {
+		bucket := throttle.bucket(limit, recipient, now)
+		bucket.tokens = math.Min(bucket.capacity, bucket.tokens+1)
+	}
+}
+
+// ThrottleSMSRequest is the models claim check, keyed on the opt in ids so every way of writing
+// a number lands in the same bucket
+func ThrottleSMSRequest(smsrequest *models.SMSRequest) time.Duration {
+	if sendThrottle == nil {
+		return 0
+	}
+	wait := sendThrottle.Take(smsrequest.FromOptInID.String(), smsrequest.ToOptInID.String())
+	if wait > 0 {
+		fmt.Printf("SMSRequest %s throttled for %s\n", smsrequest.ID, wait)
+	}
+	return wait
+}
+
+// UnthrottleSMSRequest refunds ThrottleSMSRequest when the claim it let through lost the race
+// to another worker or didn't commit
+func UnthrottleSMSRequest(smsrequest *models.SMSRequest) {
+	if sendThrottle == nil {
+		return
+	}
+	sendThrottle.Give(smsrequest.FromOptInID.String(), smsrequest.ToOptInID.String())
+}
@@ -0,0 +1,39 @@
+package helpers
+
+import (
+	"microsms/config"
+	"testing"
+	"time"
+)
+
+// Buckets refill at limit per period, a claim needs a token from the sender's and the
+// recipient's, and buckets back to full get dropped
+func TestThrottle(t *testing.T) {
+	throttle := NewThrottle(config.ThrottleConfig{SenderPerMinute: 2, RecipientPerMinute: 1})
+	start := throttle.swept
+	tests := []struct {
+		name      string
+		sender    string
+		recipient string
+		after     time.Duration
+		throttled bool
+		buckets   int
+	}{
+		{"first", "a", "x", 0, false, 2},
+		{"recipient spent", "a", "y", 0, false, 3},
+		{"recipient empty", "b", "x", time.Second, true, 4},
+		{"sender empty", "a", "z", 2 * time.Second, true, 5},
+		{"recipient refilled", "b", "x", 61 * time.Second, false, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wait := throttle.take(test.sender, test.recipient, start.Add(test.after))
+			if (wait > 0) != test.throttled {
+				t.Errorf("waited %s, expected throttled %t", wait, test.throttled)
+			}
+			if len(throttle.buckets) != test.buckets {
+				t.Errorf("holding %d buckets, expected %d", len(throttle.buckets), test.buckets)
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package helpers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"microsms/config"
+	"microsms/models"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+/**
+Outbound webhooks. Every status change (and every inbound reply) turns into one WebhookDelivery row per interested URL, the
+dispatcher loop hands the due rows to a pool of workers that POST a signed JSON event and reschedule failures
+with exponential backoff until they run out of attempts and land in the dead letter view.
+
+Signature header is X-MicroSMS-Signature: t=<unix seconds>,v1=<hex hmac-sha256(secret, "<t>.<body>")>
+**/
+
+const webhookBatchSize = 20
+
+var webhookConfig config.WebhookConfig
+var webhookClient *http.Client
+var callbackClient *http.Client // for callback_urls, won't connect to internal addresses
+
+// Webhook event for a reply coming in, carries the inbound text plus the request it threaded onto
+const WebhookEvent_INBOUND = "inbound"
+
+// The JSON body we POST
+type WebhookEvent struct {
+	ID         uuid.UUID              `json:"id"` // delivery id, stays the same across retries so receivers can dedupe
+	Event      string                 `json:"event"`
+	Created    int64                  `json:"created"`
+	SMSRequest *models.SMSRequest     `json:"smsrequest,omitempty"`
+	Inbound    *models.InboundMessage `json:"inbound,omitempty"`
+}
+
+// SetWebhookGlobals sets the webhook config from main, zero values fall back to sane defaults
+func SetWebhookGlobals(cfg config.WebhookConfig) {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 8
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = 5
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 3600
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 4
+	}
+	webhookConfig = cfg
+	webhookClient = &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second}
+	callbackClient = newCallbackClient(time.Duration(cfg.Timeout) * time.Second)
+}
+
+// The address is checked as it's dialed rather than when the URL is parsed, so a hostname that
+// resolves (or a redirect that points) somewhere internal doesn't get through either
+func newCallbackClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: func(network string, address string, conn syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !models.CallbackAddressAllowed(ip) {
+			return fmt.Errorf("%w: %s is an internal address", models.ErrCallbackURLNotAllowed, host)
+		}
+		return nil
+	}}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil // a proxy would do the dialing and skip the check
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// EnqueueWebhookEvent queues the event for every registered webhook that wants it plus the
+// request's own callback_url. Hooked up as the models status change handler
+func EnqueueWebhookEvent(smsrequest *models.SMSRequest, event string) {
+	enqueueWebhookEvent(event, smsrequest, nil)
+}
+
+// EnqueueInboundWebhookEvent forwards a reply, smsrequest is the request it threaded onto (can
+// be nil). A threaded reply also goes to that request's callback_url
+func EnqueueInboundWebhookEvent(inbound *models.InboundMessage, smsrequest *models.SMSRequest) {
+	enqueueWebhookEvent(WebhookEvent_INBOUND, smsrequest, inbound)
+}
+
+func enqueueWebhookEvent(event string, smsrequest *models.SMSRequest, inbound *models.InboundMessage) {
+	webhooks, err := models.GetWebhooks()
+	if err != nil {
+		fmt.Printf("Failed loading webhooks for %s event: %s\n", event, err)
+		return
+	}
+	for _, webhook := range webhooks {
+		if webhook.Wants(event) {
+			enqueueWebhookDelivery(&webhook.ID, webhook.URL, event, smsrequest, inbound)
+		}
+	}
+	if smsrequest != nil && smsrequest.CallbackURL != "" {
+		enqueueWebhookDelivery(nil, smsrequest.CallbackURL, event, smsrequest, inbound)
+	}
+}
+
+func enqueueWebhookDelivery(webhookID *uuid.UUID, url string, event string, smsrequest *models.SMSRequest, inbound *models.InboundMessage) {
+	delivery := models.WebhookDelivery{
+		ID:            uuid.New(), // picked here so the payload can carry it
+		WebhookID:     webhookID,
+		URL:           url,
+		Event:         event,
+		NextAttemptAt: time.Now().UnixMilli(),
+	}
+	if smsrequest != nil {
+		delivery.SMSRequestID = &smsrequest.ID
+	}
+	if inbound != nil {
+		delivery.InboundMessageID = &inbound.ID
+	}
+	// Snapshot the request as it is right now, a retry an hour later should still say what happened then
+	payload, err := json.Marshal(WebhookEvent{ID: delivery.ID, Event: event, Created: time.Now().Unix(), SMSRequest: smsrequest, Inbound: inbound})
+	if err != nil {
+		fmt.Printf("Failed building %s webhook for %s: %s\n", event, url, err)
+		return
+	}
+	delivery.Payload = string(payload)
+	if err = models.CreateWebhookDelivery(&delivery); err != nil {
+		fmt.Printf("Failed queueing %s webhook for %s: %s\n", event, url, err)
+	}
+}
+
+// Deliveries in flight per URL, so one slow receiver can only ever hold half the workers
+type webhookInFlight struct {
+	mu   sync.Mutex
+	urls map[string]int
+}
+
+func (inFlight *webhookInFlight) start(url string) bool {
+	inFlight.mu.Lock()
+	defer inFlight.mu.Unlock()
+	if inFlight.urls[url] >= max(1, webhookConfig.Workers/2) {
+		return false
+	}
+	inFlight.urls[url]++
+	return true
+}
+
+func (inFlight *webhookInFlight) done(url string) {
+	inFlight.mu.Lock()
+	defer inFlight.mu.Unlock()
+	if inFlight.urls[url]--; inFlight.urls[url] <= 0 {
+		delete(inFlight.urls, url)
+	}
+}
+
+// RunWebhookDispatcher loops forever handing whatever deliveries are due to the workers. Run it
+// in a goroutine
+func RunWebhookDispatcher() {
+	inFlight, queue := startWebhookWorkers()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		// Keep going while there's a full batch to hand out, the rest waits for the next tick
+		for dispatchWebhooks(inFlight, queue) == webhookBatchSize {
+		}
+	}
+}
+
+// The worker pool, each one sends what it's handed until the queue is closed
+func startWebhookWorkers() (*webhookInFlight, chan<- models.WebhookDelivery) {
+	inFlight := &webhookInFlight{urls: map[string]int{}}
+	queue := make(chan models.WebhookDelivery)
+	for range webhookConfig.Workers {
+		go func() {
+			for delivery := range queue {
+				deliverWebhook(&delivery)
+				inFlight.done(delivery.URL)
+			}
+		}()
+	}
+	return inFlight, queue
+}
+
+// Lease the due deliveries and queue them up for the workers, skipping the ones whose URL already
+// has its share in flight. Returns how many were handed out
+func dispatchWebhooks(inFlight *webhookInFlight, queue chan<- models.WebhookDelivery) int {
+	nowMs := time.Now().UnixMilli()
+	deliveries, err := models.GetDueWebhookDeliveries(nowMs, webhookBatchSize)
+	if err != nil {
+		fmt.Printf("Failed loading due webhook deliveries: %s\n", err)
+		return 0
+	}
+	// Long enough to wait for a worker (each one is done within a timeout) and then send
+	leaseMs := time.Now().Add(3 * time.Duration(webhookConfig.Timeout) * time.Second).UnixMilli()
+	handedOut := 0
+	for _, delivery := range deliveries {
+		if !inFlight.start(delivery.URL) {
+			continue
+		}
+		leased, err := models.LeaseWebhookDelivery(delivery.ID, nowMs, leaseMs)
+		if err != nil {
+			fmt.Printf("Failed leasing webhook delivery %s: %s\n", delivery.ID, err)
+		}
+		if !leased {
+			inFlight.done(delivery.URL)
+			continue
+		}
+		queue <- delivery
+		handedOut++
+	}
+	return handedOut
+}
+
+// Sign the body the same way receivers are expected to check it
+func SignWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Exponential backoff with full jitter, capped at the configured max
+func webhookBackoff(attempts int) time.Duration {
+	backoff := time.Duration(webhookConfig.InitialBackoff) * time.Second
+	maxBackoff := time.Duration(webhookConfig.MaxBackoff) * time.Second
+	for i := 1; i < attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+// Secret for the delivery, registered webhooks have their own, callback_urls use the config one
+func webhookSecret(delivery *models.WebhookDelivery) (string, error) {
+	if delivery.WebhookID == nil {
+		return webhookConfig.Secret, nil
+	}
+	webhook, err := models.GetWebhook(*delivery.WebhookID)
+	if err != nil {
+		return "", fmt.Errorf("webhook %s is gone: %s", delivery.WebhookID, err)
+	}
+	return webhook.Secret, nil
+}
+
+func deliverWebhook(delivery *models.WebhookDelivery) {
+	delivery.Attempts++
+	delivery.LastStatusCode = 0
+	err := postWebhook(delivery)
+	switch {
+	case err == nil:
+		delivery.Status = models.WebhookDeliveryStatus_DELIVERED
+		delivery.LastError = ""
+	case delivery.Attempts >= webhookConfig.MaxAttempts:
+		fmt.Printf("Webhook delivery %s to %s is dead after %d attempts: %s\n", delivery.ID, delivery.URL, delivery.Attempts, err)
+		delivery.Status = models.WebhookDeliveryStatus_DEAD
+		delivery.LastError = err.Error()
+	default:
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = time.Now().Add(webhookBackoff(delivery.Attempts)).UnixMilli()
+	}
+	if err = models.SaveWebhookAttempt(delivery); err != nil {
+		fmt.Printf("Failed saving webhook delivery %s: %s\n", delivery.ID, err)
+	}
+}
+
+func postWebhook(delivery *models.WebhookDelivery) error {
+	secret, err := webhookSecret(delivery)
+	if err != nil {
+		return err
+	}
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-MicroSMS-Event", delivery.Event)
+	req.Header.Set("X-MicroSMS-Delivery", delivery.ID.String())
+	if secret != "" {
+		req.Header.Set("X-MicroSMS-Signature", SignWebhookPayload(secret, time.Now().Unix(), body))
+	}
+	client := webhookClient
+	if delivery.WebhookID == nil {
+		client = callbackClient // a callback_url came from /create, registered webhooks come from an admin
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096)) // drain so the connection gets reused
+	delivery.LastStatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned non-2xx status: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package helpers
+
+import (
+	"errors"
+	"microsms/config"
+	"microsms/constants"
+	"microsms/models"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A fresh SQLite database for the length of the test
+func openTestDB(t *testing.T) {
+	t.Helper()
+	db, err := models.InitDB(config.DatabaseConfig{Driver: models.DBDriver_SQLITE, Path: filepath.Join(t.TempDir(), "helpers.db"), WAL: true})
+	if err != nil {
+		t.Fatalf("opening test database: %s", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+		models.DB = nil
+	})
+}
+
+// Opted in both ways so requests between them go straight to ready_to_send
+func optInPair(t *testing.T, numbers ...string) {
+	t.Helper()
+	for _, number := range numbers {
+		formatted, err := constants.GetPhone(number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = models.FindOrCreateOptIn(formatted); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = models.UpdateOptInFromAskTo(formatted, constants.OptInStatus_TRUE); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// The worker gets the code, the taken event stored for the callback_url doesn't
+func TestTakenWebhookLeavesOTPOut(t *testing.T) {
+	openTestDB(t)
+	optInPair(t, "555-555-0100", "555-555-0101")
+	SetWebhookGlobals(config.WebhookConfig{})
+	models.SetStatusChangeHandler(EnqueueWebhookEvent)
+	models.SetFilterEnabled(false)
+	t.Cleanup(func() {
+		models.SetStatusChangeHandler(nil)
+		models.SetFilterEnabled(true)
+	})
+
+	smsrequest := &models.SMSRequest{
+		FromNumber:  "555-555-0100",
+		ToNumber:    "555-555-0101",
+		Message:     "your code is 424242",
+		Priority:    constants.RequestPriority_OTP,
+		CallbackURL: "https://example.com/hook",
+	}
+	if err := models.CreateSMSRequest(smsrequest); err != nil {
+		t.Fatal(err)
+	}
+	claimed, err := models.ClaimSMSRequest("worker-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed.ID != smsrequest.ID || claimed.Message != smsrequest.Message {
+		t.Fatalf("worker got %s with message %q", claimed.ID, claimed.Message)
+	}
+	deliveries, err := models.ListWebhookDeliveries("", models.MaxListLimit, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	taken := 0
+	for _, delivery := range deliveries {
+		if strings.Contains(delivery.Payload, "424242") {
+			t.Errorf("%s delivery payload has the code: %s", delivery.Event, delivery.Payload)
+		}
+		if delivery.Event == string(constants.RequestStatus_TAKEN) {
+			taken++
+		}
+	}
+	if taken != 1 {
+		t.Errorf("stored %d taken deliveries, expected 1", taken)
+	}
+}
+
+// Payloads for otp requests lose the code on the way into the delivery log, everything else is left be
+func TestScrubbedOTPPayloads(t *testing.T) {
+	openTestDB(t)
+	tests := []struct {
+		name     string
+		payload  string
+		scrubbed bool
+	}{
+		{"otp", `{"event":"taken","smsrequest":{"priority":"otp","message":"code 424242","variables":{"code":"424242"}}}`, true},
+		{"standard", `{"event":"taken","smsrequest":{"priority":"standard","message":"code 424242"}}`, false},
+		{"inbound only", `{"event":"inbound","inbound":{"message":"424242"}}`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delivery := models.WebhookDelivery{URL: "https://example.com/hook", Event: "taken", Payload: test.payload}
+			if err := models.CreateWebhookDelivery(&delivery); err != nil {
+				t.Fatal(err)
+			}
+			if test.scrubbed && strings.Contains(delivery.Payload, "424242") {
+				t.Errorf("payload stored with the code in it: %s", delivery.Payload)
+			}
+			if !test.scrubbed && delivery.Payload != test.payload {
+				t.Errorf("payload changed to %s", delivery.Payload)
+			}
+		})
+	}
+}
+
+// callback_url comes from /create, it only gets to name public hosts (on the list when there is one)
+func TestCallbackURLs(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  config.WebhookConfig
+		url     string
+		allowed bool
+	}{
+		{"public host", config.WebhookConfig{}, "https://hooks.example.com/sms", true},
+		{"public address", config.WebhookConfig{}, "http://93.184.216.34/hook", true},
+		{"loopback", config.WebhookConfig{}, "http://127.0.0.1:8080/hook", false},
+		{"loopback v6", config.WebhookConfig{}, "http://[::1]/hook", false},
+		{"localhost", config.WebhookConfig{}, "http://localhost/hook", false},
+		{"private", config.WebhookConfig{}, "http://10.1.2.3/hook", false},
+		{"cloud metadata", config.WebhookConfig{}, "http://169.254.169.254/latest/meta-data", false},
+		{"shared address space", config.WebhookConfig{}, "http://100.64.0.1/hook", false},
+		{"unspecified", config.WebhookConfig{}, "http://0.0.0.0/hook", false},
+		{"not http", config.WebhookConfig{}, "ftp://hooks.example.com/sms", false},
+		{"listed host", config.WebhookConfig{CallbackHosts: []string{"example.com"}}, "https://hooks.example.com/sms", true},
+		{"unlisted host", config.WebhookConfig{CallbackHosts: []string{"example.com"}}, "https://example.net/sms", false},
+		{"private allowed", config.WebhookConfig{AllowPrivateCallbacks: true}, "http://127.0.0.1:8080/hook", true},
+	}
+	t.Cleanup(func() { models.SetCallbackPolicy(config.WebhookConfig{}) })
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			models.SetCallbackPolicy(test.policy)
+			err := models.ValidateCallbackURL(test.url)
+			if test.allowed && err != nil {
+				t.Errorf("%s refused: %s", test.url, err)
+			}
+			if !test.allowed && err == nil {
+				t.Errorf("%s allowed", test.url)
+			}
+		})
+	}
+}
+
+// Whatever the URL looked like on create, a callback delivery never connects to an internal
+// address. A registered webhook (admin configured) can
+func TestCallbackDeliveryRefusesInternalAddress(t *testing.T) {
+	openTestDB(t)
+	models.SetCallbackPolicy(config.WebhookConfig{})
+	SetWebhookGlobals(config.WebhookConfig{MaxAttempts: 1})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(receiver.Close)
+
+	callback := models.WebhookDelivery{URL: receiver.URL, Event: "sent", Payload: "{}"}
+	if err := postWebhook(&callback); !errors.Is(err, models.ErrCallbackURLNotAllowed) {
+		t.Errorf("callback delivery to %s got %v", receiver.URL, err)
+	}
+	webhook, err := models.CreateWebhook(receiver.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered := models.WebhookDelivery{WebhookID: &webhook.ID, URL: receiver.URL, Event: "sent", Payload: "{}"}
+	if err = postWebhook(&registered); err != nil {
+		t.Errorf("registered webhook delivery failed: %s", err)
+	}
+}
+
+// A receiver that hangs only holds its share of the workers, everything else still goes out
+func TestSlowReceiverDoesNotHoldTheQueue(t *testing.T) {
+	openTestDB(t)
+	SetWebhookGlobals(config.WebhookConfig{Workers: 4, Timeout: 30})
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+	}))
+	t.Cleanup(receiver.Close)
+	webhook, err := models.CreateWebhook(receiver.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queueDelivery := func(path string) uuid.UUID {
+		delivery := models.WebhookDelivery{WebhookID: &webhook.ID, URL: receiver.URL + path, Event: "sent", Payload: "{}"}
+		if err := models.CreateWebhookDelivery(&delivery); err != nil {
+			t.Fatal(err)
+		}
+		return delivery.ID
+	}
+	for range 4 {
+		queueDelivery("/slow")
+	}
+	fast := queueDelivery("/fast")
+
+	inFlight, queue := startWebhookWorkers()
+	t.Cleanup(func() {
+		// Let the slow ones finish before the database goes away
+		close(release)
+		close(queue)
+		for {
+			inFlight.mu.Lock()
+			busy := len(inFlight.urls)
+			inFlight.mu.Unlock()
+			if busy == 0 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	if handedOut := dispatchWebhooks(inFlight, queue); handedOut != 3 {
+		t.Errorf("handed out %d deliveries, expected 2 slow and the fast one", handedOut)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deliveries, err := models.ListWebhookDeliveries(models.WebhookDeliveryStatus_DELIVERED, models.MaxListLimit, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) == 1 && deliveries[0].ID == fast {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("fast delivery still waiting behind the slow ones, delivered %d", len(deliveries))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// The slow ones are leased, another pass doesn't send them twice
+	if handedOut := dispatchWebhooks(inFlight, queue); handedOut != 0 {
+		t.Errorf("second pass handed out %d deliveries", handedOut)
+	}
+}
+
+// Receivers check the header with hmac-sha256(secret, "<t>.<body>"), these were worked out with
+// another implementation
+func TestSignWebhookPayload(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		body   string
+		want   string
+	}{
+		{"event", "whsec_test", `{"event":"sent"}`, "t=1700000000,v1=8ddaf12c4e68e0e2bd7c2590b31fd17f24a1edbdfaca95a63b4ffed5e0a16ea9"},
+		{"empty secret", "", `{}`, "t=1700000000,v1=a9dc44c8eda3de70e9cbf3e488895f1abc26acb1461d3124a3cb886af35251cf"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := SignWebhookPayload(test.secret, 1700000000, []byte(test.body)); got != test.want {
+				t.Errorf("got %s, expected %s", got, test.want)
+			}
+		})
+	}
+	if SignWebhookPayload("a", 1700000000, []byte("{}")) == SignWebhookPayload("b", 1700000000, []byte("{}")) {
+		t.Error("different secrets signed the same")
+	}
+}
+
+// Doubles per attempt up to the cap, jittered between half and all of it
+func TestWebhookBackoff(t *testing.T) {
+	SetWebhookGlobals(config.WebhookConfig{InitialBackoff: 5, MaxBackoff: 60})
+	tests := []struct {
+		attempts int
+		ceiling  time.Duration
+	}{
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{4, 40 * time.Second},
+		{5, 60 * time.Second},
+		{20, 60 * time.Second},
+	}
+	for _, test := range tests {
+		for range 20 {
+			if backoff := webhookBackoff(test.attempts); backoff < test.ceiling/2 || backoff > test.ceiling {
+				t.Errorf("attempt %d backed off %s, expected %s-%s", test.attempts, backoff, test.ceiling/2, test.ceiling)
+			}
+		}
+	}
+}
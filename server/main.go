@@ -7,8 +7,10 @@ import (
 	"microsms/models"
 	"microsms/routes"
 	"net/http"
+	"os"
 	"sync"
 	"time"
+	_ "time/tzdata" // quiet hours need zone data even on images without it
 
 	"github.com/gin-gonic/gin"
 )
@@ -26,10 +28,19 @@ func main() {
 	fmt.Printf("Config loaded! Contents\n")
 	cfg.Print()
 
-	db, err := models.InitDB(cfg.Database.Path)
-	fmt.Println("DB Initialized correctly:", db)
+	// microsms <command> runs that instead of the server, see commands.go
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(cfg, os.Args[1], os.Args[2:]))
+	}
+
+	// Applies any pending migrations first, a schema newer than this build stops us here
+	db, err := models.InitDB(cfg.Database)
 	if err != nil {
-		panic("FAILED TO START DB")
+		panic(fmt.Sprintf("FAILED TO START DB %s", err))
+	}
+	fmt.Println("DB Initialized correctly:", db)
+	if err = models.InitSearch(); err != nil {
+		panic("FAILED TO SET UP SEARCH")
 	}
 
 	// Initialize channel for filter results
@@ -49,13 +60,58 @@ func main() {
 	}
 
 	// Init helpers
-	helpers.SetFilterGlobals(&filterWG, filterResultChan, filterAPIChan, cfg.Filter.APIURL)
+	helpers.SetFilterGlobals(&filterWG, filterResultChan, filterAPIChan)
+	if err = helpers.SetFilterChain(cfg.Filter); err != nil {
+		panic(fmt.Sprintf("FAILED TO SET UP FILTERS %s", err))
+	}
+	helpers.SetFilterCacheGlobals(cfg.Filter.Cache)
+	helpers.SetHeuristicsGlobals(cfg.Filter.Heuristics)
+	if err = helpers.SetReviewGlobals(cfg.Filter.Review); err != nil {
+		panic(fmt.Sprintf("FAILED TO SET UP FILTER REVIEW %s", err))
+	}
+	models.SetFilterEnabled(cfg.Filter.Enabled)
+	if err = models.SetCategoryPolicy(cfg.Filter.Categories, cfg.Filter.Overridable, cfg.Auth.Clients); err != nil {
+		panic(fmt.Sprintf("FAILED TO SET UP FILTER CATEGORIES %s", err))
+	}
 
 	// Pass waitgroup to routes for goroutine spawning
 	routes.SetFilterWaitGroup(&filterWG)
+	routes.SetAdminKeys(cfg.Auth.AdminKeys)
+	routes.SetAPIClients(cfg.Auth.Clients)
+	routes.SetVerifyGlobals(cfg.Verify)
+	models.SetMessageLimits(cfg.SMS)
+	if err = models.SetLinkPolicy(cfg.Links); err != nil {
+		panic(fmt.Sprintf("FAILED TO SET UP LINKS %s", err))
+	}
+
+	// Pacing lives on the server, workers only get what quiet hours and the throttle let through
+	helpers.SetThrottleGlobals(cfg.Throttle)
+	if err = helpers.SetQuietHoursGlobals(cfg.QuietHours); err != nil {
+		panic(fmt.Sprintf("FAILED TO SET UP QUIET HOURS %s", err))
+	}
+	if err = models.SetFrequencyCaps(cfg.Frequency); err != nil {
+		panic(fmt.Sprintf("FAILED TO SET UP FREQUENCY CAPS %s", err))
+	}
+	models.SetClaimCheck(helpers.ClaimCheck, helpers.UnthrottleSMSRequest)
 
 	// Start goroutine to handle filter results
 	go helpers.HandleFilterResults()
+	// Filter checks held while a filter API was down get retried from here
+	go helpers.RunFilterRequeue()
+	// Templates made while filtering was off get screened now there's a filter
+	helpers.ScreenPendingTemplates()
+
+	// Status changes feed the webhook queue, the dispatcher works through it in the background
+	helpers.SetWebhookGlobals(cfg.Webhooks)
+	models.SetCallbackPolicy(cfg.Webhooks)
+	models.SetStatusChangeHandler(helpers.EnqueueWebhookEvent)
+	go helpers.RunWebhookDispatcher()
+
+	// Finished requests get redacted/deleted as the retention rules say, off unless enabled
+	if err = helpers.SetRetentionGlobals(cfg.Retention); err != nil {
+		panic(fmt.Sprintf("FAILED TO SET UP RETENTION %s", err))
+	}
+	go helpers.RunRetentionSweeper()
 
 	server = gin.Default()
 	// converts into a single slash (/) when trying to match a route.
@@ -77,10 +133,13 @@ func main() {
 
 func GetHealth(c *gin.Context) {
 	uptime := time.Since(startTime)
-	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("API Healthy for %s", uptime)})
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("API Healthy for %s", uptime), "filter": helpers.GetFilterStatus()})
 }
 
 func setupRoutes() {
+	// Rewritten links land here straight from a phone so they stay short, no /api/v0
+	server.GET("/l/:code", routes.FollowLink)
+
 	apiGroup := server.Group("/api/v0")
 	{
 		apiGroup.POST("/create", routes.CreateSMSRequest)
@@ -88,9 +147,39 @@ func setupRoutes() {
 		apiGroup.GET("/smsrequest", routes.GetSMSRequest)
 		apiGroup.GET("/ready", routes.GetReadyToSendSMS)
 		apiGroup.PATCH("/smsrequest", routes.UpdateSMSRequest)
+		apiGroup.DELETE("/smsrequest", routes.CancelSMSRequest)
+		apiGroup.POST("/smsrequest/delivery", routes.ReportSMSDelivery)
 		apiGroup.GET("/optin", routes.GetReadyToAskOptIn)
 		apiGroup.POST("/optin", routes.GetPhoneOptIn)
 		apiGroup.PATCH("/optin", routes.UpdatePhoneOptIn)
+		apiGroup.POST("/inbound", routes.CreateInboundMessage)
+		apiGroup.POST("/verify/start", routes.StartVerification)
+		apiGroup.POST("/verify/check", routes.CheckVerification)
+		apiGroup.GET("/templates", routes.ListTemplates)
+	}
+
+	// Anything that can read across everyone's messages needs an admin key
+	adminGroup := server.Group("/api/v0", routes.RequireAdminKey())
+	{
+		adminGroup.GET("/smsrequests", routes.ListSMSRequests)
+		adminGroup.GET("/search", routes.SearchMessages)
+		adminGroup.GET("/conversation", routes.GetConversation)
+		adminGroup.POST("/webhooks", routes.CreateWebhook)
+		adminGroup.GET("/webhooks", routes.ListWebhooks)
+		adminGroup.DELETE("/webhooks", routes.DeleteWebhook)
+		adminGroup.GET("/webhooks/deliveries", routes.ListWebhookDeliveries)
+		adminGroup.POST("/webhooks/deliveries/retry", routes.RetryWebhookDelivery)
+		adminGroup.PATCH("/optin/timezone", routes.UpdateOptInTimezone)
+		adminGroup.GET("/usage", routes.GetRecipientUsage)
+		adminGroup.POST("/templates", routes.CreateTemplate)
+		adminGroup.DELETE("/templates", routes.DeleteTemplate)
+		adminGroup.POST("/templates/recheck", routes.RecheckTemplate)
+		adminGroup.GET("/review", routes.ListReviewQueue)
+		adminGroup.POST("/review", routes.ReviewSMSRequest)
+		adminGroup.GET("/review/decisions", routes.ListFilterReviews)
+		adminGroup.GET("/filter/cache", routes.GetFilterCacheStats)
+		adminGroup.DELETE("/filter/cache", routes.PurgeFilterCache)
+		adminGroup.GET("/retention", routes.GetRetentionPreview)
 	}
 
 }
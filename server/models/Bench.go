@@ -0,0 +1,173 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"microsms/constants"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+/**
+Sustained write load through the model layer, run with `microsms bench`. Creators keep adding
+requests while workers claim them, PATCH them sent and report them delivered, all at once and for
+a fixed time, which is the mix that used to get SQLite saying "database is locked". It wants an
+empty database and deletes what it made afterwards.
+**/
+
+var ErrDatabaseNotEmpty = errors.New("bench needs an empty database, it claims whatever is ready to send")
+
+const (
+	benchFromNumber = "555-555-0200"
+	benchRecipients = 50 // spread over a few opt ins like real traffic
+)
+
+type BenchConfig struct {
+	Duration time.Duration
+	Creators int
+	Workers  int
+}
+
+// Count, errors and latencies for one kind of operation
+type BenchOp struct {
+	Name      string
+	Count     int
+	Errors    int
+	FirstErr  error
+	latencies []time.Duration
+}
+
+func (op *BenchOp) record(start time.Time, err error) {
+	if err != nil {
+		op.Errors++
+		if op.FirstErr == nil {
+			op.FirstErr = err
+		}
+		return
+	}
+	op.Count++
+	op.latencies = append(op.latencies, time.Since(start))
+}
+
+// Latency at quantile q (0-1) of the successful calls
+func (op *BenchOp) Percentile(q float64) time.Duration {
+	if len(op.latencies) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(op.latencies)
+	slices.Sort(sorted)
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+type BenchResult struct {
+	Driver   string
+	Duration time.Duration
+	Ops      []*BenchOp // create, claim, patch sent, delivery report
+}
+
+// RunBench runs the create/claim/patch mix for cfg.Duration and reports what got through
+func RunBench(cfg BenchConfig) (*BenchResult, error) {
+	var existing int64
+	if err := DB.Model(&SMSRequest{}).Count(&existing).Error; err != nil {
+		return nil, err
+	}
+	if existing > 0 {
+		return nil, ErrDatabaseNotEmpty
+	}
+	numbers := []string{benchFromNumber}
+	for i := 0; i < benchRecipients; i++ {
+		numbers = append(numbers, fmt.Sprintf("555-556-%04d", i))
+	}
+	var formatted []string
+	defer func() { cleanUpBench(formatted) }()
+	for _, number := range numbers {
+		phone, err := constants.GetPhone(number)
+		if err != nil {
+			return nil, err
+		}
+		formatted = append(formatted, phone)
+		if _, err = FindOrCreateOptIn(phone); err != nil {
+			return nil, err
+		}
+		if _, err = UpdateOptInFromAskTo(phone, constants.OptInStatus_TRUE); err != nil {
+			return nil, err
+		}
+	}
+
+	create := &BenchOp{Name: "create"}
+	claim := &BenchOp{Name: "claim"}
+	patch := &BenchOp{Name: "patch sent"}
+	report := &BenchOp{Name: "delivery report"}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(cfg.Duration)
+
+	for c := 0; c < cfg.Creators; c++ {
+		wg.Add(1)
+		go func(creator int) {
+			defer wg.Done()
+			for i := 0; time.Now().Before(deadline); i++ {
+				smsrequest := &SMSRequest{
+					ToNumber:   numbers[1+(creator+i)%benchRecipients],
+					FromNumber: benchFromNumber,
+					Message:    fmt.Sprintf("bench %d from creator %d", i, creator),
+				}
+				opStart := time.Now()
+				err := createSMSRequest(smsrequest, constants.FilterMode_DISABLED)
+				mu.Lock()
+				create.record(opStart, err)
+				mu.Unlock()
+			}
+		}(c)
+	}
+	for w := 0; w < cfg.Workers; w++ {
+		wg.Add(1)
+		go func(worker string) {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				opStart := time.Now()
+				smsrequest, err := ClaimSMSRequest(worker)
+				if err == nil && smsrequest.ID == uuid.Nil {
+					time.Sleep(time.Millisecond) // caught up with the creators
+					continue
+				}
+				mu.Lock()
+				claim.record(opStart, err)
+				mu.Unlock()
+				if err != nil {
+					continue
+				}
+				id := smsrequest.ID.String()
+				opStart = time.Now()
+				_, err = UpdateSMSRequest(id, constants.RequestStatus_SENT, worker)
+				mu.Lock()
+				patch.record(opStart, err)
+				mu.Unlock()
+				if err != nil {
+					continue
+				}
+				opStart = time.Now()
+				_, err = RecordDeliveryReport(id, 0, 0)
+				mu.Lock()
+				report.record(opStart, err)
+				mu.Unlock()
+			}
+		}(fmt.Sprintf("bench-%d", w))
+	}
+	wg.Wait()
+	return &BenchResult{Driver: DBDriver(), Duration: time.Since(start), Ops: []*BenchOp{create, claim, patch, report}}, nil
+}
+
+// Everything the bench made hangs off its opt ins
+func cleanUpBench(numbers []string) {
+	if len(numbers) == 0 {
+		return
+	}
+	optInIDs := DB.Model(&OptIn{}).Select("id").Where("number IN ?", numbers)
+	DB.Where("to_opt_in_id IN (?) OR from_opt_in_id IN (?)", optInIDs, optInIDs).Delete(&SMSRequest{})
+	DB.Where("number IN ?", numbers).Delete(&OptIn{})
+}
@@ -0,0 +1,154 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"microsms/config"
+	"net/url"
+	"strings"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/plugin/dbresolver"
+)
+
+/**
+Which database we're talking to. SQLite is the default and only needs a file path. Postgres and
+MySQL take a DSN and are the ones to use once there's real write traffic or several workers
+claiming at once, since SQLite only ever lets one writer in at a time.
+
+SQLite gets set up so that limit never turns into "database is locked". WAL means readers and the
+writer don't block each other. All writes go through a single connection, so database/sql queues
+them in Go instead of them fighting over the file lock, and reads get a pool of their own.
+Transactions start with BEGIN IMMEDIATE so one that reads first can't be turned away when it
+goes to write, and the busy timeout covers anything outside this process holding the lock
+(a migrate run, the sqlite3 shell).
+**/
+
+var DB *gorm.DB
+
+const (
+	DBDriver_SQLITE   = "sqlite"
+	DBDriver_POSTGRES = "postgres"
+	DBDriver_MYSQL    = "mysql"
+)
+
+// Dialector for the configured driver, nothing is opened yet
+func dialectorFor(cfg config.DatabaseConfig) (gorm.Dialector, error) {
+	switch cfg.Driver {
+	case "", DBDriver_SQLITE:
+		if cfg.Path == "" {
+			return nil, errors.New("database.path is required for sqlite")
+		}
+		return sqlite.Open(sqliteDSN(cfg, false)), nil
+	case DBDriver_POSTGRES:
+		if cfg.DSN == "" {
+			return nil, errors.New("database.dsn is required for postgres")
+		}
+		return postgres.Open(cfg.DSN), nil
+	case DBDriver_MYSQL:
+		if cfg.DSN == "" {
+			return nil, errors.New("database.dsn is required for mysql")
+		}
+		return mysql.Open(cfg.DSN), nil
+	}
+	return nil, fmt.Errorf("unknown database driver %s", cfg.Driver)
+}
+
+// Connect to the configured database. Setting up the schema is up to the caller
+func openDB(cfg config.DatabaseConfig) (*gorm.DB, error) {
+	dialector, err := dialectorFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("Error opening %s database: %s", dialector.Name(), err)
+	}
+	if dialector.Name() == DBDriver_SQLITE {
+		if err = splitSQLiteWrites(db, cfg); err != nil {
+			return nil, fmt.Errorf("Error setting up sqlite connections: %s", err)
+		}
+	}
+	return db, nil
+}
+
+// In memory databases are per connection, there's nothing to share between a writer and readers
+func sqliteInMemory(path string) bool {
+	return path == ":memory:" || strings.Contains(path, "mode=memory")
+}
+
+// The SQLite path with our pragmas added to whatever options it already had. Readers are
+// query only so nothing can sneak a write past the single writer
+func sqliteDSN(cfg config.DatabaseConfig, reader bool) string {
+	if cfg.BusyTimeout <= 0 {
+		cfg.BusyTimeout = 5000
+	}
+	params := url.Values{}
+	params.Set("_busy_timeout", fmt.Sprint(cfg.BusyTimeout))
+	if cfg.WAL && !sqliteInMemory(cfg.Path) {
+		params.Set("_journal_mode", "WAL")
+		params.Set("_synchronous", "NORMAL") // safe with WAL, a power cut can only lose the last commits
+	}
+	if reader {
+		params.Set("_query_only", "1")
+	} else {
+		params.Set("_txlock", "immediate")
+	}
+	separator := "?"
+	if strings.Contains(cfg.Path, "?") {
+		separator = "&"
+	}
+	return cfg.Path + separator + params.Encode()
+}
+
+// One connection for every write and transaction, reads go to a pool of query only connections
+// on the same file
+func splitSQLiteWrites(db *gorm.DB, cfg config.DatabaseConfig) error {
+	writer, err := db.DB()
+	if err != nil {
+		return err
+	}
+	writer.SetMaxOpenConns(1)
+	if sqliteInMemory(cfg.Path) {
+		return nil // the one connection does everything
+	}
+	if cfg.Readers <= 0 {
+		cfg.Readers = 4
+	}
+	readers := dbresolver.Register(dbresolver.Config{Replicas: []gorm.Dialector{sqlite.Open(sqliteDSN(cfg, true))}}).
+		SetMaxOpenConns(cfg.Readers)
+	return db.Use(readers)
+}
+
+// DBDriver is the driver DB is running on
+func DBDriver() string {
+	if DB == nil {
+		return ""
+	}
+	return DB.Dialector.Name()
+}
+
+// Lock the rows a claim reads so two workers polling at the same moment get different rows
+// instead of queueing up behind each other. SQLite has no row locks (a write locks the whole
+// file) so there it's left to the conditional UPDATE
+func skipLocked(tx *gorm.DB) *gorm.DB {
+	switch tx.Dialector.Name() {
+	case DBDriver_POSTGRES, DBDriver_MYSQL:
+		return tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate, Options: clause.LockingOptionsSkipLocked})
+	}
+	return tx
+}
+
+// Run fn in a transaction so whatever it read through skipLocked stays locked until it's done.
+// On SQLite fn runs straight on DB instead, there are no row locks to hold and a transaction
+// would keep the one writer busy while the claim check runs. The conditional UPDATEs keep it safe
+func lockingTransaction(fn func(tx *gorm.DB) error) error {
+	if DBDriver() == DBDriver_SQLITE {
+		return fn(DB)
+	}
+	return DB.Transaction(fn)
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+/**
+Filter verdicts cached by content hash so the same alert going out a thousand times only goes
+through the filter once. The hash (built in helpers) covers the normalized message, the category
+policy and the filter chain, so changing any of those means a fresh check.
+**/
+
+type FilterCacheEntry struct {
+	Hash      string        `json:"hash" gorm:"primaryKey"` // hex sha256, see helpers.filterCacheHash
+	Verdict   FilterVerdict `json:"verdict" gorm:"embedded;embeddedPrefix:verdict_"`
+	Hits      int64         `json:"hits"`
+	Created   int64         `json:"created" gorm:"autoCreateTime"`
+	ExpiresAt int64         `json:"expires_at" gorm:"index"` // unix seconds
+}
+
+// Cached verdict for the hash if there is one that hasn't expired, counts the hit
+func GetFilterCacheEntry(hash string, now int64) (*FilterCacheEntry, error) {
+	var entry FilterCacheEntry
+	result := DB.Where("hash = ? AND expires_at > ?", hash, now).Limit(1).Find(&entry)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	DB.Model(&FilterCacheEntry{}).Where("hash = ?", hash).UpdateColumn("hits", gorm.Expr("hits + 1"))
+	return &entry, nil
+}
+
+// Store (or replace an expired) verdict for the hash
+func SaveFilterCacheEntry(hash string, verdict FilterVerdict, expiresAt int64) error {
+	entry := FilterCacheEntry{Hash: hash, Verdict: verdict, ExpiresAt: expiresAt}
+	err := DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(&entry).Error
+	if err != nil {
+		return fmt.Errorf("Error caching filter verdict %s: %s", hash, err)
+	}
+	return nil
+}
+
+// Drop cached verdicts, just the expired ones or everything. Returns how many went
+func PurgeFilterCache(expiredOnly bool, now int64) (int64, error) {
+	query := DB.Session(&gorm.Session{AllowGlobalUpdate: true})
+	if expiredOnly {
+		query = query.Where("expires_at <= ?", now)
+	}
+	result := query.Delete(&FilterCacheEntry{})
+	return result.RowsAffected, result.Error
+}
+
+// Entry counts for the stats endpoint
+func CountFilterCacheEntries(now int64) (int64, int64, error) {
+	var total, expired int64
+	if err := DB.Model(&FilterCacheEntry{}).Count(&total).Error; err != nil {
+		return 0, 0, err
+	}
+	if err := DB.Model(&FilterCacheEntry{}).Where("expires_at <= ?", now).Count(&expired).Error; err != nil {
+		return 0, 0, err
+	}
+	return total, expired, nil
+}
@@ -0,0 +1,114 @@
+package models
+
+import (
+	"fmt"
+	"maps"
+	"microsms/config"
+	"microsms/constants"
+	"slices"
+)
+
+// What the content filter made of a message, kept on the request (filter_ columns) so a sender
+// can be told why it was blocked and false positives can be audited
+type FilterVerdict struct {
+	Blocked            bool     `json:"blocked"`
+	Allowed            bool     `json:"allowed"` // allow-list hit, nothing after it ran
+	Reason             string   `json:"reason"`
+	IncludedCategories []string `json:"included_categories" gorm:"serializer:json"`
+	ExcludedCategories []string `json:"excluded_categories" gorm:"serializer:json"`
+	Backend            string   `json:"backend"` // which filter in the chain decided
+	Model              string   `json:"model,omitempty"`
+	Error              string   `json:"error,omitempty"` // set when the check failed
+	LatencyMs          int64    `json:"latency_ms"`
+	CheckedAt          int64    `json:"checked_at_ms"`
+	Cached             bool     `json:"cached,omitempty"` // came out of the verdict cache, nothing was called
+	// Local heuristics, scored per request before any filter is asked
+	Score   int      `json:"score,omitempty"`
+	Flags   []string `json:"flags,omitempty" gorm:"serializer:json"` // which heuristics fired
+	Flagged bool     `json:"flagged,omitempty"`                      // scored high enough that a human should look first
+}
+
+// Embedded columns, listed so zero values (blocked false etc) still get written
+var filterVerdictColumns = []string{
+	"filter_blocked", "filter_allowed", "filter_reason", "filter_included_categories", "filter_excluded_categories",
+	"filter_backend", "filter_model", "filter_error", "filter_latency_ms", "filter_checked_at", "filter_cached",
+	"filter_score", "filter_flags", "filter_flagged",
+}
+
+// Store the verdict on a request, only while it's still waiting on the filter
+func SaveFilterVerdict(id string, verdict FilterVerdict) error {
+	result := DB.Model(&SMSRequest{}).Where("id = ? AND status = ?", id, constants.RequestStatus_FILTER_CHECK).
+		Select(filterVerdictColumns).Updates(&SMSRequest{Filter: verdict})
+	if result.Error != nil {
+		return fmt.Errorf("Error saving filter verdict for %s: %s", id, result.Error)
+	}
+	return nil
+}
+
+var defaultFilterCategories map[string]bool
+var overridableFilterCategories []string
+var clientFilterCategories map[string]map[string]bool
+
+// SetCategoryPolicy sets the SMSFilter category defaults, what a request may flip and each
+// client's own policy, from main. Unknown category names are an error
+func SetCategoryPolicy(defaults map[string]bool, overridable []string, clients []config.APIClient) error {
+	for category := range defaults {
+		if !constants.IsValidFilterCategory(category) {
+			return fmt.Errorf("unknown filter category %s", category)
+		}
+	}
+	for _, category := range overridable {
+		if !constants.IsValidFilterCategory(category) {
+			return fmt.Errorf("unknown overridable filter category %s", category)
+		}
+	}
+	clientCategories := map[string]map[string]bool{}
+	for _, client := range clients {
+		for category := range client.Categories {
+			if !constants.IsValidFilterCategory(category) {
+				return fmt.Errorf("unknown filter category %s for client %s", category, client.Name)
+			}
+		}
+		clientCategories[client.Name] = client.Categories
+	}
+	defaultFilterCategories = defaults
+	overridableFilterCategories = overridable
+	clientFilterCategories = clientCategories
+	return nil
+}
+
+// The server wide defaults, what templates get screened with
+func DefaultFilterCategories() map[string]bool {
+	return maps.Clone(defaultFilterCategories)
+}
+
+// Work out the categories a request gets screened with: the defaults, then its client's policy,
+// then whatever the request asked for as long as the category is one requests may flip
+func resolveFilterCategories(smsrequest *SMSRequest) error {
+	requested := smsrequest.FilterCategories
+	smsrequest.FilterCategories = nil
+	if smsrequest.FilterMode != constants.FilterMode_FILTER {
+		if len(requested) > 0 {
+			return fmt.Errorf("Error filter_categories only apply to messages that go through the filter (%s)", smsrequest.FilterMode)
+		}
+		return nil
+	}
+	categories := DefaultFilterCategories()
+	if categories == nil {
+		categories = map[string]bool{}
+	}
+	maps.Copy(categories, clientFilterCategories[smsrequest.Client])
+	for category, enabled := range requested {
+		if !constants.IsValidFilterCategory(category) {
+			return fmt.Errorf("Error unknown filter category %s", category)
+		}
+		if !slices.Contains(overridableFilterCategories, category) {
+			return fmt.Errorf("Error filter category %s can't be changed per request", category)
+		}
+		categories[category] = enabled
+	}
+	if len(categories) > 0 {
+		smsrequest.FilterCategories = categories
+	}
+	return nil
+}
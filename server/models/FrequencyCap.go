@@ -0,0 +1,233 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"microsms/config"
+	"microsms/constants"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+/**
+Per recipient frequency caps over rolling windows, counted straight from sms_requests so they
+hold across restarts. Under the reject policy a create over the cap fails with
+ErrFrequencyCapExceeded, under defer it's queued and the claim check holds it back until the
+oldest send in the window ages out.
+**/
+
+const (
+	FrequencyCapPolicy_REJECT = "reject"
+	FrequencyCapPolicy_DEFER  = "defer"
+)
+
+var ErrFrequencyCapExceeded = errors.New("recipient frequency cap exceeded")
+
+type frequencyCap struct {
+	limit  int
+	window time.Duration
+}
+
+var frequencyCaps []frequencyCap
+var frequencyCapPolicy = FrequencyCapPolicy_REJECT
+var frequencyCapBypass []string
+
+// Statuses that never went (or never will go) out, they don't count against a cap
+var uncountedStatuses = []constants.RequestStatus{
+	constants.RequestStatus_ERROR,
+	constants.RequestStatus_BLOCKED,
+	constants.RequestStatus_CANCELLED,
+	constants.RequestStatus_EXPIRED,
+}
+
+// SetFrequencyCaps parses the caps from the config, each one is "<limit>/<window>" like "5/1h"
+func SetFrequencyCaps(cfg config.FrequencyCapConfig) error {
+	var caps []frequencyCap
+	for _, raw := range cfg.Caps {
+		limit, window, found := strings.Cut(strings.TrimSpace(raw), "/")
+		if !found {
+			return fmt.Errorf("invalid frequency cap %s, expected <limit>/<window>", raw)
+		}
+		var frequency frequencyCap
+		var err error
+		if frequency.limit, err = strconv.Atoi(limit); err != nil || frequency.limit <= 0 {
+			return fmt.Errorf("invalid frequency cap limit %s", raw)
+		}
+		if frequency.window, err = time.ParseDuration(window); err != nil || frequency.window <= 0 {
+			return fmt.Errorf("invalid frequency cap window %s", raw)
+		}
+		caps = append(caps, frequency)
+	}
+	switch cfg.Policy {
+	case "":
+		cfg.Policy = FrequencyCapPolicy_REJECT
+	case FrequencyCapPolicy_REJECT, FrequencyCapPolicy_DEFER:
+	default:
+		return fmt.Errorf("invalid frequency cap policy %s", cfg.Policy)
+	}
+	if cfg.Bypass == nil {
+		cfg.Bypass = []string{string(constants.RequestPriority_OTP)}
+	}
+	frequencyCaps = caps
+	frequencyCapPolicy = cfg.Policy
+	frequencyCapBypass = cfg.Bypass
+	return nil
+}
+
+func frequencyCapApplies(smsrequest *SMSRequest) bool {
+	return len(frequencyCaps) > 0 && !slices.Contains(frequencyCapBypass, string(smsrequest.Priority))
+}
+
+// Requests to the recipient created inside the window that are still going (or went) out
+func countQueued(db *gorm.DB, toOptInID uuid.UUID, since int64) (int64, error) {
+	var count int64
+	err := db.Model(&SMSRequest{}).Where("to_opt_in_id = ? AND created >= ? AND status NOT IN ?", toOptInID, since, uncountedStatuses).Count(&count).Error
+	return count, err
+}
+
+// When each text to the recipient went out inside the window (unix seconds), oldest first. That's
+// sent_at, a request a worker has taken but not reported on yet counts from when it was taken
+func sentTimes(toOptInID uuid.UUID, since int64) ([]int64, error) {
+	var sends []struct {
+		SentAt  int64
+		TakenAt int64
+	}
+	err := DB.Model(&SMSRequest{}).Select("sent_at", "taken_at").
+		Where("to_opt_in_id = ? AND status IN ?", toOptInID, outboundStatuses).
+		Where("sent_at >= ? OR (COALESCE(sent_at, 0) = 0 AND taken_at >= ?)", since*1000, since).
+		Scan(&sends).Error
+	if err != nil {
+		return nil, err
+	}
+	times := make([]int64, len(sends))
+	for i, send := range sends {
+		times[i] = send.TakenAt
+		if send.SentAt > 0 {
+			times[i] = send.SentAt / 1000
+		}
+	}
+	slices.Sort(times)
+	return times, nil
+}
+
+// Create under the reject policy: count and insert in one transaction holding the recipient's opt
+// in row, so two creates racing for the last slot can't both get it. SQLite has no row locks but
+// its one writer connection already keeps the transactions apart
+func createWithFrequencyCap(smsrequest *SMSRequest) error {
+	if frequencyCapPolicy != FrequencyCapPolicy_REJECT || !frequencyCapApplies(smsrequest) {
+		return DB.Create(smsrequest).Error
+	}
+	number, err := constants.GetPhone(smsrequest.ToNumber)
+	if err != nil {
+		return err
+	}
+	return DB.Transaction(func(tx *gorm.DB) error {
+		optin, err := findOrCreateOptIn(tx, number)
+		if err != nil {
+			return err
+		}
+		if err = checkFrequencyCaps(tx, optin.ID, number); err != nil {
+			return err
+		}
+		return tx.Create(smsrequest).Error
+	})
+}
+
+// Lock the recipient's opt in and count what's queued for them against every cap, the caller
+// adds its request in the same transaction
+func checkFrequencyCaps(tx *gorm.DB, toOptInID uuid.UUID, number string) error {
+	if tx.Dialector.Name() != DBDriver_SQLITE {
+		if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).First(&OptIn{}, "id = ?", toOptInID).Error; err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	for _, frequency := range frequencyCaps {
+		count, err := countQueued(tx, toOptInID, now.Add(-frequency.window).Unix())
+		if err != nil {
+			return err
+		}
+		if count >= int64(frequency.limit) {
+			return fmt.Errorf("%w (%d per %s to %s)", ErrFrequencyCapExceeded, frequency.limit, frequency.window, number)
+		}
+	}
+	return nil
+}
+
+// FrequencyCapWait is how long until the recipient is back under every cap, 0 if they are now.
+// The claim check runs it under both policies, a reject create only counted what was queued then
+func FrequencyCapWait(smsrequest *SMSRequest) time.Duration {
+	if !frequencyCapApplies(smsrequest) {
+		return 0
+	}
+	now := time.Now()
+	var wait time.Duration
+	for _, frequency := range frequencyCaps {
+		taken, err := sentTimes(smsrequest.ToOptInID, now.Add(-frequency.window).Unix())
+		if err != nil {
+			fmt.Printf("ERROR COUNTING SENDS TO %s %s\n", smsrequest.ToOptInID, err)
+			continue
+		}
+		if len(taken) < frequency.limit {
+			continue
+		}
+		// Free again once enough of the oldest sends age out of the window
+		frees := time.Unix(taken[len(taken)-frequency.limit], 0).Add(frequency.window)
+		wait = max(wait, frees.Sub(now))
+	}
+	return wait
+}
+
+// How a number stands against one cap
+type CapUsage struct {
+	Limit     int    `json:"limit"`
+	Window    string `json:"window"`
+	Queued    int64  `json:"queued"` // created in the window and not blocked/cancelled/errored/expired
+	Sent      int    `json:"sent"`   // went out in the window (or is with a worker)
+	Remaining int    `json:"remaining"`
+	ResetsAt  int64  `json:"resets_at,omitempty"` // unix seconds the oldest send leaves the window
+}
+
+type RecipientUsage struct {
+	Number string     `json:"number"`
+	Policy string     `json:"policy"`
+	Caps   []CapUsage `json:"caps"`
+}
+
+// Current usage for a number against every configured cap
+func GetRecipientUsage(number string) (*RecipientUsage, error) {
+	number, err := constants.GetPhone(number)
+	if err != nil {
+		return nil, err
+	}
+	optin, err := GetOptIn(number)
+	if err != nil {
+		return nil, err
+	}
+	usage := RecipientUsage{Number: number, Policy: frequencyCapPolicy, Caps: []CapUsage{}}
+	now := time.Now()
+	for _, frequency := range frequencyCaps {
+		since := now.Add(-frequency.window).Unix()
+		capUsage := CapUsage{Limit: frequency.limit, Window: frequency.window.String()}
+		if capUsage.Queued, err = countQueued(DB, optin.ID, since); err != nil {
+			return nil, err
+		}
+		taken, err := sentTimes(optin.ID, since)
+		if err != nil {
+			return nil, err
+		}
+		capUsage.Sent = len(taken)
+		capUsage.Remaining = max(0, frequency.limit-int(capUsage.Queued))
+		if len(taken) > 0 {
+			capUsage.ResetsAt = time.Unix(taken[0], 0).Add(frequency.window).Unix()
+		}
+		usage.Caps = append(usage.Caps, capUsage)
+	}
+	return &usage, nil
+}
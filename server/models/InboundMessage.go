@@ -0,0 +1,167 @@
+package models
+
+import (
+	"fmt"
+	"microsms/constants"
+	"sort"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// A text a worker received and passed back to us
+type InboundMessage struct {
+	ID         uuid.UUID  `json:"id" gorm:"primary_key"`
+	FromNumber string     `json:"from_number" gorm:"index;not null"` // normalized, who texted us
+	ToNumber   string     `json:"to_number" gorm:"index"`            // normalized, the SIM that got it (if the worker knows)
+	Message    string     `json:"message"`
+	InReplyTo  *uuid.UUID `json:"in_reply_to" gorm:"index"` // latest outbound request between the same two numbers
+	Created    int64      `json:"created" gorm:"autoCreateTime;index"`
+}
+
+// Statuses that mean a request actually went out to the phone, only those can be replied to
+var outboundStatuses = []constants.RequestStatus{
+	constants.RequestStatus_TAKEN,
+	constants.RequestStatus_SENT,
+	constants.RequestStatus_DELIVERED,
+	constants.RequestStatus_UNDELIVERED,
+}
+
+func (inbound *InboundMessage) BeforeCreate(tx *gorm.DB) error {
+	inbound.ID = uuid.New()
+	return nil
+}
+
+// Find the most recent outbound request this reply answers, the one sent to the replying number
+// (from the SIM it landed on if we know it). nil when nothing lines up
+func findReplyThread(fromNumber string, toNumber string) *SMSRequest {
+	var smsrequest SMSRequest
+	query := DB.Where("status IN ? AND to_opt_in_id IN (?)", outboundStatuses, DB.Model(&OptIn{}).Select("id").Where("number = ?", fromNumber))
+	if toNumber != "" {
+		query = query.Where("from_opt_in_id IN (?)", DB.Model(&OptIn{}).Select("id").Where("number = ?", toNumber))
+	}
+	if err := query.Order("created DESC").First(&smsrequest).Error; err != nil {
+		return nil
+	}
+	return &smsrequest
+}
+
+// Store an inbound text, numbers get normalized so they line up with the opt in records. Also
+// hands back the outbound request it was threaded onto (nil if it wasn't)
+func CreateInboundMessage(fromNumber string, toNumber string, message string) (*InboundMessage, *SMSRequest, error) {
+	var err error
+	inbound := InboundMessage{Message: message}
+	if inbound.FromNumber, err = constants.GetPhone(fromNumber); err != nil {
+		return nil, nil, err
+	}
+	if toNumber != "" {
+		if inbound.ToNumber, err = constants.GetPhone(toNumber); err != nil {
+			return nil, nil, err
+		}
+	}
+	thread := findReplyThread(inbound.FromNumber, inbound.ToNumber)
+	if thread != nil {
+		inbound.InReplyTo = &thread.ID
+	}
+	if err = DB.Create(&inbound).Error; err != nil {
+		fmt.Println("Error creating inbound message:", err)
+		return nil, nil, err
+	}
+	return &inbound, thread, nil
+}
+
+// One line of a conversation, outbound requests and inbound replies flattened into the same shape
+type ConversationEntry struct {
+	Direction  string                  `json:"direction"` // outbound or inbound
+	ID         uuid.UUID               `json:"id"`
+	FromNumber string                  `json:"from_number"`
+	ToNumber   string                  `json:"to_number"`
+	Message    string                  `json:"message"`
+	Status     constants.RequestStatus `json:"status,omitempty"`
+	InReplyTo  *uuid.UUID              `json:"in_reply_to,omitempty"`
+	Created    int64                   `json:"created"`
+}
+
+// Everything between two numbers (either direction), newest first. Pages back through history
+// with the same created + id cursor as the list, so messages sharing a second don't get skipped
+// or repeated across a page break. Hands back the cursor for the next page, empty on the last
+func GetConversation(numberA string, numberB string, cursor string, limit int) ([]ConversationEntry, string, error) {
+	var err error
+	var smsrequests []SMSRequest
+	var inbound []InboundMessage
+	if numberA, err = constants.GetPhone(numberA); err != nil {
+		return nil, "", err
+	}
+	if numberB, err = constants.GetPhone(numberB); err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+
+	optInIDs := DB.Model(&OptIn{}).Select("id").Where("number IN ?", []string{numberA, numberB})
+	pairRequests := "from_opt_in_id IN (?) AND to_opt_in_id IN (?) AND from_opt_in_id <> to_opt_in_id"
+	outboundQuery := DB.Where(pairRequests, optInIDs, optInIDs)
+	// Replies that came in without a to_number still belong here if they threaded onto one of ours
+	inboundQuery := DB.Where("((from_number = ? AND to_number = ?) OR (from_number = ? AND to_number = ?) OR in_reply_to IN (?))",
+		numberA, numberB, numberB, numberA, DB.Model(&SMSRequest{}).Select("id").Where(pairRequests, optInIDs, optInIDs))
+	if cursor != "" {
+		after, err := decodeListCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		outboundQuery = outboundQuery.Where("(created < ? OR (created = ? AND id < ?))", after.Value, after.Value, after.ID)
+		inboundQuery = inboundQuery.Where("(created < ? OR (created = ? AND id < ?))", after.Value, after.Value, after.ID)
+	}
+	// One past the page from each side tells us whether there's another page
+	if err = outboundQuery.Order("created DESC, id DESC").Limit(limit + 1).Find(&smsrequests).Error; err != nil {
+		return nil, "", err
+	}
+	if err = inboundQuery.Order("created DESC, id DESC").Limit(limit + 1).Find(&inbound).Error; err != nil {
+		return nil, "", err
+	}
+
+	entries := make([]ConversationEntry, 0, len(smsrequests)+len(inbound))
+	for _, smsrequest := range smsrequests {
+		if smsrequest.Priority == constants.RequestPriority_OTP {
+			smsrequest.Message = "" // the code only ever goes to the worker
+		}
+		entries = append(entries, ConversationEntry{
+			Direction:  SearchKind_OUTBOUND,
+			ID:         smsrequest.ID,
+			FromNumber: smsrequest.FromNumber,
+			ToNumber:   smsrequest.ToNumber,
+			Message:    smsrequest.Message,
+			Status:     smsrequest.Status,
+			Created:    smsrequest.Created,
+		})
+	}
+	for _, message := range inbound {
+		entries = append(entries, ConversationEntry{
+			Direction:  SearchKind_INBOUND,
+			ID:         message.ID,
+			FromNumber: message.FromNumber,
+			ToNumber:   message.ToNumber,
+			Message:    message.Message,
+			InReplyTo:  message.InReplyTo,
+			Created:    message.Created,
+		})
+	}
+	// Same order the queries used, ids compare as their strings like they do in the DB
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Created != entries[j].Created {
+			return entries[i].Created > entries[j].Created
+		}
+		return entries[i].ID.String() > entries[j].ID.String()
+	})
+	nextCursor := ""
+	if len(entries) > limit {
+		entries = entries[:limit]
+		last := entries[limit-1]
+		nextCursor = encodeListCursor(listCursor{Sort: "created", Value: last.Created, ID: last.ID})
+	}
+	return entries, nextCursor, nil
+}
@@ -0,0 +1,177 @@
+package models
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"microsms/config"
+	"microsms/constants"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+/**
+Links in outbound messages. Carriers are quick to filter texts with public shorteners or domains
+they don't know, so links can be held to an allow-list of domains and optionally swapped for
+<baseurl>/l/<code> on this server, which counts the click against the request and redirects.
+Links are only swapped once the request is cleared to go, until then it carries what the client
+sent so the filter judges the real links.
+**/
+
+var ErrLinkNotAllowed = errors.New("link domain is not allowed")
+
+var linkAllowList []string
+var linkRewrite bool
+var linkBaseURL string
+
+// SetLinkPolicy sets the link allow-list and rewriting from main. Rewriting needs to know where
+// this server can be reached from a phone
+func SetLinkPolicy(cfg config.LinkConfig) error {
+	linkAllowList = nil
+	for _, domain := range cfg.AllowList {
+		linkAllowList = append(linkAllowList, strings.ToLower(strings.TrimSpace(domain)))
+	}
+	linkRewrite = cfg.Rewrite
+	linkBaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	if !linkRewrite {
+		return nil
+	}
+	parsed, err := url.Parse(linkBaseURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("links.baseurl %q has to be an http(s) URL when rewriting links", cfg.BaseURL)
+	}
+	return nil
+}
+
+// A rewritten link from a request's message and its clicks
+type Link struct {
+	ID           uuid.UUID `json:"id" gorm:"primary_key"`
+	SMSRequestID uuid.UUID `json:"smsrequest_id" gorm:"index;not null"`
+	URL          string    `json:"url"`  // where it goes
+	Host         string    `json:"host"` // lower case, www. dropped
+	Code         string    `json:"code" gorm:"uniqueIndex;size:16;not null"`
+	ShortURL     string    `json:"short_url"` // what replaced it in the message
+	Clicks       int64     `json:"clicks"`
+	FirstClickAt int64     `json:"first_click_at,omitempty"` // unix seconds
+	LastClickAt  int64     `json:"last_click_at,omitempty"`
+	Created      int64     `json:"created" gorm:"autoCreateTime"`
+}
+
+func (link *Link) BeforeCreate(tx *gorm.DB) error {
+	link.ID = uuid.New()
+	return nil
+}
+
+// Short random code for the redirect path, lower case so it survives handsets that mess with case
+func generateLinkCode() (string, error) {
+	chars := []rune("abcdefghijkmnpqrstuvwxyz23456789")
+
+	b := make([]rune, 8)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = chars[n.Int64()]
+	}
+
+	return string(b), nil
+}
+
+// Every link in the message has to be on the allow-list, when there is one. Checked on create,
+// rewriting waits until the request is cleared to go (see rewriteLinks)
+func checkLinks(message string) error {
+	if len(linkAllowList) == 0 {
+		return nil
+	}
+	for _, found := range constants.FindLinks(message) {
+		if !constants.HostMatches(found.Host, linkAllowList) {
+			return fmt.Errorf("%w: %s", ErrLinkNotAllowed, found.Host)
+		}
+	}
+	return nil
+}
+
+// Swap every link in the message for a fresh redirect link. Hands back the new message and the
+// Link rows to save with the request, none when rewriting is off or there's nothing to rewrite
+func shortenLinks(message string) (string, []Link, error) {
+	found := constants.FindLinks(message)
+	if !linkRewrite || len(found) == 0 {
+		return message, nil, nil
+	}
+	var links []Link
+	var rewritten strings.Builder
+	last := 0
+	for _, link := range found {
+		code, err := generateLinkCode()
+		if err != nil {
+			return "", nil, err
+		}
+		short := Link{URL: link.URL(), Host: link.Host, Code: code, ShortURL: fmt.Sprintf("%s/l/%s", linkBaseURL, code)}
+		rewritten.WriteString(message[last:link.Start])
+		rewritten.WriteString(short.ShortURL)
+		last = link.End
+		links = append(links, short)
+	}
+	rewritten.WriteString(message[last:])
+	return rewritten.String(), links, nil
+}
+
+// Rewrite the links of a request the filter (or a reviewer) just let through. Runs in the same
+// transaction that moves it on, so a worker never gets it with the original links and a blocked
+// message never gets a redirect anyone could follow. The filter, the body hash and the verdict
+// cache all saw the message as the client wrote it
+func rewriteLinks(tx *gorm.DB, id uuid.UUID) error {
+	if !linkRewrite {
+		return nil
+	}
+	var smsrequest SMSRequest
+	if err := tx.Select("id", "message").First(&smsrequest, "id = ?", id).Error; err != nil {
+		return err
+	}
+	var existing int64
+	if err := tx.Model(&Link{}).Where("sms_request_id = ?", id).Count(&existing).Error; err != nil || existing > 0 {
+		return err // already rewritten, say a request approved a second time
+	}
+	message, links, err := shortenLinks(smsrequest.Message)
+	if err != nil || len(links) == 0 {
+		return err
+	}
+	for i := range links {
+		links[i].SMSRequestID = id
+	}
+	if err = tx.Create(&links).Error; err != nil {
+		return err
+	}
+	return tx.Model(&SMSRequest{}).Where("id = ?", id).Select("message", "encoding", "characters", "segment_length", "segments").
+		Updates(&SMSRequest{Message: message, SegmentInfo: constants.GetSegmentInfo(message)}).Error
+}
+
+// Returned for a link whose request retention has redacted, there's nowhere left to send anyone
+var ErrLinkRedacted = errors.New("link target has been redacted")
+
+// Count a click on a rewritten link and hand back where it goes
+func FollowLink(code string) (*Link, error) {
+	var link Link
+	if err := DB.Where("code = ?", code).First(&link).Error; err != nil {
+		return nil, err
+	}
+	if link.URL == "" {
+		return nil, ErrLinkRedacted
+	}
+	now := time.Now().Unix()
+	err := DB.Model(&Link{}).Where("id = ?", link.ID).Updates(map[string]interface{}{
+		"clicks":         gorm.Expr("clicks + 1"),
+		"first_click_at": gorm.Expr("CASE WHEN first_click_at = 0 THEN ? ELSE first_click_at END", now),
+		"last_click_at":  now,
+	}).Error
+	if err != nil {
+		fmt.Printf("Failed counting click on link %s: %s\n", code, err)
+	}
+	return &link, nil
+}
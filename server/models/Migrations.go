@@ -0,0 +1,441 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"microsms/config"
+	"microsms/constants"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+/**
+Versioned, forward-only schema migrations. Each one has a version and a name, runs once and is
+recorded in schema_migrations with when it ran. Nothing ever gets rolled back, a bad migration is
+fixed by the next one. Startup applies whatever is pending and won't run against a database a
+newer build has already migrated past what this one knows, an old binary writing to a newer
+schema is how data goes missing.
+
+Migration 1 is the schema as it stood when versioning came in, AutoMigrate over frozen copies of
+the models from then (SchemaBaseline.go). AutoMigrate only ever adds tables, columns and indexes,
+so it also adopts databases from before versioning (those ran AutoMigrate on every start)
+whatever state they were left in. Everything after it is explicit and checks before it changes
+something, a database from before versioning may already have what it adds.
+
+A migration that can't run on this build (the SQLite search index without FTS5 compiled in)
+says so with ErrMigrationUnsupported. It's left pending and the rest carry on, a build that
+can run it picks it up later.
+**/
+
+// One applied migration
+type SchemaMigration struct {
+	Version   int    `json:"version" gorm:"primaryKey;autoIncrement:false"`
+	Name      string `json:"name"`
+	AppliedAt int64  `json:"applied_at"` // unix seconds
+}
+
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+}
+
+// In order, append only. Never edit or renumber one that has shipped
+var migrations = []migration{
+	{1, "baseline", migrateBaseline},
+	{2, "backfill body_hash", migrateBackfillBodyHash},
+	{3, "add sms_requests.redacted_at", migrateAddRedactedAt},
+	{4, "redact finished otp codes", migrateRedactOTPCodes},
+	{5, "sqlite search index", migrateSQLiteSearch},
+	{6, "postgres/mysql search index", migrateServerSearch},
+	{7, "add sms_requests.finished_at", migrateAddFinishedAt},
+	{8, "scrub otp codes from webhook payloads", migrateScrubOTPPayloads},
+	{9, "key the sqlite search index on search_rowid", migrateSQLiteSearchKey},
+}
+
+var ErrSchemaTooNew = errors.New("database schema is newer than this build")
+
+// A migration this build can't run, it stays pending for one that can
+var ErrMigrationUnsupported = errors.New("migration not supported by this build")
+
+// LatestSchemaVersion is the newest migration this build knows
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+func migrateBaseline(tx *gorm.DB) error {
+	return tx.AutoMigrate(baselineModels...)
+}
+
+// Requests from before body_hash existed, so the fan-out heuristic sees them too
+func migrateBackfillBodyHash(tx *gorm.DB) error {
+	var smsrequests []SMSRequest
+	return tx.Model(&SMSRequest{}).Select("id", "message").Where("body_hash = '' OR body_hash IS NULL").
+		FindInBatches(&smsrequests, 500, func(batch *gorm.DB, _ int) error {
+			for _, smsrequest := range smsrequests {
+				err := tx.Model(&SMSRequest{}).Where("id = ?", smsrequest.ID).UpdateColumn("body_hash", messageBodyHash(smsrequest.Message)).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+}
+
+// Retention marks the requests it blanked. Existing rows are left NULL, which counts as not redacted
+func migrateAddRedactedAt(tx *gorm.DB) error {
+	if tx.Migrator().HasColumn(&SMSRequest{}, "RedactedAt") {
+		return nil
+	}
+	return tx.Migrator().AddColumn(&SMSRequest{}, "RedactedAt")
+}
+
+// Otp codes are redacted once the request finishes now and kept out of search. Catch up the ones
+// that finished before that, and on SQLite drop the search triggers (migration 5 puts them back
+// without the codes) and blank the codes already in the index
+func migrateRedactOTPCodes(tx *gorm.DB) error {
+	err := tx.Model(&SMSRequest{}).Where("priority = ? AND status IN ? AND "+notRedacted, constants.RequestPriority_OTP, FinishedStatuses).
+		UpdateColumns(redactedColumns(time.Now())).Error
+	if err != nil || tx.Dialector.Name() != DBDriver_SQLITE {
+		return err
+	}
+	var indexed int64
+	if err = tx.Raw("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'sms_requests_fts'").Scan(&indexed).Error; err != nil || indexed == 0 {
+		return err
+	}
+	for _, statement := range []string{
+		`DROP TRIGGER IF EXISTS sms_requests_fts_ai`,
+		`DROP TRIGGER IF EXISTS sms_requests_fts_au`,
+		`UPDATE sms_requests_fts SET message = '' WHERE rowid IN (SELECT rowid FROM sms_requests WHERE priority = 'otp')`,
+	} {
+		if err = tx.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The FTS5 tables and triggers behind search on SQLite (Search.go). Databases from before this
+// migration already have them from startup, only a fresh index gets backfilled
+func migrateSQLiteSearch(tx *gorm.DB) error {
+	if tx.Dialector.Name() != DBDriver_SQLITE {
+		return nil
+	}
+	var existing int64
+	if err := tx.Raw("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'sms_requests_fts'").Scan(&existing).Error; err != nil {
+		return err
+	}
+	for _, statement := range sqliteSearchStatements {
+		if err := tx.Exec(statement).Error; err != nil {
+			if strings.Contains(err.Error(), "no such module: fts5") {
+				return fmt.Errorf("%w: built without -tags sqlite_fts5", ErrMigrationUnsupported)
+			}
+			return err
+		}
+	}
+	if existing > 0 {
+		return nil
+	}
+	for _, statement := range sqliteSearchBackfill {
+		if err := tx.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The search indexes for Postgres and MySQL (Search.go), nothing to do on SQLite. MySQL can't roll
+// DDL back so an index that's already there from a failed earlier run gets skipped
+func migrateServerSearch(tx *gorm.DB) error {
+	switch tx.Dialector.Name() {
+	case DBDriver_POSTGRES:
+		for _, statement := range postgresSearchStatements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+	case DBDriver_MYSQL:
+		for _, index := range mysqlSearchIndexes {
+			if tx.Migrator().HasIndex(index.table, index.index) {
+				continue
+			}
+			if err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD FULLTEXT INDEX %s (%s)", index.table, index.index, index.columns)).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Retention ages requests from when they finished now. Requests already finished get the best
+// guess there is: the delivery report, the send, the claim, and created for the ones that never
+// left (blocked, cancelled, expired)
+func migrateAddFinishedAt(tx *gorm.DB) error {
+	if !tx.Migrator().HasColumn(&SMSRequest{}, "FinishedAt") {
+		if err := tx.Migrator().AddColumn(&SMSRequest{}, "FinishedAt"); err != nil {
+			return err
+		}
+	}
+	if !tx.Migrator().HasIndex(&SMSRequest{}, "FinishedAt") {
+		if err := tx.Migrator().CreateIndex(&SMSRequest{}, "FinishedAt"); err != nil {
+			return err
+		}
+	}
+	div := "/" // the millisecond columns, MySQL's / would hand back a decimal
+	if tx.Dialector.Name() == DBDriver_MYSQL {
+		div = "DIV"
+	}
+	return tx.Model(&SMSRequest{}).Where("status IN ? AND (finished_at = 0 OR finished_at IS NULL)", FinishedStatuses).
+		UpdateColumn("finished_at", gorm.Expr(fmt.Sprintf(`CASE
+			WHEN delivered_at > 0 THEN delivered_at %[1]s 1000
+			WHEN sent_at > 0 THEN sent_at %[1]s 1000
+			WHEN taken_at > 0 THEN taken_at
+			ELSE created END`, div))).Error
+}
+
+// Taken events used to go out with the worker's copy of an otp request, code and all, and the
+// delivery log kept it. Retention only blanks payloads when it's switched on, so scrub them here
+func migrateScrubOTPPayloads(tx *gorm.DB) error {
+	otp := tx.Model(&SMSRequest{}).Select("id").Where("priority = ?", constants.RequestPriority_OTP)
+	var deliveries []WebhookDelivery
+	return tx.Model(&WebhookDelivery{}).Select("id", "payload").Where("payload <> '' AND sms_request_id IN (?)", otp).
+		FindInBatches(&deliveries, 500, func(batch *gorm.DB, _ int) error {
+			for _, delivery := range deliveries {
+				scrubbed := scrubOTPPayload(delivery.Payload)
+				if scrubbed == delivery.Payload {
+					continue
+				}
+				if err := tx.Model(&WebhookDelivery{}).Where("id = ?", delivery.ID).UpdateColumn("payload", scrubbed).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+}
+
+// The FTS5 index was keyed on the rowid, which a VACUUM or table rebuild can renumber on tables
+// keyed by uuid and leave search pointing at the wrong requests. Rebuild it on a column of our
+// own (Search.go). Waits on migration 5 like it does, there's no index to rekey without FTS5
+func migrateSQLiteSearchKey(tx *gorm.DB) error {
+	if tx.Dialector.Name() != DBDriver_SQLITE {
+		return nil
+	}
+	var indexed int64
+	if err := tx.Raw("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'sms_requests_fts'").Scan(&indexed).Error; err != nil {
+		return err
+	}
+	if indexed == 0 {
+		return fmt.Errorf("%w: needs the search index from migration 5", ErrMigrationUnsupported)
+	}
+	for _, table := range []string{"sms_requests", "inbound_messages"} {
+		if tx.Migrator().HasColumn(table, "search_rowid") {
+			continue
+		}
+		if err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN search_rowid INTEGER", table)).Error; err != nil {
+			return err
+		}
+	}
+	for _, statement := range sqliteSearchKeyStatements {
+		if err := tx.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConnectDB opens the configured database and sets DB without touching the schema
+func ConnectDB(cfg config.DatabaseConfig) (*gorm.DB, error) {
+	db, err := openDB(cfg)
+	if err != nil {
+		return nil, err
+	}
+	DB = db
+	return db, nil
+}
+
+// InitDB connects and brings the schema up to date, refusing a schema newer than this build
+func InitDB(cfg config.DatabaseConfig) (*gorm.DB, error) {
+	db, err := ConnectDB(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = MigrateUp(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Applied migrations by version, empty if the bookkeeping table isn't there yet
+func appliedMigrations() (map[int]SchemaMigration, error) {
+	applied := map[int]SchemaMigration{}
+	if !DB.Migrator().HasTable(&SchemaMigration{}) {
+		return applied, nil
+	}
+	var rows []SchemaMigration
+	if err := DB.Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("Error reading schema_migrations: %s", err)
+	}
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+func checkSchemaVersion(applied map[int]SchemaMigration) error {
+	for version := range applied {
+		if version > LatestSchemaVersion() {
+			return fmt.Errorf("%w: it's at version %d, this build only knows up to %d", ErrSchemaTooNew, version, LatestSchemaVersion())
+		}
+	}
+	return nil
+}
+
+// Where a migration stands, AppliedAt 0 means pending
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt int64
+	Unknown   bool // applied by a newer build, this one doesn't have it
+}
+
+// GetMigrationStatus lists every migration this build knows plus any applied ones it doesn't
+func GetMigrationStatus() ([]MigrationStatus, error) {
+	applied, err := appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var statuses []MigrationStatus
+	known := map[int]bool{}
+	for _, m := range migrations {
+		known[m.Version] = true
+		statuses = append(statuses, MigrationStatus{Version: m.Version, Name: m.Name, AppliedAt: applied[m.Version].AppliedAt})
+	}
+	for version, row := range applied {
+		if !known[version] {
+			statuses = append(statuses, MigrationStatus{Version: version, Name: row.Name, AppliedAt: row.AppliedAt, Unknown: true})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+func pendingMigrations() ([]migration, error) {
+	applied, err := appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if err = checkSchemaVersion(applied); err != nil {
+		return nil, err
+	}
+	var pending []migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// MigrateUp applies every pending migration in order, each in its own transaction along with its
+// schema_migrations row. Returns the ones it applied
+func MigrateUp() ([]MigrationStatus, error) {
+	if err := DB.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, fmt.Errorf("Error creating schema_migrations: %s", err)
+	}
+	pending, err := pendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var done []MigrationStatus
+	for _, m := range pending {
+		start := time.Now()
+		err = DB.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now().Unix()}).Error
+		})
+		if errors.Is(err, ErrMigrationUnsupported) {
+			fmt.Printf("Skipped migration %d %s, it stays pending: %s\n", m.Version, m.Name, err)
+			continue
+		}
+		if err != nil {
+			return done, fmt.Errorf("Error applying migration %d %s: %s", m.Version, m.Name, err)
+		}
+		fmt.Printf("Applied migration %d %s in %s\n", m.Version, m.Name, time.Since(start).Round(time.Millisecond))
+		done = append(done, MigrationStatus{Version: m.Version, Name: m.Name, AppliedAt: time.Now().Unix()})
+	}
+	return done, nil
+}
+
+// A pending migration and the statements it would run
+type MigrationPlan struct {
+	Version    int
+	Name       string
+	Statements []string
+	Skipped    string // why this build can't run it, it'd stay pending
+}
+
+// DryRunMigrations works out what MigrateUp would do. Where DDL is transactional (SQLite and
+// Postgres) the pending migrations really run, inside a transaction that's rolled back, so the
+// statements are the real ones and a migration that would fail fails here. MySQL commits DDL on
+// the spot so there it's just the list. ran says which of the two happened
+func DryRunMigrations() (plans []MigrationPlan, ran bool, err error) {
+	pending, err := pendingMigrations()
+	if err != nil {
+		return nil, false, err
+	}
+	for _, m := range pending {
+		plans = append(plans, MigrationPlan{Version: m.Version, Name: m.Name})
+	}
+	if len(pending) == 0 || DBDriver() == DBDriver_MYSQL {
+		return plans, false, nil
+	}
+	capture := &statementLog{}
+	tx := DB.Session(&gorm.Session{Logger: capture}).Begin()
+	if tx.Error != nil {
+		return nil, false, tx.Error
+	}
+	defer tx.Rollback()
+	for i, m := range pending {
+		capture.statements = nil
+		err = m.Up(tx)
+		if errors.Is(err, ErrMigrationUnsupported) {
+			plans[i].Skipped = err.Error()
+			continue
+		}
+		if err != nil {
+			return plans, true, fmt.Errorf("Error in migration %d %s: %s", m.Version, m.Name, err)
+		}
+		plans[i].Statements = capture.statements
+	}
+	return plans, true, nil
+}
+
+// Keeps the statements that change something, the migrator's lookups are left out
+type statementLog struct {
+	statements []string
+}
+
+func (log *statementLog) LogMode(logger.LogLevel) logger.Interface      { return log }
+func (log *statementLog) Info(context.Context, string, ...interface{})  {}
+func (log *statementLog) Warn(context.Context, string, ...interface{})  {}
+func (log *statementLog) Error(context.Context, string, ...interface{}) {}
+
+func (log *statementLog) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	statement, _ := fc()
+	fields := strings.Fields(statement)
+	if len(fields) == 0 {
+		return
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "SELECT", "PRAGMA", "SHOW", "SAVEPOINT", "RELEASE":
+		return
+	}
+	log.statements = append(log.statements, statement)
+}
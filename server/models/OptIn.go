@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"microsms/constants"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
@@ -11,17 +12,24 @@ import (
 
 type OptIn struct {
 	ID       uuid.UUID             `json:"id" gorm:"primary_key"`
-	Number   string                `json:"number" gorm:"uniqueIndex"`
+	Number   string                `json:"number" gorm:"uniqueIndex;size:32"`
 	Codeword string                `json:"codeword"`                // the codeword we sent in our opt in msg
 	Status   constants.OptInStatus `json:"contact" gorm:"not null"` // true means they opted in
+	Timezone string                `json:"timezone"`                // IANA zone, overrides the area code guess for quiet hours
 	Created  int64                 `json:"created" gorm:"autoCreateTime"`
 	Updated  int64                 `json:"updated" gorm:"autoUpdateTime"`
 }
 
 // Find or create an optin record for a phone number
 func FindOrCreateOptIn(number string) (*OptIn, error) {
+	return findOrCreateOptIn(DB, number)
+}
+
+// Same thing on a given connection, the request create hook has to stay inside its transaction
+// since SQLite only has the one writer
+func findOrCreateOptIn(db *gorm.DB, number string) (*OptIn, error) {
 	var foundOptIn OptIn
-	result := DB.First(&foundOptIn, &OptIn{Number: number})
+	result := db.First(&foundOptIn, &OptIn{Number: number})
 	switch result.RowsAffected { // Create records if they don't exist
 	case 0:
 		// No optin found, so set status to ASK
@@ -30,7 +38,7 @@ func FindOrCreateOptIn(number string) (*OptIn, error) {
 			Status:   constants.OptInStatus_ASK,
 			Codeword: constants.GenerateCodePhrase(), // Generate a unique code for our pass
 		}
-		err := DB.Create(&newOptIn).Error
+		err := db.Create(&newOptIn).Error
 		if err != nil {
 			return nil, err
 		}
@@ -111,20 +119,28 @@ func UpdateOptInAndRequestsIfAuthD(phone string, response string) (*OptIn, error
 			// They are opting in or toggling
 			optin.Status = constants.OptInStatus_TRUE
 		}
-		// After we toggle our case trigger our SMSRequest update logic
+		// Save first so the opt in status we check against below is the new one
+		if err = DB.Save(optin).Error; err != nil {
+			return nil, err
+		}
+		// After we toggle our case trigger our SMSRequest update logic. Requests are matched on the
+		// opt in ids since the numbers on the request are however the client typed them
 		switch optin.Status {
 		case constants.OptInStatus_TRUE: // we are now true so update all verify check status where we are one of the numbers
-			DB.Where(&SMSRequest{Status: constants.RequestStatus_VERIFY_CHECK, FromNumber: optin.Number}).Or(&SMSRequest{Status: constants.RequestStatus_VERIFY_CHECK, ToNumber: optin.Number}).Find(&smsrequests)
+			DB.Preload("ToOptIn").Preload("FromOptIn").Where("status = ? AND (from_opt_in_id = ? OR to_opt_in_id = ?)", constants.RequestStatus_VERIFY_CHECK, optin.ID, optin.ID).Find(&smsrequests)
 			for i := 0; i < len(smsrequests); i++ {
 				if smsrequests[i].FromOptIn.Status == constants.OptInStatus_TRUE && smsrequests[i].ToOptIn.Status == constants.OptInStatus_TRUE {
-					smsrequests[i].Status = constants.RequestStatus_READY_TO_SEND // if they are both opted in then mark this as ready
+					// if they are both opted in then mark this as ready
+					TransitionSMSRequest(smsrequests[i].ID.String(), []constants.RequestStatus{constants.RequestStatus_VERIFY_CHECK}, constants.RequestStatus_READY_TO_SEND)
 				}
 			}
-			DB.Save(&smsrequests) // Bulk save records
 		case constants.OptInStatus_FALSE: // Get all the ready to send/verify checks so we can now update them to be denied
-			DB.Where(&SMSRequest{Status: constants.RequestStatus_READY_TO_SEND, FromNumber: optin.Number}).Or(&SMSRequest{Status: constants.RequestStatus_VERIFY_CHECK, FromNumber: optin.Number}).Or(&SMSRequest{Status: constants.RequestStatus_READY_TO_SEND, ToNumber: optin.Number}).Or(&SMSRequest{Status: constants.RequestStatus_VERIFY_CHECK, ToNumber: optin.Number}).Updates(SMSRequest{Status: constants.RequestStatus_BLOCKED})
+			DB.Where("status IN ? AND (from_opt_in_id = ? OR to_opt_in_id = ?)", PendingStatuses, optin.ID, optin.ID).Find(&smsrequests)
+			for i := 0; i < len(smsrequests); i++ {
+				TransitionSMSRequest(smsrequests[i].ID.String(), PendingStatuses, constants.RequestStatus_BLOCKED)
+			}
 		}
-
+		return optin, nil
 	}
 	err = DB.Save(optin).Error
 	if err != nil {
@@ -142,3 +158,21 @@ func GetEarliestOptIn() (*OptIn, error) {
 	}
 	return &earliest, nil
 }
+
+// Set (or clear with "") the timezone quiet hours use for a number
+func SetOptInTimezone(number string, timezone string) (*OptIn, error) {
+	if timezone != "" {
+		if _, err := time.LoadLocation(timezone); err != nil {
+			return nil, fmt.Errorf("Error invalid timezone %s", timezone)
+		}
+	}
+	optin, err := GetOptIn(number)
+	if err != nil {
+		return nil, err
+	}
+	optin.Timezone = timezone
+	if err = DB.Model(optin).Update("timezone", timezone).Error; err != nil {
+		return nil, err
+	}
+	return optin, nil
+}
@@ -0,0 +1,329 @@
+package models
+
+import (
+	"fmt"
+	"microsms/config"
+	"microsms/constants"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+/**
+Retention for finished requests. Each rule picks requests by priority and status and says how
+long after they finished (finished_at, stamped on the move into a finished status) the message
+is redacted (blanked along with the template variables, body hash and link targets) and when the
+whole row goes, taking its links, reviews and webhook deliveries with it. Nothing that's still
+on its way out is ever touched.
+
+Otp requests don't wait for a rule, their code is redacted the moment they finish.
+
+Redacted requests keep their numbers, status and delivery times for stats. Webhook payloads are
+snapshots of the request so they get blanked too, once they're no longer waiting to be sent. The
+sweep works in batches so SQLite's single writer is never held for long.
+**/
+
+// Requests that are done with, the only ones retention looks at. Taken belongs to a worker still
+var FinishedStatuses = []constants.RequestStatus{
+	constants.RequestStatus_SENT,
+	constants.RequestStatus_DELIVERED,
+	constants.RequestStatus_UNDELIVERED,
+	constants.RequestStatus_ERROR,
+	constants.RequestStatus_BLOCKED,
+	constants.RequestStatus_CANCELLED,
+	constants.RequestStatus_EXPIRED,
+}
+
+type retentionRule struct {
+	priority    constants.RequestPriority // empty is any
+	statuses    []constants.RequestStatus
+	redact      string // ages as configured, for the preview
+	delete      string
+	redactAfter time.Duration // 0 never redacts
+	deleteAfter time.Duration // 0 never deletes
+}
+
+var retentionRules []retentionRule
+var retentionBatchSize = 500
+
+// SetRetentionPolicy parses the rules from the config, ages are Go durations plus "<n>d" for days
+func SetRetentionPolicy(cfg config.RetentionConfig) error {
+	var rules []retentionRule
+	for i, raw := range cfg.Rules {
+		rule := retentionRule{priority: constants.RequestPriority(raw.Priority), redact: raw.Redact, delete: raw.Delete}
+		if raw.Priority != "" && !constants.IsValidRequestPriority(raw.Priority) {
+			return fmt.Errorf("invalid retention rule %d priority %s", i, raw.Priority)
+		}
+		for _, status := range raw.Statuses {
+			if !slices.Contains(FinishedStatuses, constants.RequestStatus(status)) {
+				return fmt.Errorf("invalid retention rule %d status %s, only finished requests can be purged %v", i, status, FinishedStatuses)
+			}
+			rule.statuses = append(rule.statuses, constants.RequestStatus(status))
+		}
+		if len(rule.statuses) == 0 {
+			rule.statuses = FinishedStatuses
+		}
+		var err error
+		if rule.redactAfter, err = parseRetentionAge(raw.Redact); err != nil {
+			return fmt.Errorf("invalid retention rule %d redact %s", i, raw.Redact)
+		}
+		if rule.deleteAfter, err = parseRetentionAge(raw.Delete); err != nil {
+			return fmt.Errorf("invalid retention rule %d delete %s", i, raw.Delete)
+		}
+		if rule.redactAfter == 0 && rule.deleteAfter == 0 {
+			return fmt.Errorf("retention rule %d needs a redact or delete age", i)
+		}
+		rules = append(rules, rule)
+	}
+	if cfg.BatchSize > 0 {
+		retentionBatchSize = cfg.BatchSize
+	}
+	retentionRules = rules
+	return nil
+}
+
+// "" is 0 (never), "90d" is days, anything else goes to time.ParseDuration
+func parseRetentionAge(raw string) (time.Duration, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, nil
+	}
+	if days, found := strings.CutSuffix(raw, "d"); found {
+		count, err := strconv.Atoi(days)
+		if err != nil || count <= 0 {
+			return 0, fmt.Errorf("invalid age %s", raw)
+		}
+		return time.Duration(count) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(raw)
+	if err != nil || age <= 0 {
+		return 0, fmt.Errorf("invalid age %s", raw)
+	}
+	return age, nil
+}
+
+// Where clause for the requests the rule has aged out as of at, "" when age is 0
+func (rule retentionRule) condition(age time.Duration, at time.Time) (string, []interface{}) {
+	if age == 0 {
+		return "", nil
+	}
+	where := "(status IN ? AND finished_at < ?"
+	args := []interface{}{rule.statuses, at.Add(-age).Unix()}
+	if rule.priority != "" {
+		where += " AND priority = ?"
+		args = append(args, rule.priority)
+	}
+	return where + ")", args
+}
+
+// Every rule's condition ORed together, so a request several rules match is only counted once.
+// Rules apply on their own, that request goes at whichever of them comes due first
+func retentionCondition(at time.Time, age func(rule retentionRule) time.Duration) (string, []interface{}) {
+	var wheres []string
+	var args []interface{}
+	for _, rule := range retentionRules {
+		where, ruleArgs := rule.condition(age(rule), at)
+		if where != "" {
+			wheres = append(wheres, where)
+			args = append(args, ruleArgs...)
+		}
+	}
+	return strings.Join(wheres, " OR "), args
+}
+
+func redactAge(rule retentionRule) time.Duration { return rule.redactAfter }
+func deleteAge(rule retentionRule) time.Duration { return rule.deleteAfter }
+
+const notRedacted = "(redacted_at = 0 OR redacted_at IS NULL)"
+
+// Requests due for redacting at at, the ones due for deleting anyway are left to that
+func redactDue(tx *gorm.DB, at time.Time) *gorm.DB {
+	where, args := retentionCondition(at, redactAge)
+	if where == "" {
+		return nil
+	}
+	query := tx.Model(&SMSRequest{}).Where(notRedacted).Where("("+where+")", args...)
+	if deleteWhere, deleteArgs := retentionCondition(at, deleteAge); deleteWhere != "" {
+		query = query.Where("NOT ("+deleteWhere+")", deleteArgs...)
+	}
+	return query
+}
+
+func deleteDue(tx *gorm.DB, at time.Time) *gorm.DB {
+	where, args := retentionCondition(at, deleteAge)
+	if where == "" {
+		return nil
+	}
+	return tx.Model(&SMSRequest{}).Where("("+where+")", args...)
+}
+
+func countDue(query *gorm.DB) (int64, error) {
+	var count int64
+	if query == nil {
+		return 0, nil
+	}
+	err := query.Count(&count).Error
+	return count, err
+}
+
+// One rule and what it has due, counted on its own
+type RetentionRuleReport struct {
+	Priority  constants.RequestPriority `json:"priority,omitempty"`
+	Statuses  []constants.RequestStatus `json:"statuses"`
+	Redact    string                    `json:"redact,omitempty"`
+	Delete    string                    `json:"delete,omitempty"`
+	RedactDue int64                     `json:"redact_due"`
+	DeleteDue int64                     `json:"delete_due"`
+}
+
+// What a sweep at At would do. Redact and Delete count every request once however many rules
+// match it, and requests due for deleting aren't counted as redacted as well
+type RetentionPreview struct {
+	At     int64                 `json:"at"` // unix seconds
+	Redact int64                 `json:"redact"`
+	Delete int64                 `json:"delete"`
+	Rules  []RetentionRuleReport `json:"rules"`
+}
+
+// PreviewRetention counts what a sweep at at would redact and delete without touching anything
+func PreviewRetention(at time.Time) (*RetentionPreview, error) {
+	preview := &RetentionPreview{At: at.Unix(), Rules: []RetentionRuleReport{}}
+	var err error
+	if preview.Redact, err = countDue(redactDue(DB, at)); err != nil {
+		return nil, err
+	}
+	if preview.Delete, err = countDue(deleteDue(DB, at)); err != nil {
+		return nil, err
+	}
+	for _, rule := range retentionRules {
+		report := RetentionRuleReport{Priority: rule.priority, Statuses: rule.statuses, Redact: rule.redact, Delete: rule.delete}
+		if where, args := rule.condition(rule.redactAfter, at); where != "" {
+			if report.RedactDue, err = countDue(DB.Model(&SMSRequest{}).Where(notRedacted).Where(where, args...)); err != nil {
+				return nil, err
+			}
+		}
+		if where, args := rule.condition(rule.deleteAfter, at); where != "" {
+			if report.DeleteDue, err = countDue(DB.Model(&SMSRequest{}).Where(where, args...)); err != nil {
+				return nil, err
+			}
+		}
+		preview.Rules = append(preview.Rules, report)
+	}
+	return preview, nil
+}
+
+// How a sweep went
+type RetentionRun struct {
+	At         int64  `json:"at"` // unix seconds
+	Redacted   int64  `json:"redacted"`
+	Deleted    int64  `json:"deleted"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// RunRetention deletes then redacts whatever the rules have due as of now, a batch per
+// transaction. Counts are what got done even when it stops on an error
+func RunRetention(now time.Time) (*RetentionRun, error) {
+	run := &RetentionRun{At: now.Unix()}
+	start := time.Now()
+	defer func() { run.DurationMs = time.Since(start).Milliseconds() }()
+	var err error
+	if run.Deleted, err = retentionBatches(deleteDue, now, deleteSMSRequests); err != nil {
+		return run, fmt.Errorf("Error deleting requests: %s", err)
+	}
+	if run.Redacted, err = retentionBatches(redactDue, now, redactSMSRequests); err != nil {
+		return run, fmt.Errorf("Error redacting requests: %s", err)
+	}
+	if err = redactWebhookPayloads(); err != nil {
+		return run, fmt.Errorf("Error redacting webhook payloads: %s", err)
+	}
+	return run, nil
+}
+
+// Pick up to a batch of due ids and hand them to apply until nothing is due. Applying takes them
+// out of the due set (deleted or marked redacted) so this always ends
+func retentionBatches(due func(tx *gorm.DB, at time.Time) *gorm.DB, now time.Time, apply func(tx *gorm.DB, ids []uuid.UUID, now time.Time) error) (int64, error) {
+	var total int64
+	for {
+		query := due(DB, now)
+		if query == nil {
+			return total, nil
+		}
+		var ids []uuid.UUID
+		if err := query.Order("finished_at ASC").Limit(retentionBatchSize).Pluck("id", &ids).Error; err != nil {
+			return total, err
+		}
+		if len(ids) == 0 {
+			return total, nil
+		}
+		if err := DB.Transaction(func(tx *gorm.DB) error { return apply(tx, ids, now) }); err != nil {
+			return total, err
+		}
+		total += int64(len(ids))
+	}
+}
+
+// The request and everything hanging off it. Replies keep their text, they just stop pointing here
+func deleteSMSRequests(tx *gorm.DB, ids []uuid.UUID, now time.Time) error {
+	if err := tx.Where("sms_request_id IN ?", ids).Delete(&Link{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("sms_request_id IN ?", ids).Delete(&FilterReview{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("sms_request_id IN ?", ids).Delete(&WebhookDelivery{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&InboundMessage{}).Where("in_reply_to IN ?", ids).Update("in_reply_to", nil).Error; err != nil {
+		return err
+	}
+	return tx.Where("id IN ?", ids).Delete(&SMSRequest{}).Error
+}
+
+// Blank the body and anything it could be rebuilt from (a hash of a 6 digit code isn't much of a secret)
+func redactedColumns(now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"message":     "",
+		"variables":   nil,
+		"body_hash":   "",
+		"redacted_at": now.Unix(),
+	}
+}
+
+// The original URL of a rewritten link says as much as the message did, the short link stops
+// working once it's gone
+func redactSMSRequests(tx *gorm.DB, ids []uuid.UUID, now time.Time) error {
+	if err := tx.Model(&SMSRequest{}).Where("id IN ?", ids).UpdateColumns(redactedColumns(now)).Error; err != nil {
+		return err
+	}
+	return tx.Model(&Link{}).Where("sms_request_id IN ?", ids).Update("url", "").Error
+}
+
+// An otp code is no use to anyone once the request is finished, so it goes right away instead of
+// waiting on a rule. Does nothing for any other priority
+func redactOTPSMSRequest(id string) {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&SMSRequest{}).Where("id = ? AND priority = ? AND "+notRedacted, id, constants.RequestPriority_OTP).
+			UpdateColumns(redactedColumns(time.Now()))
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return tx.Model(&Link{}).Where("sms_request_id = ?", id).Update("url", "").Error
+	})
+	if err != nil {
+		fmt.Printf("ERROR REDACTING OTP SMSREQUEST %s %s\n", id, err)
+	}
+}
+
+// Payloads of a redacted request's webhooks once they're sent or dead. Pending ones still need
+// theirs, the next sweep gets them
+func redactWebhookPayloads() error {
+	redacted := DB.Model(&SMSRequest{}).Select("id").Where("redacted_at > 0")
+	return DB.Model(&WebhookDelivery{}).
+		Where("status <> ? AND payload <> '' AND sms_request_id IN (?)", WebhookDeliveryStatus_PENDING, redacted).
+		Update("payload", "").Error
+}
@@ -0,0 +1,162 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"microsms/constants"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+/**
+Review queue for filter verdicts. Requests the filter blocked, errored on, held as borderline or
+the heuristics flagged sit here until an admin either approves them back onto the send path or
+confirms the block. Every decision gets its own FilterReview row so there's a record of who
+overturned what.
+**/
+
+type ReviewDecision string
+
+const (
+	ReviewDecision_APPROVE ReviewDecision = "approve" // false positive, send it after all
+	ReviewDecision_CONFIRM ReviewDecision = "confirm" // the filter was right, it stays blocked
+)
+
+var ErrSMSRequestNotUnderReview = errors.New("SMSRequest is not waiting on a review")
+
+// Retention already blanked the message, there's nothing left to approve and send
+var ErrSMSRequestRedacted = errors.New("SMSRequest message was redacted")
+
+// Statuses the filter can leave a request in
+var reviewableStatuses = []constants.RequestStatus{
+	constants.RequestStatus_HELD,
+	constants.RequestStatus_BLOCKED,
+	constants.RequestStatus_ERROR,
+}
+
+// One decision on one request
+type FilterReview struct {
+	ID           uuid.UUID               `json:"id" gorm:"primary_key"`
+	SMSRequestID uuid.UUID               `json:"smsrequest_id" gorm:"index;not null"`
+	Decision     ReviewDecision          `json:"decision"`
+	Reviewer     string                  `json:"reviewer,omitempty"`
+	Note         string                  `json:"note,omitempty"`
+	FromStatus   constants.RequestStatus `json:"from_status"`
+	ToStatus     constants.RequestStatus `json:"to_status"`
+	FilterReason string                  `json:"filter_reason"` // the verdict's reason at the time, in case it gets rechecked
+	Created      int64                   `json:"created" gorm:"autoCreateTime"`
+}
+
+func (review *FilterReview) BeforeCreate(tx *gorm.DB) error {
+	review.ID = uuid.New()
+	return nil
+}
+
+func IsValidReviewDecision(decision string) bool {
+	switch ReviewDecision(decision) {
+	case ReviewDecision_APPROVE, ReviewDecision_CONFIRM:
+		return true
+	}
+	return false
+}
+
+// Only requests the filter stopped (blocked, errored or flagged) that nobody has decided on yet.
+// The status alone isn't enough, opt outs and worker failures land in blocked and error too.
+// Rows from before these columns existed have NULLs in them, which <> and = never match
+func underReview(query *gorm.DB) *gorm.DB {
+	return query.Where("status IN ? AND (filter_blocked = ? OR filter_flagged = ? OR COALESCE(filter_error, '') <> '') AND COALESCE(review, '') = ''", reviewableStatuses, true, true)
+}
+
+// The queue, oldest first so nothing sits at the bottom forever
+func GetReviewQueue(limit int, offset int) ([]SMSRequest, error) {
+	var smsrequests []SMSRequest
+	err := underReview(DB.Model(&SMSRequest{})).Order("created ASC").Limit(limit).Offset(offset).Find(&smsrequests).Error
+	return smsrequests, err
+}
+
+// Decide on a request in the queue. Approve sends it on to whatever its opt ins say (same as
+// passing the filter), confirm leaves it blocked. The status change and the decision row go in
+// together and only if nobody else decided first
+func ReviewSMSRequest(id string, decision ReviewDecision, reviewer string, note string) (*SMSRequest, *FilterReview, error) {
+	uid, err := uuid.Parse(id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error invalid id %s", id)
+	}
+	if !IsValidReviewDecision(string(decision)) {
+		return nil, nil, fmt.Errorf("Error invalid decision %s", decision)
+	}
+	var smsrequest SMSRequest
+	if err = underReview(DB.Preload("ToOptIn").Preload("FromOptIn")).First(&smsrequest, "id = ?", uid).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrSMSRequestNotUnderReview
+		}
+		return nil, nil, err
+	}
+	review := FilterReview{
+		SMSRequestID: uid,
+		Decision:     decision,
+		Reviewer:     reviewer,
+		Note:         note,
+		FromStatus:   smsrequest.Status,
+		ToStatus:     constants.RequestStatus_BLOCKED,
+		FilterReason: smsrequest.Filter.Reason,
+	}
+	if decision == ReviewDecision_APPROVE {
+		if smsrequest.RedactedAt > 0 {
+			return nil, nil, fmt.Errorf("%w (redacted at %d)", ErrSMSRequestRedacted, smsrequest.RedactedAt)
+		}
+		review.ToStatus = optInRequestStatus(&smsrequest.FromOptIn, &smsrequest.ToOptIn)
+	}
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		// An approved request joins the recipient's queue now, so it has to fit under the caps
+		// like a fresh create would. Under defer the claim check holds it back instead
+		if review.ToStatus != constants.RequestStatus_BLOCKED && frequencyCapPolicy == FrequencyCapPolicy_REJECT && frequencyCapApplies(&smsrequest) {
+			if err := checkFrequencyCaps(tx, smsrequest.ToOptInID, smsrequest.ToOptIn.Number); err != nil {
+				return err
+			}
+		}
+		columns := statusColumns(review.ToStatus)
+		columns["review"] = decision
+		query := tx.Model(&SMSRequest{}).Where("id = ? AND status = ? AND COALESCE(review, '') = ''", uid, smsrequest.Status)
+		if decision == ReviewDecision_APPROVE {
+			query = query.Where(notRedacted) // retention could have got to it since it was loaded
+		}
+		result := query.Updates(columns)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrSMSRequestNotUnderReview
+		}
+		if review.ToStatus != constants.RequestStatus_BLOCKED {
+			if err := rewriteLinks(tx, uid); err != nil {
+				return err
+			}
+		}
+		return tx.Create(&review).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	fmt.Printf("SMS %s review %s by %q, %s -> %s\n", uid, decision, reviewer, review.FromStatus, review.ToStatus)
+	updated, err := GetSMSRequest(uid.String())
+	if err != nil {
+		return nil, &review, err
+	}
+	if review.FromStatus != review.ToStatus {
+		NotifyStatusChange(updated, string(review.ToStatus))
+	}
+	return updated, &review, nil
+}
+
+// Decision log, newest first. A nil id lists every decision
+func GetFilterReviews(smsrequestID *uuid.UUID, limit int, offset int) ([]FilterReview, error) {
+	var reviews []FilterReview
+	query := DB.Model(&FilterReview{})
+	if smsrequestID != nil {
+		query = query.Where("sms_request_id = ?", *smsrequestID)
+	}
+	err := query.Order("created DESC").Limit(limit).Offset(offset).Find(&reviews).Error
+	return reviews, err
+}
@@ -1,9 +1,17 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
+	"microsms/config"
 	"microsms/constants"
+	"slices"
+	"time"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
@@ -11,18 +19,102 @@ import (
 
 // SMSRequest definition
 type SMSRequest struct {
-	ID          uuid.UUID               `json:"id" gorm:"primary_key"`
-	ToNumber    string                  `json:"to_number" gorm:"not null"`
-	ToOptInID   uuid.UUID               `gorm:"index:toOpt_index;not null"`
-	FromOptInID uuid.UUID               `gorm:"index:fromOpt_index;not null"`
-	FromNumber  string                  `json:"from_number" gorm:"not null"`
-	Status      constants.RequestStatus `json:"status"`
-	Message     string                  `json:"message"`
-	Created     int64                   `json:"created" gorm:"autoCreateTime"`
+	ID          uuid.UUID                 `json:"id" gorm:"primary_key"`
+	ToNumber    string                    `json:"to_number" gorm:"not null"`
+	ToOptInID   uuid.UUID                 `gorm:"index:toOpt_index;not null"`
+	FromOptInID uuid.UUID                 `gorm:"index:fromOpt_index;not null"`
+	FromNumber  string                    `json:"from_number" gorm:"not null"`
+	Status      constants.RequestStatus   `json:"status" gorm:"index"`
+	FilterMode  constants.FilterMode      `json:"filter_mode"` // how the message was screened, disabled means it wasn't
+	Filter      FilterVerdict             `json:"filter_verdict" gorm:"embedded;embeddedPrefix:filter_"`
+	Review      ReviewDecision            `json:"review,omitempty" gorm:"index"` // what an admin made of the filter verdict, if anyone looked
+	Priority    constants.RequestPriority `json:"priority" gorm:"index"`         // otp > standard > bulk when handing out work
+	Message     string                    `json:"message"`
+	BodyHash    string                    `json:"-" gorm:"index"` // sha256 of the normalized message, for fan-out checks
+	Created     int64                     `json:"created" gorm:"autoCreateTime;index"`
+	Worker      string                    `json:"worker" gorm:"index"` // whichever worker marked it taken
+	TakenAt     int64                     `json:"taken_at"`
+	// Delivery tracking, milliseconds so the latency is worth looking at
+	SentAt            int64  `json:"sent_at_ms"`
+	DeliveredAt       int64  `json:"delivered_at_ms"`     // when the status report came back (delivered or not)
+	DeliveryPDUStatus *int   `json:"delivery_pdu_status"` // raw TP-Status from the last status report
+	DeliveryLatencyMs int64  `json:"delivery_latency_ms" gorm:"-"`
+	CallbackURL       string `json:"callback_url"` // optional, gets every status event for this request
+	ExpiresAt         int64  `json:"expires_at"`   // optional unix seconds, still pending by then means expired
+	// Encoding and parts the message goes out as, worked out on create
+	constants.SegmentInfo `gorm:"embedded"`
+	// Who sent it (from their API key) and the SMSFilter categories it was screened with
+	Client           string          `json:"client" gorm:"index"`
+	FilterCategories map[string]bool `json:"filter_categories,omitempty" gorm:"serializer:json"`
+	// Sent from a template, the message is rendered from it and skips the content filter
+	TemplateID *uuid.UUID        `json:"template_id" gorm:"index"`
+	Variables  map[string]string `json:"variables,omitempty" gorm:"serializer:json"`
+	// When it reached a finished status and when retention blanked the message (unix seconds),
+	// retention ages requests from the first, see Retention.go
+	FinishedAt int64 `json:"finished_at,omitempty" gorm:"index"`
+	RedactedAt int64 `json:"redacted_at,omitempty"`
+	// Links rewritten to go through /l/<code>, with their clicks
+	Links []Link `json:"links,omitempty"`
 
 	// Define the association to OptIn
 	ToOptIn   OptIn `gorm:"references:ID"`
 	FromOptIn OptIn `gorm:"references:ID"`
+
+	// Set on a request handed to a worker, the only place an otp message is shown
+	forWorker bool
+}
+
+// JSON is what API responses and webhook payloads are built from, so an otp code is blanked
+// here unless the request is going to the worker that sends it
+func (smsrequest SMSRequest) MarshalJSON() ([]byte, error) {
+	type plain SMSRequest // no methods, so no recursion
+	if smsrequest.Priority == constants.RequestPriority_OTP && !smsrequest.forWorker {
+		smsrequest.Message = ""
+		smsrequest.Variables = nil
+	}
+	return json.Marshal(plain(smsrequest))
+}
+
+var smsConfig config.SMSConfig
+
+// SetMessageLimits sets the segment limit config from main
+func SetMessageLimits(cfg config.SMSConfig) {
+	if cfg.OversizeAction == "" {
+		cfg.OversizeAction = constants.OversizeAction_REJECT
+	}
+	smsConfig = cfg
+}
+
+// Transliterate if we're set to, work out the segments and apply the max segment policy
+func prepareMessage(smsrequest *SMSRequest) error {
+	if smsConfig.Transliterate {
+		smsrequest.Message = constants.TransliterateGSM7(smsrequest.Message)
+	}
+	info := constants.GetSegmentInfo(smsrequest.Message)
+	if smsConfig.MaxSegments > 0 && info.Segments > smsConfig.MaxSegments {
+		if smsConfig.OversizeAction != constants.OversizeAction_TRUNCATE {
+			return fmt.Errorf("Error message is %d %s segments, max is %d", info.Segments, info.Encoding, smsConfig.MaxSegments)
+		}
+		smsrequest.Message = constants.TruncateToSegments(smsrequest.Message, smsConfig.MaxSegments)
+		info = constants.GetSegmentInfo(smsrequest.Message)
+	}
+	smsrequest.SegmentInfo = info
+	return nil
+}
+
+// Called after a request changes status. Main points this at the webhook queue, models just
+// needs to say something happened
+var statusChangeHandler func(smsrequest *SMSRequest, event string)
+
+func SetStatusChangeHandler(handler func(smsrequest *SMSRequest, event string)) {
+	statusChangeHandler = handler
+}
+
+// Fire the status change handler, event is usually just the new status
+func NotifyStatusChange(smsrequest *SMSRequest, event string) {
+	if statusChangeHandler != nil && smsrequest != nil {
+		statusChangeHandler(smsrequest, event)
+	}
 }
 
 // This should never happen, but hey if it does we can at least log something
@@ -46,7 +138,19 @@ func (smsrequest *SMSRequest) FromNumberF() string {
 
 // To String my struct
 func (smsrequest SMSRequest) String() string {
-	return fmt.Sprintf("SMSRequest{ ID: %s, Status: %s, Message: %s}", smsrequest.ID, smsrequest.Status, smsrequest.Message)
+	message := smsrequest.Message
+	if smsrequest.Priority == constants.RequestPriority_OTP {
+		message = "<redacted>" // keep codes out of the logs
+	}
+	return fmt.Sprintf("SMSRequest{ ID: %s, Status: %s, Priority: %s, Message: %s}", smsrequest.ID, smsrequest.Status, smsrequest.Priority, message)
+}
+
+// Fill in the derived delivery latency whenever we load a request
+func (smsrequest *SMSRequest) AfterFind(tx *gorm.DB) error {
+	if smsrequest.SentAt > 0 && smsrequest.DeliveredAt >= smsrequest.SentAt {
+		smsrequest.DeliveryLatencyMs = smsrequest.DeliveredAt - smsrequest.SentAt
+	}
+	return nil
 }
 
 // Good old precreate hook to populate the id
@@ -63,66 +167,344 @@ func (smsrequest *SMSRequest) BeforeCreate(tx *gorm.DB) error {
 		return fmt.Errorf("Error invalid to phone number %s", smsrequest.ToNumber)
 	}
 	smsrequest.ID = uuid.New()
-	if fromOptIn, err = FindOrCreateOptIn(fNumberF); err != nil {
+	optInDB := tx.Session(&gorm.Session{NewDB: true})
+	if fromOptIn, err = findOrCreateOptIn(optInDB, fNumberF); err != nil {
 		return fmt.Errorf("Error with from opt in %s", err)
 	}
-	if toOptIn, err = FindOrCreateOptIn(tNumberF); err != nil {
+	if toOptIn, err = findOrCreateOptIn(optInDB, tNumberF); err != nil {
 		return fmt.Errorf("Error with to opt in %s", err)
 	}
 	smsrequest.ToOptInID = toOptIn.ID
 	smsrequest.FromOptInID = fromOptIn.ID
-	// Check all of our opt in statuses to determine initial request status
+	// Check all of our opt in statuses to determine initial request status, anything that still
+	// needs screening waits on the filter first and gets its opt in looked at again after
+	smsrequest.Status = optInRequestStatus(fromOptIn, toOptIn)
+	if smsrequest.FilterMode == constants.FilterMode_FILTER && smsrequest.Status != constants.RequestStatus_BLOCKED {
+		smsrequest.Status = constants.RequestStatus_FILTER_CHECK
+	}
+	if slices.Contains(FinishedStatuses, smsrequest.Status) {
+		smsrequest.FinishedAt = time.Now().Unix() // blocked before it ever went anywhere
+	}
+
+	return nil
+}
+
+// sha256 of the normalized message, the same text sent over and over hashes the same
+func messageBodyHash(message string) string {
+	hash := sha256.Sum256([]byte(constants.NormalizeMessage(message)))
+	return hex.EncodeToString(hash[:])
+}
+
+// Columns for moving a request to newStatus, a finished one gets stamped so retention knows how
+// long it's been done with
+func statusColumns(newStatus constants.RequestStatus) map[string]interface{} {
+	columns := map[string]interface{}{"status": newStatus}
+	if slices.Contains(FinishedStatuses, newStatus) {
+		columns["finished_at"] = time.Now().Unix()
+	}
+	return columns
+}
+
+// Where a request should sit given both ends' opt in statuses
+func optInRequestStatus(fromOptIn *OptIn, toOptIn *OptIn) constants.RequestStatus {
 	if fromOptIn.Status == constants.OptInStatus_FALSE || toOptIn.Status == constants.OptInStatus_FALSE {
-		smsrequest.Status = constants.RequestStatus_BLOCKED
+		return constants.RequestStatus_BLOCKED
 	} else if fromOptIn.Status == constants.OptInStatus_ASK || toOptIn.Status == constants.OptInStatus_ASK {
-		smsrequest.Status = constants.RequestStatus_VERIFY_CHECK
-	} else if fromOptIn.Status == constants.OptInStatus_TRUE && toOptIn.Status == constants.OptInStatus_TRUE {
-		smsrequest.Status = constants.RequestStatus_READY_TO_SEND
+		return constants.RequestStatus_VERIFY_CHECK
 	}
+	return constants.RequestStatus_READY_TO_SEND
+}
 
-	return nil
+var filterEnabled = true
+
+// SetFilterEnabled sets whether new requests go through the content filter, from main
+func SetFilterEnabled(enabled bool) {
+	filterEnabled = enabled
 }
 
-// Method to create new SMSRequest
+// Filter passed (or wasn't needed), move the request on to whatever its opt ins say and rewrite
+// its links. Only moves requests still in filter_check so a cancel mid check sticks
+func PassFilter(id string) (*SMSRequest, bool, error) {
+	var smsrequest SMSRequest
+	if err := DB.Preload("ToOptIn").Preload("FromOptIn").First(&smsrequest, "id = ?", id).Error; err != nil {
+		return nil, false, err
+	}
+	newStatus := optInRequestStatus(&smsrequest.FromOptIn, &smsrequest.ToOptIn)
+	moved := false
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&SMSRequest{}).Where("id = ? AND status = ?", id, constants.RequestStatus_FILTER_CHECK).Updates(statusColumns(newStatus))
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		moved = true
+		if newStatus == constants.RequestStatus_BLOCKED {
+			return nil // opted out meanwhile, not going anywhere
+		}
+		return rewriteLinks(tx, smsrequest.ID)
+	})
+	if err != nil {
+		fmt.Printf("ERROR MOVING SMSREQUEST %s TO %s, %s\n", id, newStatus, err)
+		return nil, false, err
+	}
+	updated, err := GetSMSRequest(id)
+	if err != nil {
+		return nil, false, err
+	}
+	if moved {
+		NotifyStatusChange(updated, string(newStatus))
+	}
+	return updated, moved, nil
+}
+
+// Requests still in filter_check that were created before the cutoff (unix seconds), oldest first.
+// These are the ones held while a filter API was down (or left over from a restart)
+func GetStaleFilterChecks(before int64, limit int) ([]SMSRequest, error) {
+	var smsrequests []SMSRequest
+	err := DB.Where("status = ? AND created < ?", constants.RequestStatus_FILTER_CHECK, before).Order("created ASC").Limit(limit).Find(&smsrequests).Error
+	return smsrequests, err
+}
+
+// How many different numbers got this body since the cutoff (unix seconds), counting the request
+// being checked
+func CountBodyRecipients(bodyHash string, since int64) (int64, error) {
+	var count int64
+	err := DB.Model(&SMSRequest{}).Distinct("to_opt_in_id").Where("body_hash = ? AND created >= ?", bodyHash, since).Count(&count).Error
+	return count, err
+}
+
+// How many requests a sender made since the cutoff (unix seconds), counting the request being checked
+func CountSenderRequests(fromOptInID uuid.UUID, since int64) (int64, error) {
+	var count int64
+	err := DB.Model(&SMSRequest{}).Where("from_opt_in_id = ? AND created >= ?", fromOptInID, since).Count(&count).Error
+	return count, err
+}
+
+// Method to create new SMSRequest. Whatever filter_mode the client sent is ignored, it comes
+// from how the message was made
 func CreateSMSRequest(smsrequest *SMSRequest) error {
+	return createSMSRequest(smsrequest, "")
+}
+
+func createSMSRequest(smsrequest *SMSRequest, filterMode constants.FilterMode) error {
+	switch {
+	case filterMode != "":
+	case smsrequest.TemplateID != nil:
+		filterMode = constants.FilterMode_TEMPLATE
+	case filterEnabled:
+		filterMode = constants.FilterMode_FILTER
+	default:
+		filterMode = constants.FilterMode_DISABLED
+	}
+	smsrequest.FilterMode = filterMode
+	smsrequest.Filter = FilterVerdict{} // only the filter gets to fill this in
+	smsrequest.Review = ""
+	// The rest belongs to workers, delivery reports and retention, whatever the client bound is dropped
+	smsrequest.Created = 0
+	smsrequest.Worker = ""
+	smsrequest.TakenAt = 0
+	smsrequest.SentAt = 0
+	smsrequest.DeliveredAt = 0
+	smsrequest.DeliveryPDUStatus = nil
+	smsrequest.FinishedAt = 0
+	smsrequest.RedactedAt = 0
+	smsrequest.Links = nil
+	smsrequest.ToOptIn = OptIn{}
+	smsrequest.FromOptIn = OptIn{}
+	if err := resolveFilterCategories(smsrequest); err != nil {
+		return err
+	}
+	if smsrequest.TemplateID != nil {
+		if err := applyTemplate(smsrequest); err != nil {
+			return err
+		}
+	}
 	if smsrequest.Message == "" {
 		return fmt.Errorf("Error invalid message %s", smsrequest.Message)
 	}
+	if err := checkLinks(smsrequest.Message); err != nil {
+		return err
+	}
+	if err := prepareMessage(smsrequest); err != nil {
+		return err
+	}
+	smsrequest.BodyHash = messageBodyHash(smsrequest.Message)
+	// Nothing is going to screen it, so its links can be rewritten right away
+	if filterMode != constants.FilterMode_FILTER {
+		message, links, err := shortenLinks(smsrequest.Message)
+		if err != nil {
+			return err
+		}
+		if len(links) > 0 {
+			smsrequest.Message, smsrequest.Links = message, links
+			smsrequest.SegmentInfo = constants.GetSegmentInfo(message)
+		}
+	}
 	if !constants.IsValidPhone((smsrequest.ToNumber)) {
 		return fmt.Errorf("Error invalid to phone number %s", smsrequest.ToNumber)
 	}
 	if !constants.IsValidPhone(smsrequest.FromNumber) { // Get the raw numbers on purpose
 		return fmt.Errorf("Error invalid from phone number %s", smsrequest.FromNumber)
 	}
-	result := DB.Create(smsrequest)
-	if result.Error != nil {
-		fmt.Println("Error creating SMS Request:", result.Error)
-		return result.Error
+	if smsrequest.Priority == "" {
+		smsrequest.Priority = constants.RequestPriority_STANDARD
+	}
+	if !constants.IsValidRequestPriority(string(smsrequest.Priority)) {
+		return fmt.Errorf("Error invalid priority %s", smsrequest.Priority)
+	}
+	if smsrequest.CallbackURL != "" {
+		if err := ValidateCallbackURL(smsrequest.CallbackURL); err != nil {
+			return err
+		}
+	}
+	if smsrequest.ExpiresAt < 0 || (smsrequest.ExpiresAt > 0 && smsrequest.ExpiresAt <= time.Now().Unix()) {
+		return fmt.Errorf("Error expires_at %d is already in the past", smsrequest.ExpiresAt)
+	}
+	if err := createWithFrequencyCap(smsrequest); err != nil {
+		fmt.Println("Error creating SMS Request:", err)
+		return err
 	}
 	fmt.Println("Create new SMS Request: ", smsrequest)
+	NotifyStatusChange(smsrequest, string(smsrequest.Status))
 	return nil
 }
 
-// Update SMSRequest with new status
-func UpdateSMSRequest(id string, newStatus constants.RequestStatus) (*SMSRequest, error) {
-	if !constants.IsValidRequestStatus(string(newStatus)) {
-		return nil, fmt.Errorf("Error invalid status %s", newStatus)
+// Returned when a worker's PATCH doesn't fit where the request is, say it was cancelled first
+var ErrSMSRequestNotUpdatable = errors.New("SMSRequest can't move to that status from where it is")
+
+// Returned when a worker reports on a request some other worker has taken
+var ErrSMSRequestNotClaimed = errors.New("SMSRequest is taken by another worker")
+
+// Where a worker can move a request it has taken. Everything else (cancelled, blocked, expired,
+// held, delivered...) is decided somewhere else and a PATCH never moves a request out of it
+var workerTransitions = map[constants.RequestStatus][]constants.RequestStatus{
+	constants.RequestStatus_SENT:  {constants.RequestStatus_TAKEN},
+	constants.RequestStatus_ERROR: {constants.RequestStatus_TAKEN},
+}
+
+// Update SMSRequest with the status a worker reports. Goes through a conditional UPDATE like
+// every other transition, so a cancel that got in first sticks, and only the worker that took
+// the request can report on it
+func UpdateSMSRequest(id string, newStatus constants.RequestStatus, worker string) (*SMSRequest, error) {
+	from, ok := workerTransitions[newStatus]
+	if !ok {
+		return nil, fmt.Errorf("Error invalid status %s, workers can only mark a request sent or error", newStatus)
+	}
+	updates := statusColumns(newStatus)
+	if newStatus == constants.RequestStatus_SENT {
+		updates["sent_at"] = time.Now().UnixMilli()
+	}
+	result := DB.Model(&SMSRequest{}).Where("id = ? AND status IN ? AND worker = ?", id, from, worker).Updates(updates)
+	if result.Error != nil {
+		fmt.Printf("ERROR UPDATING SMSREQUEST %s, %s\n", id, result.Error)
+		return nil, result.Error
+	}
+	if result.RowsAffected > 0 {
+		redactOTPSMSRequest(id)
 	}
 	smsrequest, err := GetSMSRequest(id)
 	if err != nil {
-		fmt.Printf("ERROR UPDATING SMSREQUEST %s, %s", id, err)
 		return nil, err
 	}
-	if smsrequest == nil {
-		fmt.Printf("ERROR COULD NOT FIND SMSREQUEST TO UPDATE %s", id)
-		return nil, errors.New("COULD NOT FIND RECORD")
+	if result.RowsAffected == 0 {
+		if slices.Contains(from, smsrequest.Status) && smsrequest.Worker != worker {
+			return nil, fmt.Errorf("%w (status %s)", ErrSMSRequestNotClaimed, smsrequest.Status)
+		}
+		return smsrequest, fmt.Errorf("%w (status %s)", ErrSMSRequestNotUpdatable, smsrequest.Status)
+	}
+	NotifyStatusChange(smsrequest, string(newStatus))
+	return smsrequest, nil
+}
+
+// Returned when a cancel loses the race to a worker (or the request is already done)
+var ErrSMSRequestNotCancellable = errors.New("SMSRequest can no longer be cancelled")
+
+// Statuses a request sits in before a worker picks it up. A client can still pull a request
+// back from here, anything past this point belongs to a worker (or is already finished)
+var PendingStatuses = []constants.RequestStatus{
+	constants.RequestStatus_FILTER_CHECK,
+	constants.RequestStatus_HELD,
+	constants.RequestStatus_VERIFY_CHECK,
+	constants.RequestStatus_READY_TO_SEND,
+}
+
+// Cancel a request that hasn't been picked up yet. The status check and update happen in
+// a single UPDATE so a worker grabbing the request at the same time can't slip between them
+func CancelSMSRequest(id string) (*SMSRequest, error) {
+	uid, err := uuid.Parse(id)
+	if err != nil {
+		return nil, fmt.Errorf("Error invalid id %s", id)
+	}
+	smsrequest, moved, err := TransitionSMSRequest(uid.String(), PendingStatuses, constants.RequestStatus_CANCELLED)
+	if err != nil {
+		return nil, err
+	}
+	if !moved {
+		return smsrequest, fmt.Errorf("%w (status %s)", ErrSMSRequestNotCancellable, smsrequest.Status)
 	}
-	smsrequest.Status = newStatus
-	err = DB.Save(smsrequest).Error
+	return smsrequest, nil
+}
+
+// Move a request to newStatus only if it is currently in one of the from statuses. Returns the
+// fresh record and whether the move happened, used anywhere a background job and a client or
+// worker could be fighting over the same row
+func TransitionSMSRequest(id string, from []constants.RequestStatus, newStatus constants.RequestStatus) (*SMSRequest, bool, error) {
+	if !constants.IsValidRequestStatus(string(newStatus)) {
+		return nil, false, fmt.Errorf("Error invalid status %s", newStatus)
+	}
+	result := DB.Model(&SMSRequest{}).Where("id = ? AND status IN ?", id, from).Updates(statusColumns(newStatus))
+	if result.Error != nil {
+		fmt.Printf("ERROR MOVING SMSREQUEST %s TO %s, %s\n", id, newStatus, result.Error)
+		return nil, false, result.Error
+	}
+	if result.RowsAffected > 0 && slices.Contains(FinishedStatuses, newStatus) {
+		redactOTPSMSRequest(id)
+	}
+	smsrequest, err := GetSMSRequest(id)
+	if err != nil {
+		return nil, false, err
+	}
+	moved := result.RowsAffected > 0
+	if moved {
+		NotifyStatusChange(smsrequest, string(newStatus))
+	}
+	return smsrequest, moved, nil
+}
+
+// Returned when a delivery report shows up for a request that isn't out on the network
+var ErrSMSRequestNotAwaitingDelivery = errors.New("SMSRequest is not waiting on a delivery report")
+
+// Record a status report from a worker. Reports in the SMSC retry range just get stored, the
+// first final report moves the request to delivered/undelivered. reportedAt is unix millis, 0
+// means now
+func RecordDeliveryReport(id string, pduStatus int, reportedAt int64) (*SMSRequest, error) {
+	if reportedAt <= 0 {
+		reportedAt = time.Now().UnixMilli()
+	}
+	updates := map[string]interface{}{"delivery_pdu_status": pduStatus}
+	// Lost sent PATCHes happen (phone drops wifi), so a report for a taken request still counts
+	from := []constants.RequestStatus{constants.RequestStatus_TAKEN, constants.RequestStatus_SENT}
+	if newStatus, final := constants.RequestStatusFromPDUStatus(pduStatus); final {
+		maps.Copy(updates, statusColumns(newStatus))
+		updates["delivered_at"] = reportedAt
+	}
+	result := DB.Model(&SMSRequest{}).Where("id = ? AND status IN ?", id, from).Updates(updates)
+	if result.Error != nil {
+		fmt.Printf("ERROR RECORDING DELIVERY REPORT %s, %s\n", id, result.Error)
+		return nil, result.Error
+	}
+	if result.RowsAffected > 0 {
+		redactOTPSMSRequest(id) // a report means the text is out, even if the sent PATCH got lost
+	}
+	smsrequest, err := GetSMSRequest(id)
 	if err != nil {
-		fmt.Printf("ERROR SAVING UPDATE TO DB %s", err)
 		return nil, err
 	}
+	if result.RowsAffected == 0 {
+		return smsrequest, fmt.Errorf("%w (status %s)", ErrSMSRequestNotAwaitingDelivery, smsrequest.Status)
+	}
+	if _, final := updates["status"]; final {
+		NotifyStatusChange(smsrequest, string(smsrequest.Status))
+	}
 	return smsrequest, nil
 }
 
@@ -131,7 +513,7 @@ func GetSMSRequest(id string) (*SMSRequest, error) {
 	fmt.Printf("GET SMSREQUEST BY ID %s\n", id)
 	smsrequest := SMSRequest{}
 	uid := uuid.MustParse(id)
-	result := DB.First(&smsrequest, uid)
+	result := DB.Preload("Links").First(&smsrequest, uid)
 	if result.Error != nil {
 		fmt.Printf("ERROR FINDING SMSREQUEST %s\n", result.Error)
 		return nil, result.Error
@@ -139,15 +521,262 @@ func GetSMSRequest(id string) (*SMSRequest, error) {
 	return &smsrequest, nil
 }
 
-// Get the earliest ready_to_send record
-func GetEarliestSMSRequest() (*SMSRequest, error) {
-	fmt.Printf("GET EARLIEST SMSREQUEST")
-	var earliest SMSRequest
-	result := DB.Model(&SMSRequest{}).Where(&SMSRequest{Status: constants.RequestStatus_READY_TO_SEND}).Order("created ASC").First(&earliest)
+// Expire anything still pending past its expires_at. Goes one by one through the transition so
+// each expiry fires its own event (and a request a worker just grabbed is left alone)
+func ExpireStaleSMSRequests() {
+	var ids []uuid.UUID
+	err := DB.Model(&SMSRequest{}).Where("status IN ? AND expires_at > 0 AND expires_at <= ?", PendingStatuses, time.Now().Unix()).Pluck("id", &ids).Error
+	if err != nil {
+		fmt.Printf("ERROR FINDING EXPIRED SMSREQUESTS %s\n", err)
+		return
+	}
+	for _, id := range ids {
+		if _, _, err = TransitionSMSRequest(id.String(), PendingStatuses, constants.RequestStatus_EXPIRED); err != nil {
+			fmt.Printf("ERROR EXPIRING SMSREQUEST %s %s\n", id, err)
+		}
+	}
+}
+
+// Work goes out by priority lane first, then oldest first inside a lane
+const priorityOrder = "CASE priority WHEN 'otp' THEN 0 WHEN 'bulk' THEN 2 ELSE 1 END ASC, created ASC"
+
+// How many ready requests we look through per poll when the front of the queue is held back
+const claimScanSize = 100
+
+// Says how long a request has to wait before a worker can have it, 0 means go. Main points this
+// at quiet hours plus the send throttle. A 0 reserves whatever the check counts (throttle tokens),
+// claimRelease hands it back when the request didn't end up claimed after all
+var claimCheck func(smsrequest *SMSRequest) time.Duration
+var claimRelease func(smsrequest *SMSRequest)
+
+func SetClaimCheck(check func(smsrequest *SMSRequest) time.Duration, release func(smsrequest *SMSRequest)) {
+	claimCheck = check
+	claimRelease = release
+}
+
+func releaseClaim(smsrequest *SMSRequest) {
+	if claimCheck != nil && claimRelease != nil {
+		claimRelease(smsrequest)
+	}
+}
+
+// Every ready request was held back, RetryAfter is the soonest one frees up
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (err *ThrottledError) Error() string {
+	return fmt.Sprintf("all ready SMSRequests are held back, retry in %s", err.RetryAfter)
+}
+
+// The front of the ready queue, in the order work goes out
+func readySMSRequests(tx *gorm.DB) ([]SMSRequest, error) {
+	var candidates []SMSRequest
+	err := tx.Model(&SMSRequest{}).Preload("ToOptIn").Where(&SMSRequest{Status: constants.RequestStatus_READY_TO_SEND}).Order(priorityOrder).Limit(claimScanSize).Find(&candidates).Error
+	return candidates, err
+}
+
+// Hand out the earliest ready_to_send request the claim check lets through (held back ones are
+// skipped and stay ready_to_send), marked taken by worker before anyone else can see it, so any
+// number of workers can poll at once without sending the same text twice. The
+// candidates are read FOR UPDATE SKIP LOCKED where the database has it, everywhere the UPDATE
+// only goes through if the request is still ready_to_send. An empty queue is an empty request
+func ClaimSMSRequest(worker string) (*SMSRequest, error) {
+	ExpireStaleSMSRequests()
+	var claimed *SMSRequest
+	var retryAfter time.Duration
+	err := lockingTransaction(func(tx *gorm.DB) error {
+		candidates, err := readySMSRequests(skipLocked(tx))
+		if err != nil {
+			return err
+		}
+		for i := range candidates {
+			if claimCheck != nil {
+				if wait := claimCheck(&candidates[i]); wait > 0 {
+					if retryAfter == 0 || wait < retryAfter {
+						retryAfter = wait
+					}
+					continue
+				}
+			}
+			takenAt := time.Now().Unix()
+			result := tx.Model(&SMSRequest{}).Where("id = ? AND status = ?", candidates[i].ID, constants.RequestStatus_READY_TO_SEND).
+				Updates(map[string]interface{}{"status": constants.RequestStatus_TAKEN, "worker": worker, "taken_at": takenAt})
+			if result.Error != nil {
+				releaseClaim(&candidates[i])
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				releaseClaim(&candidates[i])
+				continue // another worker got there first
+			}
+			claimed = &candidates[i]
+			claimed.Status = constants.RequestStatus_TAKEN
+			claimed.Worker = worker
+			claimed.TakenAt = takenAt
+			return nil
+		}
+		return nil
+	})
+	if err != nil {
+		if claimed != nil {
+			releaseClaim(claimed) // the commit didn't go through
+		}
+		fmt.Printf("ERROR CLAIMING SMSREQUEST FOR %s, %s\n", worker, err)
+		return nil, err
+	}
+	if claimed != nil {
+		// The event goes to webhooks and the delivery log, only the copy going back to the worker
+		// gets to show the code
+		NotifyStatusChange(claimed, string(constants.RequestStatus_TAKEN))
+		claimed.forWorker = true
+		return claimed, nil
+	}
+	if retryAfter > 0 {
+		return nil, &ThrottledError{RetryAfter: retryAfter}
+	}
+	return &SMSRequest{}, nil
+}
+
+// Columns the list endpoint is allowed to sort on, keep them to int64 columns so the cursor stays simple
+var sortableColumns = map[string]string{
+	"created":  "created",
+	"taken_at": "taken_at",
+}
+
+const (
+	DefaultListLimit = 50
+	MaxListLimit     = 500
+)
+
+// Everything the list endpoint can filter/sort/page on. Zero values mean "don't care"
+type SMSRequestFilter struct {
+	Statuses      []constants.RequestStatus
+	ToNumber      string // matched through the opt in record so formatting doesn't matter
+	FromNumber    string
+	Worker        string
+	CreatedAfter  int64 // inclusive unix seconds
+	CreatedBefore int64 // exclusive unix seconds
+	Sort          string
+	Descending    bool
+	Limit         int
+	Cursor        string
+}
+
+// What we stuff into the opaque cursor, the sort value + id of the last row on the page
+type listCursor struct {
+	Sort  string    `json:"s"`
+	Value int64     `json:"v"`
+	ID    uuid.UUID `json:"id"`
+}
+
+func encodeListCursor(cursor listCursor) string {
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeListCursor(encoded string) (*listCursor, error) {
+	var cursor listCursor
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Error invalid cursor %s", encoded)
+	}
+	if err = json.Unmarshal(raw, &cursor); err != nil {
+		return nil, fmt.Errorf("Error invalid cursor %s", encoded)
+	}
+	return &cursor, nil
+}
+
+// Sort value for a row, has to line up with sortableColumns
+func (smsrequest *SMSRequest) sortValue(sort string) int64 {
+	switch sort {
+	case "taken_at":
+		return smsrequest.TakenAt
+	default:
+		return smsrequest.Created
+	}
+}
+
+// List requests matching the filter using keyset (cursor) pagination. Returns the page and the
+// cursor for the next one, the cursor is empty once we run out of rows
+func ListSMSRequests(filter SMSRequestFilter) ([]SMSRequest, string, error) {
+	var smsrequests []SMSRequest
+	if filter.Sort == "" {
+		filter.Sort = "created"
+	}
+	column, ok := sortableColumns[filter.Sort]
+	if !ok {
+		return nil, "", fmt.Errorf("Error invalid sort %s", filter.Sort)
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = DefaultListLimit
+	}
+	if filter.Limit > MaxListLimit {
+		filter.Limit = MaxListLimit
+	}
+
+	query := DB.Model(&SMSRequest{})
+	if len(filter.Statuses) > 0 {
+		for _, status := range filter.Statuses {
+			if !constants.IsValidRequestStatus(string(status)) {
+				return nil, "", fmt.Errorf("Error invalid status %s", status)
+			}
+		}
+		query = query.Where("status IN ?", filter.Statuses)
+	}
+	// Numbers are stored however the client sent them, the opt in record holds the normalized one
+	if filter.ToNumber != "" {
+		number, err := constants.GetPhone(filter.ToNumber)
+		if err != nil {
+			return nil, "", err
+		}
+		query = query.Where("to_opt_in_id IN (?)", DB.Model(&OptIn{}).Select("id").Where("number = ?", number))
+	}
+	if filter.FromNumber != "" {
+		number, err := constants.GetPhone(filter.FromNumber)
+		if err != nil {
+			return nil, "", err
+		}
+		query = query.Where("from_opt_in_id IN (?)", DB.Model(&OptIn{}).Select("id").Where("number = ?", number))
+	}
+	if filter.Worker != "" {
+		query = query.Where("worker = ?", filter.Worker)
+	}
+	if filter.CreatedAfter > 0 {
+		query = query.Where("created >= ?", filter.CreatedAfter)
+	}
+	if filter.CreatedBefore > 0 {
+		query = query.Where("created < ?", filter.CreatedBefore)
+	}
+
+	// Keyset pagination, ties on the sort column are broken by id so pages never overlap
+	direction, comparison := "ASC", ">"
+	if filter.Descending {
+		direction, comparison = "DESC", "<"
+	}
+	if filter.Cursor != "" {
+		cursor, err := decodeListCursor(filter.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		if cursor.Sort != filter.Sort {
+			return nil, "", fmt.Errorf("Error cursor was issued for sort %s not %s", cursor.Sort, filter.Sort)
+		}
+		query = query.Where(fmt.Sprintf("((%s %s ?) OR (%s = ? AND id %s ?))", column, comparison, column, comparison), cursor.Value, cursor.Value, cursor.ID)
+	}
+	// Grab one extra row so we know if there is another page without a count query
+	result := query.Order(fmt.Sprintf("%s %s, id %s", column, direction, direction)).Limit(filter.Limit + 1).Find(&smsrequests)
 	if result.Error != nil {
-		fmt.Printf("Error finding ready to send SMS")
+		fmt.Printf("ERROR LISTING SMSREQUESTS %s\n", result.Error)
+		return nil, "", result.Error
+	}
+	nextCursor := ""
+	if len(smsrequests) > filter.Limit {
+		smsrequests = smsrequests[:filter.Limit]
+		last := smsrequests[len(smsrequests)-1]
+		nextCursor = encodeListCursor(listCursor{Sort: filter.Sort, Value: last.sortValue(filter.Sort), ID: last.ID})
 	}
-	return &earliest, nil
+	return smsrequests, nextCursor, nil
 }
 
 // Based on the optin status
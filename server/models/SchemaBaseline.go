@@ -0,0 +1,195 @@
+package models
+
+import (
+	"github.com/google/uuid"
+)
+
+/**
+The schema as migration 1 creates it, frozen. The baseline AutoMigrates these snapshots instead
+of the live models, so a field added to a model later can't sneak into it and a fresh database
+goes through exactly the same steps an upgraded one did. Never change anything in here, add a
+migration instead. Only the column types, gorm tags and table names matter, json tags are left off.
+**/
+
+type baselineFilterVerdict struct {
+	Blocked            bool
+	Allowed            bool
+	Reason             string
+	IncludedCategories []string `gorm:"serializer:json"`
+	ExcludedCategories []string `gorm:"serializer:json"`
+	Backend            string
+	Model              string
+	Error              string
+	LatencyMs          int64
+	CheckedAt          int64
+	Cached             bool
+	Score              int
+	Flags              []string `gorm:"serializer:json"`
+	Flagged            bool
+}
+
+type baselineSegmentInfo struct {
+	Encoding      string
+	Characters    int
+	SegmentLength int
+	Segments      int
+}
+
+type baselineOptIn struct {
+	ID       uuid.UUID `gorm:"primary_key"`
+	Number   string    `gorm:"uniqueIndex;size:32"`
+	Codeword string
+	Status   string `gorm:"not null"`
+	Timezone string
+	Created  int64 `gorm:"autoCreateTime"`
+	Updated  int64 `gorm:"autoUpdateTime"`
+}
+
+func (baselineOptIn) TableName() string { return "opt_ins" }
+
+type baselineSMSRequest struct {
+	ID                uuid.UUID `gorm:"primary_key"`
+	ToNumber          string    `gorm:"not null"`
+	ToOptInID         uuid.UUID `gorm:"index:toOpt_index;not null"`
+	FromOptInID       uuid.UUID `gorm:"index:fromOpt_index;not null"`
+	FromNumber        string    `gorm:"not null"`
+	Status            string    `gorm:"index"`
+	FilterMode        string
+	Filter            baselineFilterVerdict `gorm:"embedded;embeddedPrefix:filter_"`
+	Review            string                `gorm:"index"`
+	Priority          string                `gorm:"index"`
+	Message           string
+	BodyHash          string `gorm:"index"`
+	Created           int64  `gorm:"autoCreateTime;index"`
+	Worker            string `gorm:"index"`
+	TakenAt           int64
+	SentAt            int64
+	DeliveredAt       int64
+	DeliveryPDUStatus *int
+	CallbackURL       string
+	ExpiresAt         int64
+	SegmentInfo       baselineSegmentInfo `gorm:"embedded"`
+	Client            string              `gorm:"index"`
+	FilterCategories  map[string]bool     `gorm:"serializer:json"`
+	TemplateID        *uuid.UUID          `gorm:"index"`
+	Variables         map[string]string   `gorm:"serializer:json"`
+	Links             []baselineLink      `gorm:"foreignKey:SMSRequestID"`
+	ToOptIn           baselineOptIn       `gorm:"references:ID"`
+	FromOptIn         baselineOptIn       `gorm:"references:ID"`
+}
+
+func (baselineSMSRequest) TableName() string { return "sms_requests" }
+
+type baselineInboundMessage struct {
+	ID         uuid.UUID `gorm:"primary_key"`
+	FromNumber string    `gorm:"index;not null"`
+	ToNumber   string    `gorm:"index"`
+	Message    string
+	InReplyTo  *uuid.UUID `gorm:"index"`
+	Created    int64      `gorm:"autoCreateTime;index"`
+}
+
+func (baselineInboundMessage) TableName() string { return "inbound_messages" }
+
+type baselineWebhook struct {
+	ID      uuid.UUID `gorm:"primary_key"`
+	URL     string    `gorm:"not null"`
+	Events  []string  `gorm:"serializer:json"`
+	Secret  string
+	Created int64 `gorm:"autoCreateTime"`
+}
+
+func (baselineWebhook) TableName() string { return "webhooks" }
+
+type baselineWebhookDelivery struct {
+	ID               uuid.UUID `gorm:"primary_key"`
+	WebhookID        *uuid.UUID
+	URL              string     `gorm:"not null"`
+	Event            string     `gorm:"index"`
+	SMSRequestID     *uuid.UUID `gorm:"index"`
+	InboundMessageID *uuid.UUID `gorm:"index"`
+	Payload          string
+	Status           string `gorm:"index"`
+	Attempts         int
+	NextAttemptAt    int64 `gorm:"index"`
+	LastStatusCode   int
+	LastError        string
+	Created          int64 `gorm:"autoCreateTime"`
+	Updated          int64 `gorm:"autoUpdateTime"`
+}
+
+func (baselineWebhookDelivery) TableName() string { return "webhook_deliveries" }
+
+type baselineVerification struct {
+	ID           uuid.UUID `gorm:"primary_key"`
+	Number       string    `gorm:"index;not null"`
+	CodeHash     string
+	Salt         string
+	Status       string `gorm:"index"`
+	Attempts     int
+	MaxAttempts  int
+	ExpiresAt    int64
+	SMSRequestID uuid.UUID
+	Created      int64 `gorm:"autoCreateTime"`
+	Updated      int64 `gorm:"autoUpdateTime"`
+}
+
+func (baselineVerification) TableName() string { return "verifications" }
+
+type baselineTemplate struct {
+	ID           uuid.UUID `gorm:"primary_key"`
+	Name         string    `gorm:"uniqueIndex;size:191;not null"`
+	Body         string    `gorm:"not null"`
+	Variables    []string  `gorm:"serializer:json"`
+	Status       string    `gorm:"index"`
+	FilterReason string
+	Created      int64 `gorm:"autoCreateTime"`
+	Updated      int64 `gorm:"autoUpdateTime"`
+}
+
+func (baselineTemplate) TableName() string { return "templates" }
+
+type baselineFilterReview struct {
+	ID           uuid.UUID `gorm:"primary_key"`
+	SMSRequestID uuid.UUID `gorm:"index;not null"`
+	Decision     string
+	Reviewer     string
+	Note         string
+	FromStatus   string
+	ToStatus     string
+	FilterReason string
+	Created      int64 `gorm:"autoCreateTime"`
+}
+
+func (baselineFilterReview) TableName() string { return "filter_reviews" }
+
+type baselineFilterCacheEntry struct {
+	Hash      string                `gorm:"primaryKey"`
+	Verdict   baselineFilterVerdict `gorm:"embedded;embeddedPrefix:verdict_"`
+	Hits      int64
+	Created   int64 `gorm:"autoCreateTime"`
+	ExpiresAt int64 `gorm:"index"`
+}
+
+func (baselineFilterCacheEntry) TableName() string { return "filter_cache_entries" }
+
+type baselineLink struct {
+	ID           uuid.UUID `gorm:"primary_key"`
+	SMSRequestID uuid.UUID `gorm:"index;not null"`
+	URL          string
+	Host         string
+	Code         string `gorm:"uniqueIndex;size:16;not null"`
+	ShortURL     string
+	Clicks       int64
+	FirstClickAt int64
+	LastClickAt  int64
+	Created      int64 `gorm:"autoCreateTime"`
+}
+
+func (baselineLink) TableName() string { return "links" }
+
+// Every table as it stood at version 1, in the order the baseline creates them
+var baselineModels = []interface{}{
+	&baselineOptIn{}, &baselineSMSRequest{}, &baselineInboundMessage{}, &baselineWebhook{}, &baselineWebhookDelivery{},
+	&baselineVerification{}, &baselineTemplate{}, &baselineFilterReview{}, &baselineFilterCacheEntry{}, &baselineLink{},
+}
@@ -0,0 +1,391 @@
+package models
+
+import (
+	"fmt"
+	"html"
+	"microsms/constants"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+/**
+Message history search over outbound SMSRequests and inbound texts. On SQLite we keep an FTS5 index
+per table in sync with triggers, the numbers column holds the normalized opt in numbers so
+"555.123.4567" finds a request created as "5551234567". The index is keyed on a search_rowid column
+of our own rather than the rowid, the tables are keyed by uuid so their rowids can be renumbered by
+a VACUUM or a table rebuild. Postgres gets a generated tsvector column
+with a GIN index and MySQL a FULLTEXT index, both over the message and the numbers as written on
+the row. Otp messages are never indexed or matched, a search for the code shouldn't turn up the
+text it went out in. A SQLite built without fts5 falls back to plain LIKE matching so the endpoint
+still works, just slower, and matches the opt in numbers too. The LIKE side lower cases both sides
+itself since only SQLite's LIKE ignores case out of the box.
+
+Paging is limit/offset over the two tables merged, each side has to fetch offset+limit rows for
+the page to come out right, so the offset stops at MaxSearchOffset. Past that narrow the search.
+**/
+
+const (
+	SearchBackend_FTS5     = "fts5"
+	SearchBackend_TSVECTOR = "tsvector"
+	SearchBackend_FULLTEXT = "fulltext"
+	SearchBackend_LIKE     = "like"
+
+	SearchKind_OUTBOUND = "outbound"
+	SearchKind_INBOUND  = "inbound"
+
+	DefaultSearchLimit = 20
+	MaxSearchLimit     = 100
+	MaxSearchOffset    = 1000
+	maxSearchTerms     = 10
+)
+
+var searchBackend = SearchBackend_LIKE
+
+// Which backend the search is running on, handy for the response/health
+func SearchBackend() string {
+	return searchBackend
+}
+
+// Statements to build the FTS5 tables and the triggers that keep them current, run by migration
+// 5. FTS rowid is the source table rowid so syncing is a cheap rowid delete/insert. Migration 9
+// replaces all of it with sqliteSearchKeyStatements
+var sqliteSearchStatements = []string{
+	`CREATE VIRTUAL TABLE IF NOT EXISTS sms_requests_fts USING fts5(message, numbers)`,
+	`CREATE TRIGGER IF NOT EXISTS sms_requests_fts_ai AFTER INSERT ON sms_requests BEGIN
+		INSERT INTO sms_requests_fts(rowid, message, numbers) VALUES (new.rowid, CASE new.priority WHEN 'otp' THEN '' ELSE new.message END,
+			COALESCE((SELECT number FROM opt_ins WHERE id = new.from_opt_in_id), '') || ' ' ||
+			COALESCE((SELECT number FROM opt_ins WHERE id = new.to_opt_in_id), ''));
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS sms_requests_fts_au AFTER UPDATE OF message, from_opt_in_id, to_opt_in_id ON sms_requests BEGIN
+		DELETE FROM sms_requests_fts WHERE rowid = old.rowid;
+		INSERT INTO sms_requests_fts(rowid, message, numbers) VALUES (new.rowid, CASE new.priority WHEN 'otp' THEN '' ELSE new.message END,
+			COALESCE((SELECT number FROM opt_ins WHERE id = new.from_opt_in_id), '') || ' ' ||
+			COALESCE((SELECT number FROM opt_ins WHERE id = new.to_opt_in_id), ''));
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS sms_requests_fts_ad AFTER DELETE ON sms_requests BEGIN
+		DELETE FROM sms_requests_fts WHERE rowid = old.rowid;
+	END`,
+	`CREATE VIRTUAL TABLE IF NOT EXISTS inbound_messages_fts USING fts5(message, numbers)`,
+	`CREATE TRIGGER IF NOT EXISTS inbound_messages_fts_ai AFTER INSERT ON inbound_messages BEGIN
+		INSERT INTO inbound_messages_fts(rowid, message, numbers) VALUES (new.rowid, new.message, new.from_number || ' ' || COALESCE(new.to_number, ''));
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS inbound_messages_fts_au AFTER UPDATE OF message, from_number, to_number ON inbound_messages BEGIN
+		DELETE FROM inbound_messages_fts WHERE rowid = old.rowid;
+		INSERT INTO inbound_messages_fts(rowid, message, numbers) VALUES (new.rowid, new.message, new.from_number || ' ' || COALESCE(new.to_number, ''));
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS inbound_messages_fts_ad AFTER DELETE ON inbound_messages BEGIN
+		DELETE FROM inbound_messages_fts WHERE rowid = old.rowid;
+	END`,
+}
+
+// Backfill for rows that existed before the index did
+var sqliteSearchBackfill = []string{
+	`INSERT INTO sms_requests_fts(rowid, message, numbers)
+		SELECT r.rowid, CASE r.priority WHEN 'otp' THEN '' ELSE r.message END, COALESCE(f.number, '') || ' ' || COALESCE(t.number, '')
+		FROM sms_requests r LEFT JOIN opt_ins f ON f.id = r.from_opt_in_id LEFT JOIN opt_ins t ON t.id = r.to_opt_in_id`,
+	`INSERT INTO inbound_messages_fts(rowid, message, numbers)
+		SELECT rowid, message, from_number || ' ' || COALESCE(to_number, '') FROM inbound_messages`,
+}
+
+// Migration 9, the same index keyed on search_rowid. Existing rows take their current rowid, new
+// ones the next one up. The index on it is unique so a clash fails the insert instead of two
+// requests sharing an index row
+var sqliteSearchKeyStatements = []string{
+	`DROP TRIGGER IF EXISTS sms_requests_fts_ai`,
+	`DROP TRIGGER IF EXISTS sms_requests_fts_au`,
+	`DROP TRIGGER IF EXISTS sms_requests_fts_ad`,
+	`DROP TRIGGER IF EXISTS inbound_messages_fts_ai`,
+	`DROP TRIGGER IF EXISTS inbound_messages_fts_au`,
+	`DROP TRIGGER IF EXISTS inbound_messages_fts_ad`,
+	`DROP TABLE IF EXISTS sms_requests_fts`,
+	`DROP TABLE IF EXISTS inbound_messages_fts`,
+	`UPDATE sms_requests SET search_rowid = rowid WHERE search_rowid IS NULL`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_sms_requests_search_rowid ON sms_requests(search_rowid)`,
+	`UPDATE inbound_messages SET search_rowid = rowid WHERE search_rowid IS NULL`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_inbound_messages_search_rowid ON inbound_messages(search_rowid)`,
+	`CREATE VIRTUAL TABLE sms_requests_fts USING fts5(message, numbers)`,
+	`CREATE TRIGGER sms_requests_fts_ai AFTER INSERT ON sms_requests BEGIN
+		UPDATE sms_requests SET search_rowid = (SELECT COALESCE(MAX(search_rowid), 0) + 1 FROM sms_requests) WHERE rowid = new.rowid;
+		INSERT INTO sms_requests_fts(rowid, message, numbers) SELECT search_rowid, CASE new.priority WHEN 'otp' THEN '' ELSE new.message END,
+			COALESCE((SELECT number FROM opt_ins WHERE id = new.from_opt_in_id), '') || ' ' ||
+			COALESCE((SELECT number FROM opt_ins WHERE id = new.to_opt_in_id), '')
+			FROM sms_requests WHERE rowid = new.rowid;
+	END`,
+	`CREATE TRIGGER sms_requests_fts_au AFTER UPDATE OF message, from_opt_in_id, to_opt_in_id ON sms_requests BEGIN
+		DELETE FROM sms_requests_fts WHERE rowid = old.search_rowid;
+		INSERT INTO sms_requests_fts(rowid, message, numbers) VALUES (new.search_rowid, CASE new.priority WHEN 'otp' THEN '' ELSE new.message END,
+			COALESCE((SELECT number FROM opt_ins WHERE id = new.from_opt_in_id), '') || ' ' ||
+			COALESCE((SELECT number FROM opt_ins WHERE id = new.to_opt_in_id), ''));
+	END`,
+	`CREATE TRIGGER sms_requests_fts_ad AFTER DELETE ON sms_requests BEGIN
+		DELETE FROM sms_requests_fts WHERE rowid = old.search_rowid;
+	END`,
+	`CREATE VIRTUAL TABLE inbound_messages_fts USING fts5(message, numbers)`,
+	`CREATE TRIGGER inbound_messages_fts_ai AFTER INSERT ON inbound_messages BEGIN
+		UPDATE inbound_messages SET search_rowid = (SELECT COALESCE(MAX(search_rowid), 0) + 1 FROM inbound_messages) WHERE rowid = new.rowid;
+		INSERT INTO inbound_messages_fts(rowid, message, numbers) SELECT search_rowid, new.message, new.from_number || ' ' || COALESCE(new.to_number, '')
+			FROM inbound_messages WHERE rowid = new.rowid;
+	END`,
+	`CREATE TRIGGER inbound_messages_fts_au AFTER UPDATE OF message, from_number, to_number ON inbound_messages BEGIN
+		DELETE FROM inbound_messages_fts WHERE rowid = old.search_rowid;
+		INSERT INTO inbound_messages_fts(rowid, message, numbers) VALUES (new.search_rowid, new.message, new.from_number || ' ' || COALESCE(new.to_number, ''));
+	END`,
+	`CREATE TRIGGER inbound_messages_fts_ad AFTER DELETE ON inbound_messages BEGIN
+		DELETE FROM inbound_messages_fts WHERE rowid = old.search_rowid;
+	END`,
+	`INSERT INTO sms_requests_fts(rowid, message, numbers)
+		SELECT r.search_rowid, CASE r.priority WHEN 'otp' THEN '' ELSE r.message END, COALESCE(f.number, '') || ' ' || COALESCE(t.number, '')
+		FROM sms_requests r LEFT JOIN opt_ins f ON f.id = r.from_opt_in_id LEFT JOIN opt_ins t ON t.id = r.to_opt_in_id`,
+	`INSERT INTO inbound_messages_fts(rowid, message, numbers)
+		SELECT search_rowid, message, from_number || ' ' || COALESCE(to_number, '') FROM inbound_messages`,
+}
+
+// Migration 6 on Postgres, tsvector over the message (blank for otp) and the numbers with their
+// punctuation turned into spaces so they split the same way searchTerms does
+var postgresSearchStatements = []string{
+	`ALTER TABLE sms_requests ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (to_tsvector('simple',
+		CASE WHEN priority = 'otp' THEN '' ELSE COALESCE(message, '') END || ' ' ||
+		regexp_replace(COALESCE(from_number, '') || ' ' || COALESCE(to_number, ''), '[^[:alnum:]]+', ' ', 'g'))) STORED`,
+	`CREATE INDEX IF NOT EXISTS idx_sms_requests_search ON sms_requests USING GIN (search_vector)`,
+	`ALTER TABLE inbound_messages ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (to_tsvector('simple',
+		COALESCE(message, '') || ' ' ||
+		regexp_replace(COALESCE(from_number, '') || ' ' || COALESCE(to_number, ''), '[^[:alnum:]]+', ' ', 'g'))) STORED`,
+	`CREATE INDEX IF NOT EXISTS idx_inbound_messages_search ON inbound_messages USING GIN (search_vector)`,
+}
+
+// Migration 6 on MySQL. A FULLTEXT index can't leave otp messages out, the query does that
+var mysqlSearchIndexes = []struct {
+	table, index, columns string
+}{
+	{"sms_requests", "idx_sms_requests_search", "message, to_number, from_number"},
+	{"inbound_messages", "idx_inbound_messages_search", "message, from_number, to_number"},
+}
+
+// Pick the search backend for the database. The index itself comes from the migrations, this
+// just checks it's there and this build can read it
+func InitSearch() error {
+	switch DB.Dialector.Name() {
+	case DBDriver_SQLITE:
+		var rows int64
+		if err := DB.Raw("SELECT count(*) FROM sms_requests_fts WHERE rowid = 0").Scan(&rows).Error; err != nil {
+			// Most likely built without -tags sqlite_fts5, not worth refusing to start over
+			fmt.Printf("FTS5 search unavailable, falling back to LIKE search: %s\n", err)
+			searchBackend = SearchBackend_LIKE
+			break
+		}
+		searchBackend = SearchBackend_FTS5
+	case DBDriver_POSTGRES:
+		searchBackend = SearchBackend_TSVECTOR
+	case DBDriver_MYSQL:
+		searchBackend = SearchBackend_FULLTEXT
+	default:
+		searchBackend = SearchBackend_LIKE
+	}
+	fmt.Printf("Search backend: %s\n", searchBackend)
+	return nil
+}
+
+// A single search result, outbound requests carry their status
+type SearchHit struct {
+	Kind       string                  `json:"kind"`
+	ID         uuid.UUID               `json:"id"`
+	FromNumber string                  `json:"from_number"`
+	ToNumber   string                  `json:"to_number"`
+	Status     constants.RequestStatus `json:"status,omitempty"`
+	Message    string                  `json:"message"`
+	Highlight  string                  `json:"highlight"` // message with matches wrapped in <mark></mark>
+	Created    int64                   `json:"created"`
+}
+
+// Break the query into plain word/number terms. A phone number gets normalized first so it
+// splits the same way the indexed opt in numbers do
+func searchTerms(query string) []string {
+	query = strings.TrimSpace(query)
+	if constants.IsValidPhone(query) {
+		if normalized, err := constants.GetPhone(query); err == nil {
+			query = normalized
+		}
+	}
+	terms := strings.FieldsFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(terms) > maxSearchTerms {
+		terms = terms[:maxSearchTerms]
+	}
+	return terms
+}
+
+// Quote every term so user input can't wander into FTS5 query syntax, FTS ANDs them together
+func ftsMatchQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = fmt.Sprintf("\"%s\"", term)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Boolean mode query requiring every term, they're plain letters/digits so there's no syntax to escape
+func fulltextMatchQuery(terms []string) string {
+	required := make([]string, len(terms))
+	for i, term := range terms {
+		required[i] = "+" + term
+	}
+	return strings.Join(required, " ")
+}
+
+// The highlight is HTML, so the message gets escaped piece by piece around the matches. Escaping
+// first and matching after would let a term like "amp" land inside an entity
+func highlightTerms(text string, terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	re := regexp.MustCompile("(?i)(" + strings.Join(quoted, "|") + ")")
+	var highlighted strings.Builder
+	last := 0
+	for _, match := range re.FindAllStringIndex(text, -1) {
+		highlighted.WriteString(html.EscapeString(text[last:match[0]]))
+		highlighted.WriteString("<mark>" + html.EscapeString(text[match[0]:match[1]]) + "</mark>")
+		last = match[1]
+	}
+	highlighted.WriteString(html.EscapeString(text[last:]))
+	return highlighted.String()
+}
+
+// A term against the normalized opt in numbers of a request, the same ones FTS5 indexes. The
+// numbers on the request are as written, "5551234567" there would never match "(555)-123-4567"
+const optInNumberLike = `(sms_requests.from_opt_in_id IN (SELECT id FROM opt_ins WHERE number LIKE ?) OR
+	sms_requests.to_opt_in_id IN (SELECT id FROM opt_ins WHERE number LIKE ?))`
+
+func searchOutbound(terms []string, fetch int) ([]SMSRequest, error) {
+	var smsrequests []SMSRequest
+	query := DB.Model(&SMSRequest{})
+	switch searchBackend {
+	case SearchBackend_FTS5:
+		query = query.Joins("JOIN sms_requests_fts ON sms_requests_fts.rowid = sms_requests.search_rowid").Where("sms_requests_fts MATCH ?", ftsMatchQuery(terms))
+	case SearchBackend_TSVECTOR:
+		query = query.Where("sms_requests.search_vector @@ plainto_tsquery('simple', ?)", strings.Join(terms, " "))
+	case SearchBackend_FULLTEXT:
+		query = query.Where("MATCH(sms_requests.message, sms_requests.to_number, sms_requests.from_number) AGAINST (? IN BOOLEAN MODE)", fulltextMatchQuery(terms))
+		// The index has the otp text in it, those rows only count when the numbers match
+		numbers := []string{"sms_requests.priority <> ?"}
+		args := []interface{}{constants.RequestPriority_OTP}
+		for _, term := range terms {
+			numbers = append(numbers, optInNumberLike)
+			args = append(args, "%"+term+"%", "%"+term+"%")
+		}
+		query = query.Where("("+numbers[0]+" OR ("+strings.Join(numbers[1:], " AND ")+"))", args...)
+	default:
+		for _, term := range terms {
+			like := "%" + strings.ToLower(term) + "%"
+			query = query.Where("((LOWER(sms_requests.message) LIKE ? AND sms_requests.priority <> ?) OR "+optInNumberLike+")",
+				like, constants.RequestPriority_OTP, like, like)
+		}
+	}
+	err := query.Order("sms_requests.created DESC").Limit(fetch).Find(&smsrequests).Error
+	return smsrequests, err
+}
+
+func searchInbound(terms []string, fetch int) ([]InboundMessage, error) {
+	var inbound []InboundMessage
+	query := DB.Model(&InboundMessage{})
+	switch searchBackend {
+	case SearchBackend_FTS5:
+		query = query.Joins("JOIN inbound_messages_fts ON inbound_messages_fts.rowid = inbound_messages.search_rowid").Where("inbound_messages_fts MATCH ?", ftsMatchQuery(terms))
+	case SearchBackend_TSVECTOR:
+		query = query.Where("inbound_messages.search_vector @@ plainto_tsquery('simple', ?)", strings.Join(terms, " "))
+	case SearchBackend_FULLTEXT:
+		query = query.Where("MATCH(inbound_messages.message, inbound_messages.from_number, inbound_messages.to_number) AGAINST (? IN BOOLEAN MODE)", fulltextMatchQuery(terms))
+	default:
+		for _, term := range terms {
+			like := "%" + strings.ToLower(term) + "%"
+			query = query.Where("(LOWER(inbound_messages.message) LIKE ? OR inbound_messages.to_number LIKE ? OR inbound_messages.from_number LIKE ?)", like, like, like)
+		}
+	}
+	err := query.Order("inbound_messages.created DESC").Limit(fetch).Find(&inbound).Error
+	return inbound, err
+}
+
+// Search message bodies and numbers, newest first. kind narrows to outbound/inbound, empty
+// searches both. Paging is limit/offset since results from two tables get merged here
+func Search(query string, kind string, limit int, offset int) ([]SearchHit, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("Error empty search query")
+	}
+	if kind != "" && kind != SearchKind_OUTBOUND && kind != SearchKind_INBOUND {
+		return nil, fmt.Errorf("Error invalid search kind %s", kind)
+	}
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	if limit > MaxSearchLimit {
+		limit = MaxSearchLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > MaxSearchOffset {
+		return nil, fmt.Errorf("Error search offset %d is past %d, narrow the search instead", offset, MaxSearchOffset)
+	}
+	// Each side needs offset+limit rows for the merged page to be right, hence the offset cap
+	fetch := offset + limit
+	var hits []SearchHit
+
+	if kind == "" || kind == SearchKind_OUTBOUND {
+		smsrequests, err := searchOutbound(terms, fetch)
+		if err != nil {
+			fmt.Printf("ERROR SEARCHING SMSREQUESTS %s\n", err)
+			return nil, err
+		}
+		for _, smsrequest := range smsrequests {
+			if smsrequest.Priority == constants.RequestPriority_OTP {
+				smsrequest.Message = "" // found by number, the code still stays put
+			}
+			hits = append(hits, SearchHit{
+				Kind:       SearchKind_OUTBOUND,
+				ID:         smsrequest.ID,
+				FromNumber: smsrequest.FromNumber,
+				ToNumber:   smsrequest.ToNumber,
+				Status:     smsrequest.Status,
+				Message:    smsrequest.Message,
+				Highlight:  highlightTerms(smsrequest.Message, terms),
+				Created:    smsrequest.Created,
+			})
+		}
+	}
+	if kind == "" || kind == SearchKind_INBOUND {
+		inbound, err := searchInbound(terms, fetch)
+		if err != nil {
+			fmt.Printf("ERROR SEARCHING INBOUND MESSAGES %s\n", err)
+			return nil, err
+		}
+		for _, message := range inbound {
+			hits = append(hits, SearchHit{
+				Kind:       SearchKind_INBOUND,
+				ID:         message.ID,
+				FromNumber: message.FromNumber,
+				ToNumber:   message.ToNumber,
+				Message:    message.Message,
+				Highlight:  highlightTerms(message.Message, terms),
+				Created:    message.Created,
+			})
+		}
+	}
+
+	sort.SliceStable(hits, func(i, j int) bool {
+		return hits[i].Created > hits[j].Created
+	})
+	if offset >= len(hits) {
+		return []SearchHit{}, nil
+	}
+	end := offset + limit
+	if end > len(hits) {
+		end = len(hits)
+	}
+	return hits[offset:end], nil
+}
@@ -0,0 +1,26 @@
+package models
+
+import "testing"
+
+// The message is escaped around the matches, never inside an entity the escaping made
+func TestHighlightTerms(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		terms []string
+		want  string
+	}{
+		{"plain", "see you at lunch", []string{"lunch"}, "see you at <mark>lunch</mark>"},
+		{"case kept", "Lunch at LUNCHTIME", []string{"lunch"}, "<mark>Lunch</mark> at <mark>LUNCH</mark>TIME"},
+		{"entities left alone", `Tom & "Amp" <b>`, []string{"amp", "b"}, `Tom &amp; &#34;<mark>Amp</mark>&#34; &lt;<mark>b</mark>&gt;`},
+		{"regex characters", "costs $5.00 (approx)", []string{"$5.00", "(approx)"}, "costs <mark>$5.00</mark> <mark>(approx)</mark>"},
+		{"no match", "<script>", []string{"lunch"}, "&lt;script&gt;"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := highlightTerms(test.text, test.terms); got != test.want {
+				t.Errorf("got %s, expected %s", got, test.want)
+			}
+		})
+	}
+}
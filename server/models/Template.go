@@ -0,0 +1,200 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"microsms/constants"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+/**
+Message templates. The body has {{name}} placeholders and goes through the content filter once when
+the template is created, requests sent from an approved template skip the per message filter and
+only get a quick local check on the variables since those are the only part we haven't seen.
+**/
+
+type TemplateStatus string
+
+const (
+	TemplateStatus_PENDING  TemplateStatus = "pending" // waiting on the filter
+	TemplateStatus_APPROVED TemplateStatus = "approved"
+	TemplateStatus_BLOCKED  TemplateStatus = "blocked"
+	TemplateStatus_ERROR    TemplateStatus = "error" // filter call failed, recheck it
+)
+
+// Variables get dropped into an already approved body so keep them short and plain
+const maxTemplateVariableLength = 64
+
+var templatePlaceholder = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_]+)\s*\}\}`)
+
+// Anything link shaped, a variable is not the place to smuggle a URL past the filter
+var templateVariableLink = regexp.MustCompile(`(?i)(https?://|www\.|[a-z0-9-]+\.(com|net|org|io|ly|co|me|info|biz|xyz)\b)`)
+
+var ErrTemplateNotApproved = errors.New("template is not approved")
+
+type Template struct {
+	ID           uuid.UUID      `json:"id" gorm:"primary_key"`
+	Name         string         `json:"name" gorm:"uniqueIndex;size:191;not null"` // sized so MySQL can index it
+	Body         string         `json:"body" gorm:"not null"`
+	Variables    []string       `json:"variables" gorm:"serializer:json"` // placeholder names found in the body
+	Status       TemplateStatus `json:"status" gorm:"index"`
+	FilterReason string         `json:"filter_reason,omitempty"`
+	Created      int64          `json:"created" gorm:"autoCreateTime"`
+	Updated      int64          `json:"updated" gorm:"autoUpdateTime"`
+}
+
+func (template *Template) BeforeCreate(tx *gorm.DB) error {
+	template.ID = uuid.New()
+	return nil
+}
+
+// Placeholder names in order of first use
+func templateVariables(body string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, match := range templatePlaceholder.FindAllStringSubmatch(body, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
+
+// Lightweight stand in for the filter on template variables
+func checkTemplateVariable(name string, value string) error {
+	switch {
+	case value == "":
+		return fmt.Errorf("Error template variable %s is empty", name)
+	case len(value) > maxTemplateVariableLength:
+		return fmt.Errorf("Error template variable %s is longer than %d characters", name, maxTemplateVariableLength)
+	case strings.ContainsAny(value, "\r\n"):
+		return fmt.Errorf("Error template variable %s has a line break", name)
+	case templateVariableLink.MatchString(value):
+		return fmt.Errorf("Error template variable %s looks like a link", name)
+	}
+	return nil
+}
+
+// Fill in the placeholders. Every placeholder needs a value and every value has to be a placeholder
+func (template *Template) Render(variables map[string]string) (string, error) {
+	for name := range variables {
+		if !slices.Contains(template.Variables, name) {
+			return "", fmt.Errorf("Error template %s has no variable %s", template.Name, name)
+		}
+	}
+	for _, name := range template.Variables {
+		value, ok := variables[name]
+		if !ok {
+			return "", fmt.Errorf("Error template %s is missing variable %s", template.Name, name)
+		}
+		if err := checkTemplateVariable(name, value); err != nil {
+			return "", err
+		}
+	}
+	return templatePlaceholder.ReplaceAllStringFunc(template.Body, func(placeholder string) string {
+		return variables[templatePlaceholder.FindStringSubmatch(placeholder)[1]]
+	}), nil
+}
+
+// Store a template as pending, the caller kicks off the filter check
+func CreateTemplate(name string, body string) (*Template, error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, fmt.Errorf("Error invalid template name %s", name)
+	}
+	if strings.TrimSpace(body) == "" {
+		return nil, fmt.Errorf("Error invalid template body %s", body)
+	}
+	template := Template{Name: name, Body: body, Variables: templateVariables(body), Status: TemplateStatus_PENDING}
+	if err := DB.Create(&template).Error; err != nil {
+		fmt.Println("Error creating template:", err)
+		return nil, err
+	}
+	return &template, nil
+}
+
+func GetTemplates() ([]Template, error) {
+	var templates []Template
+	err := DB.Order("name ASC").Find(&templates).Error
+	return templates, err
+}
+
+// Templates nothing has screened yet, made while filtering was off or cut off by a restart
+func GetPendingTemplates() ([]Template, error) {
+	var templates []Template
+	err := DB.Where("status IN ?", []TemplateStatus{TemplateStatus_PENDING, TemplateStatus_ERROR}).Order("created ASC").Find(&templates).Error
+	return templates, err
+}
+
+func GetTemplate(id uuid.UUID) (*Template, error) {
+	var template Template
+	if err := DB.First(&template, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+func DeleteTemplate(id uuid.UUID) error {
+	result := DB.Delete(&Template{}, "id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// Put a template back to pending so it can go through the filter again
+func ResetTemplateFilter(id uuid.UUID) (*Template, error) {
+	template, err := GetTemplate(id)
+	if err != nil {
+		return nil, err
+	}
+	template.Status = TemplateStatus_PENDING
+	template.FilterReason = ""
+	if err = DB.Save(template).Error; err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+// Record what the filter said about the template body
+func SetTemplateFilterResult(id uuid.UUID, blocked bool, reason string, filterErr error) error {
+	status := TemplateStatus_APPROVED
+	switch {
+	case filterErr != nil:
+		status = TemplateStatus_ERROR
+		reason = filterErr.Error()
+	case blocked:
+		status = TemplateStatus_BLOCKED
+	}
+	return DB.Model(&Template{}).Where("id = ?", id).Updates(map[string]interface{}{"status": status, "filter_reason": reason}).Error
+}
+
+// Render the request's message from its template, only approved templates can be sent
+func applyTemplate(smsrequest *SMSRequest) error {
+	if smsrequest.Message != "" {
+		return fmt.Errorf("Error message and template_id can't both be set")
+	}
+	template, err := GetTemplate(*smsrequest.TemplateID)
+	if err != nil {
+		return fmt.Errorf("Error finding template %s: %s", smsrequest.TemplateID, err)
+	}
+	switch {
+	case template.Status == TemplateStatus_APPROVED:
+	case !filterEnabled && template.Status != TemplateStatus_BLOCKED:
+		// Never screened and nothing to screen it with, goes out like any message with filtering off.
+		// The template gets screened once the server comes up with a filter
+		smsrequest.FilterMode = constants.FilterMode_DISABLED
+	default:
+		return fmt.Errorf("%w (template %s is %s)", ErrTemplateNotApproved, template.ID, template.Status)
+	}
+	smsrequest.Message, err = template.Render(smsrequest.Variables)
+	return err
+}
@@ -0,0 +1,145 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"microsms/config"
+	"microsms/constants"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+/**
+One time password verification. Start generates a code, stores only a salted hash of it and sends
+it as an otp priority SMSRequest. Check compares against the newest pending code for the number,
+every wrong guess burns an attempt and a code is good for exactly one successful check.
+**/
+
+// A code sent to a number, the code itself is never stored
+type Verification struct {
+	ID           uuid.UUID                    `json:"id" gorm:"primary_key"`
+	Number       string                       `json:"number" gorm:"index;not null"` // normalized
+	CodeHash     string                       `json:"-"`
+	Salt         string                       `json:"-"`
+	Status       constants.VerificationStatus `json:"status" gorm:"index"`
+	Attempts     int                          `json:"attempts"`
+	MaxAttempts  int                          `json:"max_attempts"`
+	ExpiresAt    int64                        `json:"expires_at"` // unix seconds
+	SMSRequestID uuid.UUID                    `json:"-"`          // the request holds the code until it's sent
+	Created      int64                        `json:"created" gorm:"autoCreateTime"`
+	Updated      int64                        `json:"updated" gorm:"autoUpdateTime"`
+}
+
+var ErrNoPendingVerification = errors.New("no pending verification for number")
+
+func (verification *Verification) BeforeCreate(tx *gorm.DB) error {
+	verification.ID = uuid.New()
+	return nil
+}
+
+func hashVerificationCode(salt string, code string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send a fresh code to the number, any code still pending for it stops working
+func StartVerification(toNumber string, fromNumber string, cfg config.VerifyConfig) (*Verification, error) {
+	number, err := constants.GetPhone(toNumber)
+	if err != nil {
+		return nil, err
+	}
+	if fromNumber == "" {
+		fromNumber = cfg.FromNumber
+	}
+	code, err := constants.GenerateOTPCode(cfg.CodeLength)
+	if err != nil {
+		return nil, fmt.Errorf("Error generating code %s", err)
+	}
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("Error generating salt %s", err)
+	}
+
+	smsrequest := SMSRequest{
+		ToNumber:   toNumber,
+		FromNumber: fromNumber,
+		Message:    fmt.Sprintf(cfg.MessageFormat, code),
+		Priority:   constants.RequestPriority_OTP,
+		ExpiresAt:  time.Now().Add(time.Duration(cfg.TTL) * time.Second).Unix(), // no point delivering a dead code
+	}
+	if err = createSMSRequest(&smsrequest, constants.FilterMode_SYSTEM); err != nil {
+		return nil, err
+	}
+
+	verification := Verification{
+		Number:       number,
+		Salt:         hex.EncodeToString(salt),
+		Status:       constants.VerificationStatus_PENDING,
+		MaxAttempts:  cfg.MaxAttempts,
+		ExpiresAt:    smsrequest.ExpiresAt,
+		SMSRequestID: smsrequest.ID,
+	}
+	verification.CodeHash = hashVerificationCode(verification.Salt, code)
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Verification{}).Where("number = ? AND status = ?", number, constants.VerificationStatus_PENDING).
+			Update("status", constants.VerificationStatus_REPLACED).Error; err != nil {
+			return err
+		}
+		return tx.Create(&verification).Error
+	})
+	if err != nil {
+		fmt.Println("Error creating verification:", err)
+		return nil, err
+	}
+	return &verification, nil
+}
+
+// Check a code against the newest pending verification for the number. The bool is whether the
+// code was right, the returned record carries the resulting status either way
+func CheckVerification(toNumber string, code string) (*Verification, bool, error) {
+	number, err := constants.GetPhone(toNumber)
+	if err != nil {
+		return nil, false, err
+	}
+	var verification Verification
+	err = DB.Where("number = ? AND status = ?", number, constants.VerificationStatus_PENDING).Order("created DESC").First(&verification).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, ErrNoPendingVerification
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if time.Now().Unix() >= verification.ExpiresAt {
+		verification.Status = constants.VerificationStatus_EXPIRED
+		return &verification, false, DB.Save(&verification).Error
+	}
+
+	valid := hmac.Equal([]byte(hashVerificationCode(verification.Salt, code)), []byte(verification.CodeHash))
+	verification.Attempts++
+	// Conditional on the attempt count we read so two checks racing can't both spend the same attempt
+	updates := map[string]interface{}{"attempts": verification.Attempts}
+	switch {
+	case valid:
+		verification.Status = constants.VerificationStatus_APPROVED
+	case verification.Attempts >= verification.MaxAttempts:
+		verification.Status = constants.VerificationStatus_FAILED
+	}
+	updates["status"] = verification.Status
+	result := DB.Model(&Verification{}).Where("id = ? AND status = ? AND attempts = ?", verification.ID, constants.VerificationStatus_PENDING, verification.Attempts-1).Updates(updates)
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		// Someone else got there first, treat it as a miss and let the caller retry
+		return nil, false, ErrNoPendingVerification
+	}
+	return &verification, valid, nil
+}
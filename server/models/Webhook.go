@@ -0,0 +1,276 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"microsms/config"
+	"microsms/constants"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryStatus_PENDING   WebhookDeliveryStatus = "pending"
+	WebhookDeliveryStatus_DELIVERED WebhookDeliveryStatus = "delivered"
+	WebhookDeliveryStatus_DEAD      WebhookDeliveryStatus = "dead" // ran out of retries, sits here until someone retries it
+)
+
+// A client registered URL that gets every event (or just the ones listed in Events)
+type Webhook struct {
+	ID      uuid.UUID `json:"id" gorm:"primary_key"`
+	URL     string    `json:"url" gorm:"not null"`
+	Events  []string  `json:"events" gorm:"serializer:json"` // empty means everything
+	Secret  string    `json:"secret,omitempty"`              // only handed out when the webhook is created
+	Created int64     `json:"created" gorm:"autoCreateTime"`
+}
+
+// One attempt-tracked POST of one event to one URL. Doubles as the delivery log and the retry queue
+type WebhookDelivery struct {
+	ID               uuid.UUID             `json:"id" gorm:"primary_key"`
+	WebhookID        *uuid.UUID            `json:"webhook_id"` // nil for a per request callback_url
+	URL              string                `json:"url" gorm:"not null"`
+	Event            string                `json:"event" gorm:"index"`
+	SMSRequestID     *uuid.UUID            `json:"smsrequest_id" gorm:"index"`
+	InboundMessageID *uuid.UUID            `json:"inbound_message_id" gorm:"index"`
+	Payload          string                `json:"payload"`
+	Status           WebhookDeliveryStatus `json:"status" gorm:"index"`
+	Attempts         int                   `json:"attempts"`
+	NextAttemptAt    int64                 `json:"next_attempt_at_ms" gorm:"index"`
+	LastStatusCode   int                   `json:"last_status_code"`
+	LastError        string                `json:"last_error"`
+	Created          int64                 `json:"created" gorm:"autoCreateTime"`
+	Updated          int64                 `json:"updated" gorm:"autoUpdateTime"`
+}
+
+func (webhook *Webhook) BeforeCreate(tx *gorm.DB) error {
+	webhook.ID = uuid.New()
+	return nil
+}
+
+// The enqueue side picks the id itself so the payload can carry it, anything else gets one here
+func (delivery *WebhookDelivery) BeforeCreate(tx *gorm.DB) error {
+	if delivery.ID == uuid.Nil {
+		delivery.ID = uuid.New()
+	}
+	return nil
+}
+
+// Does this webhook care about the event
+func (webhook *Webhook) Wants(event string) bool {
+	return len(webhook.Events) == 0 || slices.Contains(webhook.Events, event)
+}
+
+// Only plain http(s) URLs make sense as webhook targets
+func ValidateWebhookURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("Error invalid webhook url %s", rawURL)
+	}
+	return nil
+}
+
+var callbackHosts []string
+var allowPrivateCallbacks bool
+
+// Returned when a callback_url points somewhere requests from /create aren't allowed to reach
+var ErrCallbackURLNotAllowed = errors.New("callback_url is not allowed")
+
+// SetCallbackPolicy sets where a request's callback_url may point, from main
+func SetCallbackPolicy(cfg config.WebhookConfig) {
+	callbackHosts = nil
+	for _, host := range cfg.CallbackHosts {
+		callbackHosts = append(callbackHosts, strings.ToLower(strings.TrimSpace(host)))
+	}
+	allowPrivateCallbacks = cfg.AllowPrivateCallbacks
+}
+
+// Carrier grade NAT space, not covered by IsPrivate but no more public than 10/8
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// Can a callback_url reach this address. Loopback, private, link-local (cloud metadata lives
+// there), multicast and unspecified ones are off limits unless private callbacks are allowed
+func CallbackAddressAllowed(ip net.IP) bool {
+	if allowPrivateCallbacks {
+		return true
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip))
+}
+
+// A callback_url is a webhook URL anyone who can call /create picks, so it has to be on the
+// callback host list (when there is one) and can't name an internal address. Hostnames are only
+// resolved when the delivery is sent, the dispatcher checks the address again there
+func ValidateCallbackURL(rawURL string) error {
+	if err := ValidateWebhookURL(rawURL); err != nil {
+		return err
+	}
+	parsed, _ := url.Parse(rawURL)
+	host := strings.ToLower(strings.TrimSuffix(parsed.Hostname(), "."))
+	if len(callbackHosts) > 0 && !constants.HostMatches(host, callbackHosts) {
+		return fmt.Errorf("%w: %s isn't a callback host", ErrCallbackURLNotAllowed, host)
+	}
+	if allowPrivateCallbacks {
+		return nil
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("%w: %s", ErrCallbackURLNotAllowed, host)
+	}
+	if ip := net.ParseIP(host); ip != nil && !CallbackAddressAllowed(ip) {
+		return fmt.Errorf("%w: %s is an internal address", ErrCallbackURLNotAllowed, host)
+	}
+	return nil
+}
+
+func generateWebhookSecret() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// Register a webhook, the returned record is the only time the secret is shown
+func CreateWebhook(rawURL string, events []string) (*Webhook, error) {
+	var err error
+	if err = ValidateWebhookURL(rawURL); err != nil {
+		return nil, err
+	}
+	webhook := Webhook{URL: rawURL, Events: events}
+	if webhook.Secret, err = generateWebhookSecret(); err != nil {
+		return nil, err
+	}
+	if err = DB.Create(&webhook).Error; err != nil {
+		fmt.Println("Error creating webhook:", err)
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// All registered webhooks, secrets included so only use this internally
+func GetWebhooks() ([]Webhook, error) {
+	var webhooks []Webhook
+	err := DB.Order("created ASC").Find(&webhooks).Error
+	return webhooks, err
+}
+
+func GetWebhook(id uuid.UUID) (*Webhook, error) {
+	var webhook Webhook
+	if err := DB.First(&webhook, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+func DeleteWebhook(id uuid.UUID) error {
+	result := DB.Delete(&Webhook{}, "id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func CreateWebhookDelivery(delivery *WebhookDelivery) error {
+	delivery.Status = WebhookDeliveryStatus_PENDING
+	delivery.Payload = scrubOTPPayload(delivery.Payload)
+	return DB.Create(delivery).Error
+}
+
+// Blank the message and variables of an otp request carried in a payload. The request's JSON
+// already leaves them out, this makes sure the delivery log never has a code in it whatever
+// built the payload. Anything that isn't an otp request comes back untouched
+func scrubOTPPayload(payload string) string {
+	var event map[string]json.RawMessage
+	if json.Unmarshal([]byte(payload), &event) != nil || event["smsrequest"] == nil {
+		return payload
+	}
+	var smsrequest map[string]interface{}
+	if json.Unmarshal(event["smsrequest"], &smsrequest) != nil || smsrequest["priority"] != string(constants.RequestPriority_OTP) {
+		return payload
+	}
+	if smsrequest["message"] == "" && smsrequest["variables"] == nil {
+		return payload
+	}
+	smsrequest["message"] = ""
+	delete(smsrequest, "variables")
+	var err error
+	if event["smsrequest"], err = json.Marshal(smsrequest); err != nil {
+		return ""
+	}
+	scrubbed, err := json.Marshal(event)
+	if err != nil {
+		return ""
+	}
+	return string(scrubbed)
+}
+
+// Store how an attempt went. Only the columns the dispatcher owns, so a payload retention
+// blanked in the meantime stays blank
+func SaveWebhookAttempt(delivery *WebhookDelivery) error {
+	return DB.Model(&WebhookDelivery{}).Where("id = ?", delivery.ID).Updates(map[string]interface{}{
+		"status":           delivery.Status,
+		"attempts":         delivery.Attempts,
+		"next_attempt_at":  delivery.NextAttemptAt,
+		"last_status_code": delivery.LastStatusCode,
+		"last_error":       delivery.LastError,
+	}).Error
+}
+
+// Pending deliveries whose retry time has come, oldest first
+func GetDueWebhookDeliveries(nowMs int64, limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := DB.Where("status = ? AND next_attempt_at <= ?", WebhookDeliveryStatus_PENDING, nowMs).Order("next_attempt_at ASC").Limit(limit).Find(&deliveries).Error
+	return deliveries, err
+}
+
+// Take a due delivery for one attempt by pushing its next attempt past the lease, so the next
+// pass (or another server) doesn't send it again while it's in flight. A crash mid send just means
+// it comes due again once the lease runs out. False when someone else got it first
+func LeaseWebhookDelivery(id uuid.UUID, nowMs int64, untilMs int64) (bool, error) {
+	result := DB.Model(&WebhookDelivery{}).Where("id = ? AND status = ? AND next_attempt_at <= ?", id, WebhookDeliveryStatus_PENDING, nowMs).Update("next_attempt_at", untilMs)
+	return result.RowsAffected > 0, result.Error
+}
+
+// Delivery log, newest first. Empty status lists everything, "dead" is the dead letter view
+func ListWebhookDeliveries(status WebhookDeliveryStatus, limit int, offset int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	query := DB.Model(&WebhookDelivery{})
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	err := query.Order("created DESC").Limit(limit).Offset(offset).Find(&deliveries).Error
+	return deliveries, err
+}
+
+// Retention blanked the payload, there's nothing left to send
+var ErrWebhookPayloadRedacted = errors.New("webhook delivery payload was redacted")
+
+// Put a dead (or any) delivery back in the queue with a fresh set of attempts
+func RetryWebhookDelivery(id uuid.UUID, nowMs int64) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	if err := DB.First(&delivery, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	if delivery.Payload == "" {
+		return nil, ErrWebhookPayloadRedacted
+	}
+	delivery.Status = WebhookDeliveryStatus_PENDING
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = nowMs
+	if err := SaveWebhookAttempt(&delivery); err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
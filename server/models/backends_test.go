@@ -0,0 +1,835 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"microsms/config"
+	"microsms/constants"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+/**
+The model layer against each database backend, through the same functions the routes use. Every
+test runs on its own fresh setup: SQLite on a new file, Postgres and MySQL when
+MICROSMS_TEST_POSTGRES_DSN / MICROSMS_TEST_MYSQL_DSN point at an empty database. Claims take
+whatever is ready to send, so everything a test created is deleted again before the next one.
+**/
+
+const (
+	checkFromNumber = "555-555-0100"
+	checkToNumber   = "555-555-0101"
+	checkNewNumber  = "555-555-0102" // never opted in by the setup
+	checkRequests   = 40             // ready requests the claim check fights over
+	checkWorkers    = 8
+)
+
+// What a run created, so it can all be cleaned up
+type modelCheckRun struct {
+	requestIDs  []uuid.UUID
+	inboundIDs  []uuid.UUID
+	templateIDs []uuid.UUID
+	cacheHash   string
+}
+
+// Run the check against SQLite and whichever of Postgres and MySQL have a DSN set, each time on a
+// freshly migrated database with the from and to numbers opted in both ways
+func eachBackend(t *testing.T, check func(run *modelCheckRun) error) {
+	backends := []struct {
+		name string
+		env  string
+		cfg  config.DatabaseConfig
+	}{
+		{DBDriver_SQLITE, "", config.DatabaseConfig{Driver: DBDriver_SQLITE, WAL: true}},
+		{DBDriver_POSTGRES, "MICROSMS_TEST_POSTGRES_DSN", config.DatabaseConfig{Driver: DBDriver_POSTGRES}},
+		{DBDriver_MYSQL, "MICROSMS_TEST_MYSQL_DSN", config.DatabaseConfig{Driver: DBDriver_MYSQL}},
+	}
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			if backend.env != "" {
+				if backend.cfg.DSN = os.Getenv(backend.env); backend.cfg.DSN == "" {
+					t.Skipf("set %s to run against %s", backend.env, backend.name)
+				}
+			} else {
+				backend.cfg.Path = filepath.Join(t.TempDir(), "backends.db")
+			}
+			openTestDB(t, backend.cfg)
+			run := &modelCheckRun{cacheHash: "backends-" + uuid.NewString()}
+			t.Cleanup(run.cleanUp)
+			if err := run.optIn(checkFromNumber, checkToNumber); err != nil {
+				t.Fatal(err)
+			}
+			if err := check(run); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestOptIns(t *testing.T)             { eachBackend(t, (*modelCheckRun).checkOptIns) }
+func TestCreate(t *testing.T)             { eachBackend(t, (*modelCheckRun).checkCreate) }
+func TestConcurrentClaims(t *testing.T)   { eachBackend(t, (*modelCheckRun).checkClaims) }
+func TestCancel(t *testing.T)             { eachBackend(t, (*modelCheckRun).checkCancel) }
+func TestDeliveryReport(t *testing.T)     { eachBackend(t, (*modelCheckRun).checkDeliveryReport) }
+func TestListPaging(t *testing.T)         { eachBackend(t, (*modelCheckRun).checkListPaging) }
+func TestSearch(t *testing.T)             { eachBackend(t, (*modelCheckRun).checkSearch) }
+func TestFilterCache(t *testing.T)        { eachBackend(t, (*modelCheckRun).checkFilterCache) }
+func TestReview(t *testing.T)             { eachBackend(t, (*modelCheckRun).checkReview) }
+func TestReviewLimits(t *testing.T)       { eachBackend(t, (*modelCheckRun).checkReviewLimits) }
+func TestRetention(t *testing.T)          { eachBackend(t, (*modelCheckRun).checkRetention) }
+func TestOTPRedaction(t *testing.T)       { eachBackend(t, (*modelCheckRun).checkOTPRedaction) }
+func TestFrequencyCap(t *testing.T)       { eachBackend(t, (*modelCheckRun).checkFrequencyCap) }
+func TestLinkRewriting(t *testing.T)      { eachBackend(t, (*modelCheckRun).checkLinkRewriting) }
+func TestConversationPaging(t *testing.T) { eachBackend(t, (*modelCheckRun).checkConversationPaging) }
+func TestVerification(t *testing.T)       { eachBackend(t, (*modelCheckRun).checkVerification) }
+func TestUnscreenedTemplate(t *testing.T) { eachBackend(t, (*modelCheckRun).checkUnscreenedTemplate) }
+
+// Migrate the database and point DB at it for the length of the test. Refuses one that already
+// has requests or opt ins in it
+func openTestDB(t *testing.T, cfg config.DatabaseConfig) {
+	db, err := InitDB(cfg)
+	if err != nil {
+		t.Fatalf("opening %s: %s", cfg.Driver, err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+		DB = nil
+	})
+	if err = InitSearch(); err != nil {
+		t.Fatalf("setting up search: %s", err)
+	}
+	var existing int64
+	for _, model := range []interface{}{&SMSRequest{}, &OptIn{}} {
+		if err = DB.Model(model).Count(&existing).Error; err != nil {
+			t.Fatal(err)
+		}
+		if existing > 0 {
+			t.Fatalf("%s database isn't empty, the claim checks would take whatever is ready to send", cfg.Driver)
+		}
+	}
+}
+
+func (run *modelCheckRun) create(message string, filterMode constants.FilterMode) (*SMSRequest, error) {
+	smsrequest := &SMSRequest{ToNumber: checkToNumber, FromNumber: checkFromNumber, Message: message}
+	if err := createSMSRequest(smsrequest, filterMode); err != nil {
+		return nil, err
+	}
+	run.requestIDs = append(run.requestIDs, smsrequest.ID)
+	return smsrequest, nil
+}
+
+func (run *modelCheckRun) cleanUp() {
+	if len(run.requestIDs) > 0 {
+		DB.Where("sms_request_id IN ?", run.requestIDs).Delete(&Link{})
+		DB.Where("sms_request_id IN ?", run.requestIDs).Delete(&FilterReview{})
+		DB.Where("id IN ?", run.requestIDs).Delete(&SMSRequest{})
+	}
+	if len(run.inboundIDs) > 0 {
+		DB.Where("id IN ?", run.inboundIDs).Delete(&InboundMessage{})
+	}
+	if len(run.templateIDs) > 0 {
+		DB.Where("id IN ?", run.templateIDs).Delete(&Template{})
+	}
+	DB.Where("hash = ?", run.cacheHash).Delete(&FilterCacheEntry{})
+	for _, number := range []string{checkFromNumber, checkToNumber, checkNewNumber} {
+		if formatted, err := constants.GetPhone(number); err == nil {
+			DB.Where("number = ?", formatted).Delete(&Verification{})
+			DB.Where("number = ?", formatted).Delete(&OptIn{})
+		}
+	}
+}
+
+// Opt the numbers in both ways so requests between them go straight to ready_to_send
+func (run *modelCheckRun) optIn(numbers ...string) error {
+	for _, number := range numbers {
+		formatted, err := constants.GetPhone(number)
+		if err != nil {
+			return err
+		}
+		if _, err = FindOrCreateOptIn(formatted); err != nil {
+			return err
+		}
+		if _, err = UpdateOptInFromAskTo(formatted, constants.OptInStatus_TRUE); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Finding a number twice hands back the same opt in
+func (run *modelCheckRun) checkOptIns() error {
+	formatted, err := constants.GetPhone(checkNewNumber)
+	if err != nil {
+		return err
+	}
+	first, err := FindOrCreateOptIn(formatted)
+	if err != nil {
+		return err
+	}
+	again, err := FindOrCreateOptIn(formatted)
+	if err != nil {
+		return err
+	}
+	if first.ID != again.ID {
+		return fmt.Errorf("opt in for %s created twice (%s, %s)", formatted, first.ID, again.ID)
+	}
+	updated, err := UpdateOptInFromAskTo(formatted, constants.OptInStatus_TRUE)
+	if err != nil {
+		return err
+	}
+	if updated.ID != first.ID || updated.Status != constants.OptInStatus_TRUE {
+		return fmt.Errorf("opt in for %s updated as %+v", formatted, updated)
+	}
+	return nil
+}
+
+// A request a worker has taken, for the checks that need one
+func (run *modelCheckRun) claimed(message string) (*SMSRequest, error) {
+	if _, err := run.create(message, constants.FilterMode_DISABLED); err != nil {
+		return nil, err
+	}
+	smsrequest, err := ClaimSMSRequest("backends")
+	if err != nil {
+		return nil, err
+	}
+	if smsrequest.ID == uuid.Nil {
+		return nil, errors.New("nothing to claim")
+	}
+	return smsrequest, nil
+}
+
+func (run *modelCheckRun) checkCreate() error {
+	created, err := run.create("backends create https://example.com/a", constants.FilterMode_DISABLED)
+	if err != nil {
+		return err
+	}
+	if created.Status != constants.RequestStatus_READY_TO_SEND {
+		return fmt.Errorf("new request is %s, expected %s", created.Status, constants.RequestStatus_READY_TO_SEND)
+	}
+	found, err := GetSMSRequest(created.ID.String())
+	if err != nil {
+		return err
+	}
+	if found.Message != created.Message || found.BodyHash != created.BodyHash || found.Priority != constants.RequestPriority_STANDARD {
+		return fmt.Errorf("request read back as %s", found)
+	}
+	return nil
+}
+
+// Several workers claiming at once, every request has to go out exactly once
+func (run *modelCheckRun) checkClaims() error {
+	for i := 0; i < checkRequests; i++ {
+		if _, err := run.create(fmt.Sprintf("backends claim %d", i), constants.FilterMode_DISABLED); err != nil {
+			return err
+		}
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	claimedBy := map[uuid.UUID]string{}
+	var errs []error
+	for w := 0; w < checkWorkers; w++ {
+		wg.Add(1)
+		go func(worker string) {
+			defer wg.Done()
+			for {
+				smsrequest, err := ClaimSMSRequest(worker)
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, err)
+					mu.Unlock()
+					return
+				}
+				if smsrequest.ID == uuid.Nil {
+					mu.Unlock()
+					return
+				}
+				if other, ok := claimedBy[smsrequest.ID]; ok {
+					errs = append(errs, fmt.Errorf("%s claimed by both %s and %s", smsrequest.ID, other, worker))
+				}
+				claimedBy[smsrequest.ID] = worker
+				mu.Unlock()
+			}
+		}(fmt.Sprintf("backends-%d", w))
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if len(claimedBy) != checkRequests {
+		return fmt.Errorf("%d requests claimed, expected %d", len(claimedBy), checkRequests)
+	}
+	var taken int64
+	if err := DB.Model(&SMSRequest{}).Where("id IN ? AND status = ? AND worker <> ''", run.requestIDs, constants.RequestStatus_TAKEN).Count(&taken).Error; err != nil {
+		return err
+	}
+	if taken != int64(len(claimedBy)) {
+		return fmt.Errorf("%d claimed requests are taken, expected %d", taken, len(claimedBy))
+	}
+	return nil
+}
+
+func (run *modelCheckRun) checkCancel() error {
+	taken, err := run.claimed("backends cancel taken")
+	if err != nil {
+		return err
+	}
+	if _, err = CancelSMSRequest(taken.ID.String()); !errors.Is(err, ErrSMSRequestNotCancellable) {
+		return fmt.Errorf("cancelling a taken request gave %v", err)
+	}
+	pending, err := run.create("backends cancel", constants.FilterMode_DISABLED)
+	if err != nil {
+		return err
+	}
+	cancelled, err := CancelSMSRequest(pending.ID.String())
+	if err != nil {
+		return err
+	}
+	if cancelled.Status != constants.RequestStatus_CANCELLED {
+		return fmt.Errorf("cancelled request is %s", cancelled.Status)
+	}
+	return nil
+}
+
+func (run *modelCheckRun) checkDeliveryReport() error {
+	taken, err := run.claimed("backends delivery report")
+	if err != nil {
+		return err
+	}
+	id := taken.ID.String()
+	if _, err = UpdateSMSRequest(id, constants.RequestStatus_SENT, "someone-else"); !errors.Is(err, ErrSMSRequestNotClaimed) {
+		return fmt.Errorf("another worker's PATCH gave %v", err)
+	}
+	if _, err = UpdateSMSRequest(id, constants.RequestStatus_SENT, taken.Worker); err != nil {
+		return err
+	}
+	delivered, err := RecordDeliveryReport(id, 0, 0)
+	if err != nil {
+		return err
+	}
+	if delivered.Status != constants.RequestStatus_DELIVERED {
+		return fmt.Errorf("request is %s after a delivered report", delivered.Status)
+	}
+	if _, err = RecordDeliveryReport(id, 0, 0); !errors.Is(err, ErrSMSRequestNotAwaitingDelivery) {
+		return fmt.Errorf("second report gave %v", err)
+	}
+	return nil
+}
+
+// Small pages so the cursor has to break ties on id, everything was created in the same second or so
+func (run *modelCheckRun) checkListPaging() error {
+	for i := 0; i < 20; i++ {
+		if _, err := run.create(fmt.Sprintf("backends page %d", i), constants.FilterMode_DISABLED); err != nil {
+			return err
+		}
+	}
+	seen := map[uuid.UUID]bool{}
+	cursor := ""
+	for page := 0; ; page++ {
+		if page > checkRequests {
+			return errors.New("paging never ended")
+		}
+		smsrequests, next, err := ListSMSRequests(SMSRequestFilter{FromNumber: checkFromNumber, Limit: 7, Cursor: cursor})
+		if err != nil {
+			return err
+		}
+		for _, smsrequest := range smsrequests {
+			if seen[smsrequest.ID] {
+				return fmt.Errorf("%s came back on two pages", smsrequest.ID)
+			}
+			seen[smsrequest.ID] = true
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(seen) != len(run.requestIDs) {
+		return fmt.Errorf("paged through %d requests, expected %d", len(seen), len(run.requestIDs))
+	}
+	return nil
+}
+
+func (run *modelCheckRun) checkSearch() error {
+	var needle *SMSRequest
+	for _, message := range []string{"backends search needle", "backends search haystack"} {
+		smsrequest, err := run.create(message, constants.FilterMode_DISABLED)
+		if err != nil {
+			return err
+		}
+		if needle == nil {
+			needle = smsrequest
+		}
+	}
+	// A table rebuild or VACUUM is free to renumber rowids on a table keyed by uuid, the index has
+	// to keep pointing at the same request
+	if DBDriver() == DBDriver_SQLITE {
+		if err := DB.Exec("UPDATE sms_requests SET rowid = rowid + 1000").Error; err != nil {
+			return err
+		}
+	}
+	hits, err := Search("NEEDLE", SearchKind_OUTBOUND, 10, 0)
+	if err != nil {
+		return err
+	}
+	if len(hits) != 1 || hits[0].ID != needle.ID {
+		return fmt.Errorf("search found %+v, expected just %s", hits, needle.ID)
+	}
+	// The number as typed some other way still finds them, whatever backend does the matching
+	if hits, err = Search("(555) 555.0101", SearchKind_OUTBOUND, 10, 0); err != nil || len(hits) < 2 {
+		return fmt.Errorf("search by number found %d requests (%v), expected at least 2", len(hits), err)
+	}
+	if _, err = Search("needle", "", 10, MaxSearchOffset+1); err == nil {
+		return fmt.Errorf("searched past the offset cap")
+	}
+	return nil
+}
+
+func (run *modelCheckRun) checkFilterCache() error {
+	now := time.Now().Unix()
+	if err := SaveFilterCacheEntry(run.cacheHash, FilterVerdict{Blocked: true, Reason: "first"}, now+60); err != nil {
+		return err
+	}
+	if err := SaveFilterCacheEntry(run.cacheHash, FilterVerdict{Reason: "second", IncludedCategories: []string{"a"}}, now+60); err != nil {
+		return err
+	}
+	entry, err := GetFilterCacheEntry(run.cacheHash, now)
+	if err != nil {
+		return err
+	}
+	if entry == nil || entry.Verdict.Blocked || entry.Verdict.Reason != "second" || len(entry.Verdict.IncludedCategories) != 1 {
+		return fmt.Errorf("cache entry read back as %+v", entry)
+	}
+	return nil
+}
+
+func (run *modelCheckRun) checkReview() error {
+	smsrequest, err := run.create("backends review", constants.FilterMode_FILTER)
+	if err != nil {
+		return err
+	}
+	id := smsrequest.ID.String()
+	if err = SaveFilterVerdict(id, FilterVerdict{Blocked: true, Reason: "backends"}); err != nil {
+		return err
+	}
+	if _, _, err = TransitionSMSRequest(id, []constants.RequestStatus{constants.RequestStatus_FILTER_CHECK}, constants.RequestStatus_BLOCKED); err != nil {
+		return err
+	}
+	// Rows from before the review column came back with NULL there, they still need a decision
+	if err = DB.Model(&SMSRequest{}).Where("id = ?", id).UpdateColumn("review", nil).Error; err != nil {
+		return err
+	}
+	approved, _, err := ReviewSMSRequest(id, ReviewDecision_APPROVE, "backends", "")
+	if err != nil {
+		return err
+	}
+	if approved.Status != constants.RequestStatus_READY_TO_SEND {
+		return fmt.Errorf("approved request is %s", approved.Status)
+	}
+	if _, _, err = ReviewSMSRequest(id, ReviewDecision_CONFIRM, "backends", ""); !errors.Is(err, ErrSMSRequestNotUnderReview) {
+		return fmt.Errorf("second review gave %v", err)
+	}
+	return nil
+}
+
+// Two cancelled requests aged past a redact and a delete rule, swapped in for the configured ones
+func (run *modelCheckRun) checkRetention() error {
+	configured := retentionRules
+	defer func() { retentionRules = configured }()
+	err := SetRetentionPolicy(config.RetentionConfig{Rules: []config.RetentionRule{{Statuses: []string{"cancelled"}, Redact: "1h", Delete: "1d"}}})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	// Aged by when they finished, the last one was created long ago but only just cancelled
+	var aged []*SMSRequest
+	for _, age := range []struct{ created, finished time.Duration }{{2 * time.Hour, 2 * time.Hour}, {48 * time.Hour, 48 * time.Hour}, {48 * time.Hour, 0}} {
+		smsrequest, err := run.create("backends retention https://example.com/kept", constants.FilterMode_DISABLED)
+		if err != nil {
+			return err
+		}
+		if _, err = CancelSMSRequest(smsrequest.ID.String()); err != nil {
+			return err
+		}
+		err = DB.Model(&SMSRequest{}).Where("id = ?", smsrequest.ID).
+			UpdateColumns(map[string]interface{}{"created": now.Add(-age.created).Unix(), "finished_at": now.Add(-age.finished).Unix()}).Error
+		if err != nil {
+			return err
+		}
+		aged = append(aged, smsrequest)
+	}
+	link := Link{SMSRequestID: aged[0].ID, URL: "https://example.com/kept", Code: fmt.Sprintf("r%d", now.UnixNano()%1e9)}
+	if err = DB.Create(&link).Error; err != nil {
+		return err
+	}
+	preview, err := PreviewRetention(now)
+	if err != nil {
+		return err
+	}
+	if preview.Redact != 1 || preview.Delete != 1 {
+		return fmt.Errorf("preview has %d to redact and %d to delete, expected 1 and 1", preview.Redact, preview.Delete)
+	}
+	swept, err := RunRetention(now)
+	if err != nil {
+		return err
+	}
+	if swept.Redacted != 1 || swept.Deleted != 1 {
+		return fmt.Errorf("sweep redacted %d and deleted %d, expected 1 and 1", swept.Redacted, swept.Deleted)
+	}
+	redacted, err := GetSMSRequest(aged[0].ID.String())
+	if err != nil {
+		return err
+	}
+	if redacted.Message != "" || redacted.BodyHash != "" || redacted.RedactedAt == 0 {
+		return fmt.Errorf("redacted request read back as %s (body hash %q, redacted at %d)", redacted, redacted.BodyHash, redacted.RedactedAt)
+	}
+	if _, err = FollowLink(link.Code); !errors.Is(err, ErrLinkRedacted) {
+		return fmt.Errorf("following a redacted request's link gave %v, expected %v", err, ErrLinkRedacted)
+	}
+	if _, err = GetSMSRequest(aged[1].ID.String()); err == nil {
+		return errors.New("deleted request is still there")
+	}
+	recent, err := GetSMSRequest(aged[2].ID.String())
+	if err != nil {
+		return err
+	}
+	if recent.RedactedAt != 0 {
+		return errors.New("request that only just finished got redacted by its created time")
+	}
+	return nil
+}
+
+// An otp code never shows up in JSON outside the worker's claim and is gone once the request is
+func (run *modelCheckRun) checkOTPRedaction() error {
+	smsrequest := &SMSRequest{ToNumber: checkToNumber, FromNumber: checkFromNumber, Message: "backends code 424242", Priority: constants.RequestPriority_OTP}
+	if err := createSMSRequest(smsrequest, constants.FilterMode_SYSTEM); err != nil {
+		return err
+	}
+	run.requestIDs = append(run.requestIDs, smsrequest.ID)
+	if payload, err := json.Marshal(smsrequest); err != nil || strings.Contains(string(payload), "424242") {
+		return fmt.Errorf("otp request marshalled as %s (%v)", payload, err)
+	}
+	if hits, err := Search("424242", SearchKind_OUTBOUND, 10, 0); err != nil || len(hits) > 0 {
+		return fmt.Errorf("searching for the code found %d hits (%v)", len(hits), err)
+	}
+	entries, _, err := GetConversation(checkFromNumber, checkToNumber, "", MaxListLimit)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Message, "424242") {
+			return fmt.Errorf("conversation shows the code in %s", entry.ID)
+		}
+	}
+	cancelled, err := CancelSMSRequest(smsrequest.ID.String())
+	if err != nil {
+		return err
+	}
+	if cancelled.Message != "" || cancelled.RedactedAt == 0 {
+		return fmt.Errorf("cancelled otp request still has its message, redacted at %d", cancelled.RedactedAt)
+	}
+	return nil
+}
+
+// Approving can't bring back a redacted message or push a recipient over their caps
+func (run *modelCheckRun) checkReviewLimits() error {
+	block := func(message string) (string, error) {
+		smsrequest := &SMSRequest{ToNumber: checkToNumber, FromNumber: checkFromNumber, Message: message}
+		if err := createSMSRequest(smsrequest, constants.FilterMode_FILTER); err != nil {
+			return "", err
+		}
+		run.requestIDs = append(run.requestIDs, smsrequest.ID)
+		id := smsrequest.ID.String()
+		if err := SaveFilterVerdict(id, FilterVerdict{Blocked: true, Reason: "backends"}); err != nil {
+			return "", err
+		}
+		_, _, err := TransitionSMSRequest(id, []constants.RequestStatus{constants.RequestStatus_FILTER_CHECK}, constants.RequestStatus_BLOCKED)
+		return id, err
+	}
+	redacted, err := block("backends review redacted")
+	if err != nil {
+		return err
+	}
+	if err = DB.Model(&SMSRequest{}).Where("id = ?", redacted).UpdateColumn("redacted_at", time.Now().Unix()).Error; err != nil {
+		return err
+	}
+	if _, _, err = ReviewSMSRequest(redacted, ReviewDecision_APPROVE, "backends", ""); !errors.Is(err, ErrSMSRequestRedacted) {
+		return fmt.Errorf("approving a redacted request gave %v", err)
+	}
+	if _, _, err = ReviewSMSRequest(redacted, ReviewDecision_CONFIRM, "backends", ""); err != nil {
+		return fmt.Errorf("confirming a redacted request: %s", err)
+	}
+
+	queued := &SMSRequest{ToNumber: checkToNumber, FromNumber: checkFromNumber, Message: "backends review queued"}
+	if err = createSMSRequest(queued, constants.FilterMode_DISABLED); err != nil {
+		return err
+	}
+	run.requestIDs = append(run.requestIDs, queued.ID)
+	capped, err := block("backends review capped")
+	if err != nil {
+		return err
+	}
+	if err = SetFrequencyCaps(config.FrequencyCapConfig{Caps: []string{"1/1h"}, Policy: FrequencyCapPolicy_REJECT}); err != nil {
+		return err
+	}
+	defer SetFrequencyCaps(config.FrequencyCapConfig{})
+	if _, _, err = ReviewSMSRequest(capped, ReviewDecision_APPROVE, "backends", ""); !errors.Is(err, ErrFrequencyCapExceeded) {
+		return fmt.Errorf("approving over the cap gave %v", err)
+	}
+	// Still waiting on a decision
+	queue, err := GetReviewQueue(MaxListLimit, 0)
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(queue, func(smsrequest SMSRequest) bool { return smsrequest.ID.String() == capped }) {
+		return fmt.Errorf("capped request %s left the review queue", capped)
+	}
+	return nil
+}
+
+// Creates racing for the last slots under a reject cap, exactly the cap's worth get in
+func (run *modelCheckRun) checkFrequencyCap() error {
+	const limit = 3
+	if err := SetFrequencyCaps(config.FrequencyCapConfig{Caps: []string{fmt.Sprintf("%d/1h", limit)}, Policy: FrequencyCapPolicy_REJECT}); err != nil {
+		return err
+	}
+	defer SetFrequencyCaps(config.FrequencyCapConfig{})
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var created int
+	var errs []error
+	for i := 0; i < checkWorkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			smsrequest := &SMSRequest{ToNumber: checkToNumber, FromNumber: checkFromNumber, Message: fmt.Sprintf("backends cap %d", i)}
+			err := createSMSRequest(smsrequest, constants.FilterMode_DISABLED)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				created++
+				run.requestIDs = append(run.requestIDs, smsrequest.ID)
+			case !errors.Is(err, ErrFrequencyCapExceeded):
+				errs = append(errs, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if created != limit {
+		return fmt.Errorf("%d requests got under a cap of %d", created, limit)
+	}
+	return nil
+}
+
+// The filter and the body hash see the links the client sent, they're only swapped once it passes
+func (run *modelCheckRun) checkLinkRewriting() error {
+	if err := SetLinkPolicy(config.LinkConfig{Rewrite: true, BaseURL: "https://sms.example.com"}); err != nil {
+		return err
+	}
+	defer SetLinkPolicy(config.LinkConfig{})
+	original := "backends link https://example.com/offer"
+	created, err := run.create(original, constants.FilterMode_FILTER)
+	if err != nil {
+		return err
+	}
+	if created.Message != original || created.BodyHash != messageBodyHash(original) || len(created.Links) > 0 {
+		return fmt.Errorf("links rewritten before the filter saw them: %s", created.Message)
+	}
+	passed, moved, err := PassFilter(created.ID.String())
+	if err != nil {
+		return err
+	}
+	if !moved || len(passed.Links) != 1 || !strings.Contains(passed.Message, passed.Links[0].ShortURL) {
+		return fmt.Errorf("links not rewritten after the filter passed it: %s", passed.Message)
+	}
+	if passed.BodyHash != created.BodyHash || passed.Links[0].URL != "https://example.com/offer" {
+		return fmt.Errorf("rewriting changed the body hash or lost the link (%s)", passed.Links[0].URL)
+	}
+	return nil
+}
+
+// Small pages through a conversation where everything happened in the same second have to come
+// out exactly like one big page, nothing skipped at a page break and nothing twice
+func (run *modelCheckRun) checkConversationPaging() error {
+	for i := 0; i < 4; i++ {
+		if _, err := run.create(fmt.Sprintf("backends conversation %d", i), constants.FilterMode_DISABLED); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < 3; i++ {
+		inbound, _, err := CreateInboundMessage(checkToNumber, checkFromNumber, fmt.Sprintf("backends reply %d", i))
+		if err != nil {
+			return err
+		}
+		run.inboundIDs = append(run.inboundIDs, inbound.ID)
+	}
+	stamp := time.Now().Unix()
+	if err := DB.Model(&SMSRequest{}).Where("id IN ?", run.requestIDs).UpdateColumn("created", stamp).Error; err != nil {
+		return err
+	}
+	if err := DB.Model(&InboundMessage{}).Where("id IN ?", run.inboundIDs).UpdateColumn("created", stamp).Error; err != nil {
+		return err
+	}
+	all, next, err := GetConversation(checkFromNumber, checkToNumber, "", MaxListLimit)
+	if err != nil {
+		return err
+	}
+	if next != "" {
+		return fmt.Errorf("conversation has more than %d messages, can't check it in one page", MaxListLimit)
+	}
+	var paged []ConversationEntry
+	cursor := ""
+	for {
+		page, next, err := GetConversation(checkFromNumber, checkToNumber, cursor, 3)
+		if err != nil {
+			return err
+		}
+		paged = append(paged, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(paged) != len(all) {
+		return fmt.Errorf("paged through %d messages, one page has %d", len(paged), len(all))
+	}
+	for i := range all {
+		if paged[i].ID != all[i].ID {
+			return fmt.Errorf("message %d is %s paged and %s in one page", i, paged[i].ID, all[i].ID)
+		}
+	}
+	return nil
+}
+
+// A template nothing screened only goes out while filtering is off, and its requests say so
+func (run *modelCheckRun) checkUnscreenedTemplate() error {
+	template, err := CreateTemplate("backends-"+uuid.NewString(), "backends template {{name}}")
+	if err != nil {
+		return err
+	}
+	run.templateIDs = append(run.templateIDs, template.ID)
+	send := func() (*SMSRequest, error) {
+		smsrequest := &SMSRequest{ToNumber: checkToNumber, FromNumber: checkFromNumber, TemplateID: &template.ID, Variables: map[string]string{"name": "pat"}}
+		err := CreateSMSRequest(smsrequest)
+		if err == nil {
+			run.requestIDs = append(run.requestIDs, smsrequest.ID)
+		}
+		return smsrequest, err
+	}
+	if _, err = send(); !errors.Is(err, ErrTemplateNotApproved) {
+		return fmt.Errorf("pending template sent with the filter on, got %v", err)
+	}
+	SetFilterEnabled(false)
+	defer SetFilterEnabled(true)
+	smsrequest, err := send()
+	if err != nil {
+		return err
+	}
+	if smsrequest.FilterMode != constants.FilterMode_DISABLED {
+		return fmt.Errorf("unscreened template request has filter_mode %s, expected %s", smsrequest.FilterMode, constants.FilterMode_DISABLED)
+	}
+	if smsrequest.Message != "backends template pat" {
+		return fmt.Errorf("template rendered as %q", smsrequest.Message)
+	}
+	if template, err = GetTemplate(template.ID); err != nil {
+		return err
+	}
+	if template.Status != TemplateStatus_PENDING {
+		return fmt.Errorf("template is %s after sending with the filter off, expected it left %s", template.Status, TemplateStatus_PENDING)
+	}
+	return nil
+}
+
+// Codes pass once, burn after too many wrong guesses, expire and get replaced by a newer one.
+// Every scenario starts its own code, and the steps are checks in order
+func (run *modelCheckRun) checkVerification() error {
+	cfg := config.VerifyConfig{FromNumber: checkFromNumber, CodeLength: 6, TTL: 300, MaxAttempts: 2, MessageFormat: "%s"}
+	type step struct {
+		code   string // right, wrong or first (the code from the replaced start)
+		valid  bool
+		status constants.VerificationStatus
+		err    error
+	}
+	tests := []struct {
+		name    string
+		replace bool // start a second code before checking
+		expire  bool
+		steps   []step
+	}{
+		{"right code", false, false, []step{{"right", true, constants.VerificationStatus_APPROVED, nil}}},
+		{"wrong then right", false, false, []step{
+			{"wrong", false, constants.VerificationStatus_PENDING, nil},
+			{"right", true, constants.VerificationStatus_APPROVED, nil},
+		}},
+		{"only passes once", false, false, []step{
+			{"right", true, constants.VerificationStatus_APPROVED, nil},
+			{"right", false, "", ErrNoPendingVerification},
+		}},
+		{"burned", false, false, []step{
+			{"wrong", false, constants.VerificationStatus_PENDING, nil},
+			{"wrong", false, constants.VerificationStatus_FAILED, nil},
+			{"right", false, "", ErrNoPendingVerification},
+		}},
+		{"expired", false, true, []step{{"right", false, constants.VerificationStatus_EXPIRED, nil}}},
+		{"replaced", true, false, []step{
+			{"first", false, constants.VerificationStatus_PENDING, nil},
+			{"right", true, constants.VerificationStatus_APPROVED, nil},
+		}},
+	}
+	start := func() (*Verification, string, error) {
+		verification, err := StartVerification(checkToNumber, "", cfg)
+		if err != nil {
+			return nil, "", err
+		}
+		run.requestIDs = append(run.requestIDs, verification.SMSRequestID)
+		var smsrequest SMSRequest
+		if err = DB.First(&smsrequest, "id = ?", verification.SMSRequestID).Error; err != nil {
+			return nil, "", err
+		}
+		return verification, smsrequest.Message, nil
+	}
+	for _, test := range tests {
+		verification, right, err := start()
+		if err != nil {
+			return err
+		}
+		first := right
+		if test.replace {
+			if verification, right, err = start(); err != nil {
+				return err
+			}
+		}
+		if test.expire {
+			if err = DB.Model(verification).UpdateColumn("expires_at", time.Now().Unix()-1).Error; err != nil {
+				return err
+			}
+		}
+		for i, step := range test.steps {
+			code := map[string]string{"right": right, "wrong": "000000x", "first": first}[step.code]
+			checked, valid, err := CheckVerification(checkToNumber, code)
+			if !errors.Is(err, step.err) {
+				return fmt.Errorf("%s step %d: got %v, expected %v", test.name, i, err, step.err)
+			}
+			if err != nil {
+				continue
+			}
+			if valid != step.valid || checked.Status != step.status {
+				return fmt.Errorf("%s step %d: valid %t %s, expected %t %s", test.name, i, valid, checked.Status, step.valid, step.status)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package routes
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"microsms/config"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+Bare bones API key checks. Keys live in config (auth.adminkeys) and get handed to us from main.
+Not the grand auth solution, just enough to keep the nosy endpoints (search etc) locked down.
+**/
+
+var adminKeys []string
+var apiClients []config.APIClient
+
+func SetAdminKeys(keys []string) {
+	adminKeys = keys
+}
+
+func SetAPIClients(clients []config.APIClient) {
+	apiClients = clients
+}
+
+// Pull the key from X-API-Key, or fall back to a bearer token for clients that prefer that
+func getAPIKey(c *gin.Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	return strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+}
+
+// Constant time compare against every key so we don't leak which prefix was close
+func isAdminKey(key string) bool {
+	found := false
+	for _, adminKey := range adminKeys {
+		if adminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+// Who's behind the admin key on the request, for audit trails. A short hash of the key so it's
+// the same every time without the key itself ending up in the database
+func adminIdentity(c *gin.Context) string {
+	hash := sha256.Sum256([]byte(getAPIKey(c)))
+	return "admin-" + hex.EncodeToString(hash[:4])
+}
+
+// Name of the configured client whose key came with the request, "" for anyone else
+func apiClientName(c *gin.Context) string {
+	key := getAPIKey(c)
+	name := ""
+	if key == "" {
+		return name
+	}
+	for _, client := range apiClients {
+		if client.Key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(client.Key)) == 1 {
+			name = client.Name
+		}
+	}
+	return name
+}
+
+// Middleware for privileged endpoints. No keys configured means nobody gets in
+func RequireAdminKey() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := getAPIKey(c)
+		if key == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing API key"})
+			return
+		}
+		if !isAdminKey(key) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key is not allowed here"})
+			return
+		}
+		c.Next()
+	}
+}
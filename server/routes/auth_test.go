@@ -0,0 +1,71 @@
+package routes
+
+import (
+	"microsms/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Run one request through the admin key check and hand back the status and who it came from
+func adminRequest(t *testing.T, headers map[string]string) (int, string, string) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	var identity, client string
+	router := gin.New()
+	router.GET("/admin", RequireAdminKey(), func(c *gin.Context) {
+		identity, client = adminIdentity(c), apiClientName(c)
+		c.JSON(http.StatusOK, gin.H{"message": "ok"})
+	})
+	req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder.Code, identity, client
+}
+
+func TestRequireAdminKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     []string
+		headers  map[string]string
+		status   int
+		identity string
+	}{
+		{"no key", []string{"key-one"}, nil, http.StatusUnauthorized, ""},
+		{"wrong key", []string{"key-one"}, map[string]string{"X-API-Key": "key-two"}, http.StatusForbidden, ""},
+		{"header", []string{"key-one"}, map[string]string{"X-API-Key": "key-one"}, http.StatusOK, "admin-9b346041"},
+		{"bearer", []string{"key-one"}, map[string]string{"Authorization": "Bearer key-one"}, http.StatusOK, "admin-9b346041"},
+		{"second key", []string{"key-zero", "key-one"}, map[string]string{"X-API-Key": "key-one"}, http.StatusOK, "admin-9b346041"},
+		{"prefix isn't enough", []string{"key-one"}, map[string]string{"X-API-Key": "key-on"}, http.StatusForbidden, ""},
+		{"no keys configured", nil, map[string]string{"X-API-Key": "key-one"}, http.StatusForbidden, ""},
+		{"blank key configured", []string{""}, map[string]string{"Authorization": "Bearer "}, http.StatusUnauthorized, ""},
+	}
+	t.Cleanup(func() { SetAdminKeys(nil) })
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			SetAdminKeys(test.keys)
+			status, identity, _ := adminRequest(t, test.headers)
+			if status != test.status || identity != test.identity {
+				t.Errorf("got %d as %q, expected %d as %q", status, identity, test.status, test.identity)
+			}
+		})
+	}
+}
+
+// The client name comes from the key, whatever else the request says
+func TestAPIClientName(t *testing.T) {
+	SetAdminKeys([]string{"key-one"})
+	SetAPIClients([]config.APIClient{{Name: "billing", Key: "key-one"}, {Name: "nobody", Key: ""}})
+	t.Cleanup(func() {
+		SetAdminKeys(nil)
+		SetAPIClients(nil)
+	})
+	if _, _, client := adminRequest(t, map[string]string{"X-API-Key": "key-one"}); client != "billing" {
+		t.Errorf("client %q, expected billing", client)
+	}
+}
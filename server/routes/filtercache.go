@@ -0,0 +1,32 @@
+package routes
+
+import (
+	"fmt"
+	"microsms/helpers"
+	"microsms/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Hit/miss counts and how big the verdict cache is
+func GetFilterCacheStats(c *gin.Context) {
+	stats, err := helpers.GetFilterCacheStats()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed reading filter cache stats %s", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Filter cache has %d entries", stats.Entries), "cache": stats})
+}
+
+// Empty the verdict cache, ?expired=true only drops the ones past their TTL
+func PurgeFilterCache(c *gin.Context) {
+	expiredOnly := c.Query("expired") == "true"
+	purged, err := models.PurgeFilterCache(expiredOnly, time.Now().Unix())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed purging filter cache %s", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Purged %d filter cache entries", purged), "purged": purged})
+}
@@ -0,0 +1,30 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"microsms/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Count the click and send the phone on to the real URL
+func FollowLink(c *gin.Context) {
+	link, err := models.FollowLink(c.Param("code"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.String(http.StatusNotFound, "Link not found")
+		return
+	}
+	if errors.Is(err, models.ErrLinkRedacted) {
+		c.String(http.StatusGone, "Link expired")
+		return
+	}
+	if err != nil {
+		fmt.Printf("Failed following link %s: %s\n", c.Param("code"), err)
+		c.String(http.StatusInternalServerError, "Link unavailable")
+		return
+	}
+	c.Redirect(http.StatusFound, link.URL)
+}
@@ -0,0 +1,31 @@
+package routes
+
+import (
+	"fmt"
+	"microsms/helpers"
+	"microsms/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// What the next retention sweep will redact and delete, plus how the last one went. With
+// retention off (or before the first sweep) it's what a sweep right now would do
+func GetRetentionPreview(c *gin.Context) {
+	status := helpers.GetRetentionStatus()
+	at := time.Now()
+	if status.NextRunAt > at.Unix() {
+		at = time.Unix(status.NextRunAt, 0)
+	}
+	preview, err := models.PreviewRetention(at)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed previewing retention %s", err)})
+		return
+	}
+	message := fmt.Sprintf("Next retention sweep redacts %d and deletes %d requests", preview.Redact, preview.Delete)
+	if !status.Enabled {
+		message = fmt.Sprintf("Retention is off, a sweep now would redact %d and delete %d requests", preview.Redact, preview.Delete)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": message, "retention": status, "preview": preview})
+}
@@ -0,0 +1,87 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"microsms/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type ReviewRequest struct {
+	Decision models.ReviewDecision `json:"decision" binding:"required"` // approve or confirm
+	Note     string                `json:"note"`
+}
+
+// Requests the filter stopped that are waiting on a decision, with the stored verdict
+func ListReviewQueue(c *gin.Context) {
+	limit, offset, err := getLimitOffset(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	smsrequests, err := models.GetReviewQueue(limit, offset)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed listing review queue %s", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Found %d SMSRequests waiting on review", len(smsrequests)), "smsrequests": smsrequests})
+}
+
+// Approve a request back onto the send path or confirm the block
+func ReviewSMSRequest(c *gin.Context) {
+	id, ok := getIDCheckValid(c)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("ID is invalid %s", id)})
+		return
+	}
+	var review ReviewRequest
+	if err := c.ShouldBindJSON(&review); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("FAILED TO PARSE PAYLOAD %s", err)})
+		return
+	}
+	smsrequest, decision, err := models.ReviewSMSRequest(id, review.Decision, adminIdentity(c), review.Note)
+	if errors.Is(err, models.ErrSMSRequestNotUnderReview) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("SMSRequest %s is not waiting on a review", id)})
+		return
+	}
+	if errors.Is(err, models.ErrSMSRequestRedacted) {
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, models.ErrFrequencyCapExceeded) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("SMSRequest %s %s, now %s", id, decision.Decision, smsrequest.Status), "smsrequest": smsrequest, "review": decision})
+}
+
+// Decision log, everything or just one request's with ?id=
+func ListFilterReviews(c *gin.Context) {
+	limit, offset, err := getLimitOffset(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var smsrequestID *uuid.UUID
+	if raw := c.Query("id"); raw != "" {
+		uid, err := uuid.Parse(raw)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("ID is invalid %s", raw)})
+			return
+		}
+		smsrequestID = &uid
+	}
+	reviews, err := models.GetFilterReviews(smsrequestID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed listing reviews %s", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Found %d reviews", len(reviews)), "reviews": reviews})
+}
@@ -1,15 +1,20 @@
 package routes
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"microsms/constants"
 	"microsms/helpers"
 	"microsms/models"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 var filterWG *sync.WaitGroup
@@ -24,12 +29,23 @@ func CreateSMSRequest(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := models.CreateSMSRequest(&smsrequest); err != nil {
+	smsrequest.Client = apiClientName(c) // never trust a client named in the body
+	err := models.CreateSMSRequest(&smsrequest)
+	if errors.Is(err, models.ErrFrequencyCapExceeded) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error()})
 		return
 	}
-	filterWG.Add(1)                                               // increment the waitgroup or else our app won't know of new potential goroutine
-	go helpers.CheckSMSMessage(smsrequest.ID, smsrequest.Message) // Execute the CheckSMSMessage in parallel non blocking manner
+	// Only requests waiting on the filter get checked. Templated ones were screened with their
+	// template, with filtering off (or the request already blocked) there's nothing to do
+	if smsrequest.Status == constants.RequestStatus_FILTER_CHECK {
+		filterWG.Add(1) // increment the waitgroup or else our app won't know of new potential goroutine
+		// Execute the CheckSMSMessage in parallel non blocking manner
+		go helpers.CheckSMSMessage(smsrequest)
+	}
 
 	c.JSON(http.StatusCreated, gin.H{"message": fmt.Sprintf("SMSRequest Created %s", smsrequest.ID), "smsrequest": smsrequest})
 }
@@ -64,6 +80,57 @@ func GetSMSRequest(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "SMSRequest found", "smsrequest": smsrequest})
 }
 
+// Pull an optional unix timestamp query param, 0 means it wasn't set
+func getInt64Query(c *gin.Context, key string) (int64, error) {
+	raw := c.Query(key)
+	if raw == "" {
+		return 0, nil
+	}
+	value, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s %s", key, raw)
+	}
+	return value, nil
+}
+
+func ListSMSRequests(c *gin.Context) {
+	var err error
+	filter := models.SMSRequestFilter{
+		ToNumber:   c.Query("to_number"),
+		FromNumber: c.Query("from_number"),
+		Worker:     c.Query("worker"),
+		Sort:       c.Query("sort"),
+		Descending: c.DefaultQuery("order", "asc") == "desc",
+		Cursor:     c.Query("cursor"),
+	}
+	// status=verify_check,ready_to_send style so ops can look at a few at once
+	if statuses := c.Query("status"); statuses != "" {
+		for _, status := range strings.Split(statuses, ",") {
+			filter.Statuses = append(filter.Statuses, constants.RequestStatus(strings.TrimSpace(status)))
+		}
+	}
+	if filter.CreatedAfter, err = getInt64Query(c, "created_after"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if filter.CreatedBefore, err = getInt64Query(c, "created_before"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if limit := c.Query("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid limit %s", limit)})
+			return
+		}
+	}
+	smsrequests, nextCursor, err := models.ListSMSRequests(filter)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed listing SMSRequests %s", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Found %d SMSRequests", len(smsrequests)), "smsrequests": smsrequests, "next_cursor": nextCursor})
+}
+
 func UpdateSMSRequest(c *gin.Context) {
 	var smsrequest *models.SMSRequest
 	var smsupdate models.SMSRequest
@@ -78,20 +145,100 @@ func UpdateSMSRequest(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("FAILED TO PARSE PAYLOAD %s", err)})
 		return
 	}
-	smsrequest, err = models.UpdateSMSRequest(sms_id, smsupdate.Status)
+	smsrequest, err = models.UpdateSMSRequest(sms_id, smsupdate.Status, workerName(c, smsupdate.Worker))
+	if errors.Is(err, models.ErrSMSRequestNotClaimed) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, models.ErrSMSRequestNotUpdatable) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "smsrequest": smsrequest})
+		return
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("SMSRequest ID %s not found", sms_id)})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed updating SMSRequest %s", err)})
 		return
 	}
-	if smsrequest == nil {
+	c.JSON(http.StatusOK, gin.H{"message": "SMSRequest found", "smsrequest": smsrequest})
+}
+
+func CancelSMSRequest(c *gin.Context) {
+	sms_id, goOn := getIDCheckValid(c)
+	if goOn == false {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("ID is invalid %s", sms_id)})
+		return // exit
+	}
+	smsrequest, err := models.CancelSMSRequest(sms_id)
+	if errors.Is(err, models.ErrSMSRequestNotCancellable) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "smsrequest": smsrequest})
+		return
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
 		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("SMSRequest ID %s not found", sms_id)})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "SMSRequest found", "smsrequest": smsrequest})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed cancelling SMSRequest %s", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("SMSRequest %s cancelled", smsrequest.ID), "smsrequest": smsrequest})
+}
+
+// What a worker sends back when the network hands it a status report
+type DeliveryReport struct {
+	PDUStatus  *int  `json:"pdu_status" binding:"required"` // TP-Status byte from the status report PDU
+	ReportedAt int64 `json:"reported_at_ms"`                // optional, defaults to when we got it
 }
 
+func ReportSMSDelivery(c *gin.Context) {
+	var report DeliveryReport
+	sms_id, goOn := getIDCheckValid(c)
+	if goOn == false {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("ID is invalid %s", sms_id)})
+		return // exit
+	}
+	if err := c.ShouldBindJSON(&report); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("FAILED TO PARSE PAYLOAD %s", err)})
+		return
+	}
+	smsrequest, err := models.RecordDeliveryReport(sms_id, *report.PDUStatus, report.ReportedAt)
+	if errors.Is(err, models.ErrSMSRequestNotAwaitingDelivery) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "smsrequest": smsrequest})
+		return
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("SMSRequest ID %s not found", sms_id)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed recording delivery report %s", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Delivery report recorded for %s", smsrequest.ID), "smsrequest": smsrequest})
+}
+
+// Workers name themselves with ?worker=<name> (or "worker" in a PATCH body), older ones that
+// don't are known by their address
+func workerName(c *gin.Context, worker string) string {
+	if worker != "" {
+		return worker
+	}
+	return c.ClientIP()
+}
+
+// The request always comes back already taken by the worker asking, so two workers polling at
+// once never get the same one and a cancel can't slip in before it's marked
 func GetReadyToSendSMS(c *gin.Context) {
-	smsrequest, err := models.GetEarliestSMSRequest()
+	smsrequest, err := models.ClaimSMSRequest(workerName(c, c.Query("worker")))
+	var throttled *models.ThrottledError
+	if errors.As(err, &throttled) {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed to find ready to send SMS %s", err)})
 		return
@@ -141,6 +288,10 @@ func UpdatePhoneOptIn(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid phone number %s", err)})
 		return
 	}
+	// Keep a copy of every reply so it shows up in search/conversations and goes out to webhooks
+	if _, err = recordInboundMessage(optinupdate.Number, "", optinupdate.Codeword); err != nil {
+		fmt.Printf("Failed recording inbound message from %s: %s\n", optinupdate.Number, err)
+	}
 	// Check our optin against the message we got
 	optIn, err := models.UpdateOptInAndRequestsIfAuthD(optinupdate.Number, optinupdate.Codeword)
 	if err != nil {
@@ -149,3 +300,117 @@ func UpdatePhoneOptIn(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, gin.H{"message": "OptIn updated", "optin": optIn})
 }
+
+// Where a number stands against the frequency caps
+func GetRecipientUsage(c *gin.Context) {
+	usage, err := models.GetRecipientUsage(c.Query("number"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("No OptIn record for %s", c.Query("number"))})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed getting usage %s", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Usage for %s", usage.Number), "usage": usage})
+}
+
+type OptInTimezoneUpdate struct {
+	Number   string `json:"number" binding:"required"`
+	Timezone string `json:"timezone"` // IANA name, empty goes back to the area code guess
+}
+
+// Override the timezone quiet hours use for a number
+func UpdateOptInTimezone(c *gin.Context) {
+	var update OptInTimezoneUpdate
+	var err error
+	if err = c.ShouldBindJSON(&update); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("FAILED TO PARSE PAYLOAD %s", err)})
+		return
+	}
+	if update.Number, err = constants.GetPhone(update.Number); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid phone number %s", err)})
+		return
+	}
+	optin, err := models.SetOptInTimezone(update.Number, update.Timezone)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Failed to find OptIn record %s", err)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed updating OptIn timezone %s", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("OptIn timezone updated for %s", optin.Number), "optin": optin})
+}
+
+// Store the reply, thread it and pass it along to the webhooks
+func recordInboundMessage(fromNumber string, toNumber string, message string) (*models.InboundMessage, error) {
+	inbound, thread, err := models.CreateInboundMessage(fromNumber, toNumber, message)
+	if err != nil {
+		return nil, err
+	}
+	helpers.EnqueueInboundWebhookEvent(inbound, thread)
+	return inbound, nil
+}
+
+// What a worker posts when a text lands on its SIM
+type InboundReport struct {
+	FromNumber string `json:"from_number" binding:"required"`
+	ToNumber   string `json:"to_number"` // the worker's own number, optional but threading is better with it
+	Message    string `json:"message"`
+}
+
+func CreateInboundMessage(c *gin.Context) {
+	var report InboundReport
+	if err := c.ShouldBindJSON(&report); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("FAILED TO PARSE PAYLOAD %s", err)})
+		return
+	}
+	inbound, err := recordInboundMessage(report.FromNumber, report.ToNumber, report.Message)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed recording inbound message %s", err)})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": fmt.Sprintf("Inbound message recorded %s", inbound.ID), "inbound": inbound})
+}
+
+func GetConversation(c *gin.Context) {
+	var err error
+	limit := 0
+	if raw := c.Query("limit"); raw != "" {
+		if limit, err = strconv.Atoi(raw); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid limit %s", raw)})
+			return
+		}
+	}
+	entries, nextCursor, err := models.GetConversation(c.Query("a"), c.Query("b"), c.Query("cursor"), limit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed loading conversation %s", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Found %d messages", len(entries)), "conversation": entries, "next_cursor": nextCursor})
+}
+
+func SearchMessages(c *gin.Context) {
+	var err error
+	limit, offset := 0, 0
+	if raw := c.Query("limit"); raw != "" {
+		if limit, err = strconv.Atoi(raw); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid limit %s", raw)})
+			return
+		}
+	}
+	if raw := c.Query("offset"); raw != "" {
+		if offset, err = strconv.Atoi(raw); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid offset %s", raw)})
+			return
+		}
+	}
+	hits, err := models.Search(c.Query("q"), c.Query("kind"), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed searching messages %s", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Found %d messages", len(hits)), "results": hits, "search_backend": models.SearchBackend()})
+}
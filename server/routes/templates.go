@@ -0,0 +1,84 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"microsms/helpers"
+	"microsms/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type TemplateRegistration struct {
+	Name string `json:"name" binding:"required"`
+	Body string `json:"body" binding:"required"` // {{name}} style placeholders
+}
+
+// Create a template, the body goes through the filter in the background and the template can be
+// used once it comes back approved
+func CreateTemplate(c *gin.Context) {
+	var registration TemplateRegistration
+	if err := c.ShouldBindJSON(&registration); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("FAILED TO PARSE PAYLOAD %s", err)})
+		return
+	}
+	template, err := models.CreateTemplate(registration.Name, registration.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed creating template %s", err)})
+		return
+	}
+	filterWG.Add(1)
+	go helpers.CheckTemplate(template.ID, template.Body)
+	c.JSON(http.StatusCreated, gin.H{"message": fmt.Sprintf("Template Created %s, pending filter approval", template.ID), "template": template})
+}
+
+func ListTemplates(c *gin.Context) {
+	templates, err := models.GetTemplates()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed listing templates %s", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Found %d templates", len(templates)), "templates": templates})
+}
+
+func DeleteTemplate(c *gin.Context) {
+	template_id, err := uuid.Parse(c.Query("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("ID is invalid %s", c.Query("id"))})
+		return
+	}
+	err = models.DeleteTemplate(template_id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Template ID %s not found", template_id)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed deleting template %s", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Template %s deleted", template_id)})
+}
+
+// Send a template through the filter again, for when the first check errored out
+func RecheckTemplate(c *gin.Context) {
+	template_id, err := uuid.Parse(c.Query("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("ID is invalid %s", c.Query("id"))})
+		return
+	}
+	template, err := models.ResetTemplateFilter(template_id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Template ID %s not found", template_id)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed rechecking template %s", err)})
+		return
+	}
+	filterWG.Add(1)
+	go helpers.CheckTemplate(template.ID, template.Body)
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Template %s queued for filtering", template.ID), "template": template})
+}
@@ -0,0 +1,124 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"microsms/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type WebhookRegistration struct {
+	URL    string   `json:"url" binding:"required"`
+	Events []string `json:"events"` // empty means every event
+}
+
+func CreateWebhook(c *gin.Context) {
+	var registration WebhookRegistration
+	if err := c.ShouldBindJSON(&registration); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("FAILED TO PARSE PAYLOAD %s", err)})
+		return
+	}
+	webhook, err := models.CreateWebhook(registration.URL, registration.Events)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed creating webhook %s", err)})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": fmt.Sprintf("Webhook Created %s, store the secret it won't be shown again", webhook.ID), "webhook": webhook})
+}
+
+func ListWebhooks(c *gin.Context) {
+	webhooks, err := models.GetWebhooks()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed listing webhooks %s", err)})
+		return
+	}
+	for i := range webhooks {
+		webhooks[i].Secret = "" // secrets only go out once
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Found %d webhooks", len(webhooks)), "webhooks": webhooks})
+}
+
+func DeleteWebhook(c *gin.Context) {
+	webhook_id, err := uuid.Parse(c.Query("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("ID is invalid %s", c.Query("id"))})
+		return
+	}
+	err = models.DeleteWebhook(webhook_id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Webhook ID %s not found", webhook_id)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed deleting webhook %s", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Webhook %s deleted", webhook_id)})
+}
+
+// limit/offset paging for the admin listings
+func getLimitOffset(c *gin.Context) (int, int, error) {
+	var err error
+	limit, offset := 50, 0
+	if raw := c.Query("limit"); raw != "" {
+		if limit, err = strconv.Atoi(raw); err != nil || limit <= 0 || limit > 500 {
+			return 0, 0, fmt.Errorf("Invalid limit %s", raw)
+		}
+	}
+	if raw := c.Query("offset"); raw != "" {
+		if offset, err = strconv.Atoi(raw); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("Invalid offset %s", raw)
+		}
+	}
+	return limit, offset, nil
+}
+
+// Delivery log, ?status=dead gives the dead letter view
+func ListWebhookDeliveries(c *gin.Context) {
+	limit, offset, err := getLimitOffset(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	status := models.WebhookDeliveryStatus(c.Query("status"))
+	switch status {
+	case "", models.WebhookDeliveryStatus_PENDING, models.WebhookDeliveryStatus_DELIVERED, models.WebhookDeliveryStatus_DEAD:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid status %s", status)})
+		return
+	}
+	deliveries, err := models.ListWebhookDeliveries(status, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed listing webhook deliveries %s", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Found %d webhook deliveries", len(deliveries)), "deliveries": deliveries})
+}
+
+func RetryWebhookDelivery(c *gin.Context) {
+	delivery_id, err := uuid.Parse(c.Query("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("ID is invalid %s", c.Query("id"))})
+		return
+	}
+	delivery, err := models.RetryWebhookDelivery(delivery_id, time.Now().UnixMilli())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Webhook delivery ID %s not found", delivery_id)})
+		return
+	}
+	if errors.Is(err, models.ErrWebhookPayloadRedacted) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Webhook delivery %s can't be retried, its payload was redacted", delivery_id)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed retrying webhook delivery %s", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Webhook delivery %s queued for retry", delivery.ID), "delivery": delivery})
+}
@@ -0,0 +1,36 @@
+package routes
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGetLimitOffset(t *testing.T) {
+	tests := []struct {
+		query  string
+		limit  int
+		offset int
+		valid  bool
+	}{
+		{"", 50, 0, true},
+		{"limit=10&offset=20", 10, 20, true},
+		{"limit=500", 500, 0, true},
+		{"limit=501", 0, 0, false},
+		{"limit=0", 0, 0, false},
+		{"limit=ten", 0, 0, false},
+		{"offset=-1", 0, 0, false},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/?"+test.query, nil)
+			limit, offset, err := getLimitOffset(c)
+			if (err == nil) != test.valid || limit != test.limit || offset != test.offset {
+				t.Errorf("got %d, %d (%v), expected %d, %d valid %t", limit, offset, err, test.limit, test.offset, test.valid)
+			}
+		})
+	}
+}